@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/blobstore"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/imaging"
+	"github.com/sirupsen/logrus"
+)
+
+// backfillPlaceholders computes the placeholders (BlurHash and dominant color) of the photos stored before they were
+// computed at upload, for the images of the posts and the profile pics alike. Unlike the migrations, it decodes every
+// photo concerned, which may take a while: it is run on demand (see WebAPIConfiguration.Backfill), and resumed where it
+// stopped if interrupted.
+func backfillPlaceholders(db database.AppDatabase, photos blobstore.BlobStore, logger logrus.FieldLogger) error {
+	digests, err := db.GetBlobsWithoutPlaceholder()
+	if err != nil {
+		return err
+	}
+	logger.WithField("blobs", len(*digests)).Info("backfilling the placeholders of the photos")
+
+	done := 0
+	for _, digest := range *digests {
+		data, err := photos.Get(blobstore.DigestKey(digest))
+		if errors.Is(err, blobstore.ErrNotFound) {
+			logger.WithField("digest", digest).Warn("photo missing, its placeholder not computed")
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		blurHash, color, err := imaging.Placeholder(data)
+		if err != nil {
+			logger.WithError(err).WithField("digest", digest).Warn("photo not readable, its placeholder not computed")
+			continue
+		}
+
+		if err = db.SetBlobPlaceholder(digest, components.Placeholder{BlurHash: blurHash, Color: color}); err != nil {
+			return err
+		}
+		done++
+	}
+	logger.WithFields(logrus.Fields{
+		"blobs":      len(*digests),
+		"backfilled": done,
+	}).Info("placeholders of the photos backfilled")
+
+	return nil
+}
+
+// backfillPhotoHashes computes the perceptual hash of the images of the posts uploaded before the hashes were computed,
+// so that they are found among the similar posts. Like backfillPlaceholders, it decodes every image concerned: it is
+// run on demand, and resumed where it stopped if interrupted. A server running meanwhile finds the hashes backfilled
+// once restarted.
+func backfillPhotoHashes(db database.AppDatabase, photos blobstore.BlobStore, logger logrus.FieldLogger) error {
+	mediaList, err := db.GetPostMediaWithoutHash()
+	if err != nil {
+		return err
+	}
+	logger.WithField("images", len(*mediaList)).Info("backfilling the perceptual hashes of the photos")
+
+	done := 0
+	for _, media := range *mediaList {
+		data, err := photos.Get(blobstore.DigestKey(media.Digest))
+		if errors.Is(err, blobstore.ErrNotFound) {
+			logger.WithField("path", media.Photo).Warn("photo of the post missing, its perceptual hash not computed")
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		hash, err := imaging.PerceptualHash(data)
+		if err != nil {
+			logger.WithError(err).WithField("path", media.Photo).Warn("photo of the post not readable, its perceptual hash not computed")
+			continue
+		}
+
+		if err = db.SetPostMediaHash(media.Photo, hash.String()); err != nil {
+			return err
+		}
+		done++
+	}
+	logger.WithFields(logrus.Fields{
+		"images":     len(*mediaList),
+		"backfilled": done,
+	}).Info("perceptual hashes of the photos backfilled")
+
+	return nil
+}
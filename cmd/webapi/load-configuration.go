@@ -28,6 +28,72 @@ type WebAPIConfiguration struct {
 	DB    struct {
 		Filename string `conf:"default:/tmp/decaf.db"`
 	}
+	Auth struct {
+		SessionTTL   time.Duration `conf:"default:24h"`
+		LoginMode    string        `conf:"default:username"`
+		TokenMode    string        `conf:"default:session"`
+		SigningKeys  string        `conf:"noprint"`
+		SigningKeyID string
+		OIDC         struct {
+			Issuer       string
+			ClientID     string
+			ClientSecret string `conf:"noprint"`
+			RedirectURL  string
+		}
+	}
+	Storage struct {
+		Backend string `conf:"default:filesystem"`
+		Root    string `conf:"default:photos"`
+		S3      struct {
+			Endpoint        string
+			Region          string `conf:"default:us-east-1"`
+			Bucket          string
+			AccessKeyID     string
+			SecretAccessKey string `conf:"noprint"`
+		}
+	}
+	Upload struct {
+		AspectRatio     string        `conf:"default:16:9"`
+		AspectTolerance float64       `conf:"default:0.02"`
+		AspectPolicy    string        `conf:"default:reject"`
+		MaxWidth        int           `conf:"default:4096"`
+		MaxHeight       int           `conf:"default:4096"`
+		MaxMegapixels   int           `conf:"default:50"`
+		KeepEXIF        []string      `conf:"default:DateTimeOriginal"`
+		MaxFrames       int           `conf:"default:300"`
+		MaxDuration     time.Duration `conf:"default:30s"`
+		SessionTTL      time.Duration `conf:"default:24h"`
+	}
+	PhotoURL struct {
+		Key string        `conf:"noprint"`
+		TTL time.Duration `conf:"default:1h"`
+	}
+	RateLimit struct {
+		SessionRequests int           `conf:"default:10"`
+		SessionPeriod   time.Duration `conf:"default:1m"`
+		WritesRequests  int           `conf:"default:60"`
+		WritesPeriod    time.Duration `conf:"default:1m"`
+		ReadsRequests   int           `conf:"default:600"`
+		ReadsPeriod     time.Duration `conf:"default:1m"`
+	}
+	Quota struct {
+		DefaultBytes int64 `conf:"default:1073741824"`
+		Overrides    map[string]int64
+	}
+	Reconciler struct {
+		Interval    time.Duration `conf:"default:1h"`
+		GracePeriod time.Duration `conf:"default:24h"`
+		DryRun      bool
+	}
+	Similarity struct {
+		MaxDistance   int `conf:"default:10"`
+		Blocklist     []string
+		BlockDistance int `conf:"default:4"`
+	}
+	Backfill struct {
+		Placeholders bool
+		Hashes       bool
+	}
 }
 
 // loadConfiguration creates a WebAPIConfiguration starting from flags, environment variables and configuration file.
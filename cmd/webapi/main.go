@@ -8,6 +8,16 @@ Usage:
 
 	webapi [flags]
 
+To compute the placeholders of the photos stored before placeholders were computed at upload, and then exit (instead of
+starting the web servers):
+
+	webapi --backfill-placeholders
+
+Likewise, to compute the perceptual hashes of the photos of the posts uploaded before they were computed at upload (the
+posts are not found among the similar posts until then):
+
+	webapi --backfill-hashes
+
 Flags and configurations are handled automatically by the code in `load-configuration.go`.
 
 Return values (exit codes):
@@ -26,6 +36,7 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -35,8 +46,14 @@ import (
 	"syscall"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/authenticator"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/blobstore"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/imaging"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/photourl"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/ratelimit"
 	"github.com/ardanlabs/conf"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
@@ -98,6 +115,138 @@ func run() error {
 		return fmt.Errorf("creating AppDatabase: %w", err)
 	}
 
+	// Init the authenticator
+	var auth authenticator.Authenticator
+	switch cfg.Auth.TokenMode {
+	case "session":
+		auth, err = authenticator.NewSessionAuthenticator(db, cfg.Auth.SessionTTL)
+	case "signed":
+		var keys map[string][]byte
+		keys, err = authenticator.ParseSigningKeys(cfg.Auth.SigningKeys)
+		if err == nil {
+			auth, err = authenticator.NewSignedAuthenticator(db, keys, cfg.Auth.SigningKeyID, cfg.Auth.SessionTTL)
+		}
+	default:
+		err = fmt.Errorf("unknown token mode %q", cfg.Auth.TokenMode)
+	}
+	if err != nil {
+		logger.WithError(err).Error("error creating the authenticator")
+		return fmt.Errorf("creating the authenticator: %w", err)
+	}
+
+	// Init the OpenID Connect provider, if single sign-on is configured
+	var provider *oidc.Provider
+	if cfg.Auth.OIDC.Issuer != "" {
+		provider, err = oidc.NewProvider(oidc.Config{
+			Issuer:       cfg.Auth.OIDC.Issuer,
+			ClientID:     cfg.Auth.OIDC.ClientID,
+			ClientSecret: cfg.Auth.OIDC.ClientSecret,
+			RedirectURL:  cfg.Auth.OIDC.RedirectURL,
+		})
+		if err != nil {
+			logger.WithError(err).Error("error creating the OpenID Connect provider")
+			return fmt.Errorf("creating the OpenID Connect provider: %w", err)
+		}
+	}
+
+	// Init the photo store
+	var photos blobstore.BlobStore
+	switch cfg.Storage.Backend {
+	case "filesystem":
+		photos, err = blobstore.NewFilesystem(cfg.Storage.Root)
+	case "memory":
+		photos = blobstore.NewMemory()
+	case "s3":
+		photos, err = blobstore.NewS3(blobstore.S3Config{
+			Endpoint:        cfg.Storage.S3.Endpoint,
+			Region:          cfg.Storage.S3.Region,
+			Bucket:          cfg.Storage.S3.Bucket,
+			AccessKeyID:     cfg.Storage.S3.AccessKeyID,
+			SecretAccessKey: cfg.Storage.S3.SecretAccessKey,
+		})
+	default:
+		err = fmt.Errorf("unknown storage backend %q", cfg.Storage.Backend)
+	}
+	if err == nil {
+		err = seedPhotos(photos)
+	}
+	if err != nil {
+		logger.WithError(err).Error("error creating the photo store")
+		return fmt.Errorf("creating the photo store: %w", err)
+	}
+
+	// Fix the photos uploaded before their format was recorded
+	if err = migratePhotoFormats(db, photos, logger); err != nil {
+		logger.WithError(err).Error("error migrating the format of the photos")
+		return fmt.Errorf("migrating the format of the photos: %w", err)
+	}
+
+	// Move the photos stored before photos were stored by digest
+	if err = migratePhotoDigests(db, photos, logger); err != nil {
+		logger.WithError(err).Error("error migrating the photos to their digest")
+		return fmt.Errorf("migrating the photos to their digest: %w", err)
+	}
+
+	// Turn the photos of the posts uploaded before posts had several images into their first image
+	if err = migratePostMedia(db, photos, logger); err != nil {
+		logger.WithError(err).Error("error migrating the posts to images")
+		return fmt.Errorf("migrating the posts to images: %w", err)
+	}
+
+	// Record the size of the photos stored before their size was recorded
+	if err = migrateBlobSizes(db, photos, logger); err != nil {
+		logger.WithError(err).Error("error recording the size of the photos")
+		return fmt.Errorf("recording the size of the photos: %w", err)
+	}
+
+	// Backfill the placeholders and the perceptual hashes of the photos, if asked to, instead of serving
+	if cfg.Backfill.Placeholders || cfg.Backfill.Hashes {
+		if cfg.Backfill.Placeholders {
+			if err = backfillPlaceholders(db, photos, logger); err != nil {
+				logger.WithError(err).Error("error backfilling the placeholders of the photos")
+				return fmt.Errorf("backfilling the placeholders of the photos: %w", err)
+			}
+		}
+		if cfg.Backfill.Hashes {
+			if err = backfillPhotoHashes(db, photos, logger); err != nil {
+				logger.WithError(err).Error("error backfilling the perceptual hashes of the photos")
+				return fmt.Errorf("backfilling the perceptual hashes of the photos: %w", err)
+			}
+		}
+		return nil
+	}
+
+	// Init the policy the uploaded photos are brought to
+	ratioWidth, ratioHeight, err := imaging.ParseRatio(cfg.Upload.AspectRatio)
+	if err != nil {
+		logger.WithError(err).Error("error parsing the aspect ratio of the photos")
+		return fmt.Errorf("parsing the aspect ratio of the photos: %w", err)
+	}
+	photoPolicy := imaging.Policy{
+		RatioWidth:  ratioWidth,
+		RatioHeight: ratioHeight,
+		Tolerance:   cfg.Upload.AspectTolerance,
+		Aspect:      cfg.Upload.AspectPolicy,
+		MaxWidth:    cfg.Upload.MaxWidth,
+		MaxHeight:   cfg.Upload.MaxHeight,
+		MaxPixels:   cfg.Upload.MaxMegapixels * 1000000,
+		KeepEXIF:    cfg.Upload.KeepEXIF,
+		MaxFrames:   cfg.Upload.MaxFrames,
+		MaxDuration: cfg.Upload.MaxDuration,
+	}
+
+	// Init the signer of the photo URLs. The key is base64-encoded: if missing, a random one is generated at each start.
+	photoKey, err := base64.StdEncoding.DecodeString(cfg.PhotoURL.Key)
+	if err != nil {
+		logger.WithError(err).Error("error decoding the photo URL key")
+		return fmt.Errorf("decoding the photo URL key: %w", err)
+	}
+	photoURLs, err := photourl.NewSigner(photoKey, cfg.PhotoURL.TTL)
+	if err != nil {
+		logger.WithError(err).Error("error creating the photo URL signer")
+		return fmt.Errorf("creating the photo URL signer: %w", err)
+	}
+
 	// Start (main) API server
 	logger.Info("initializing API server")
 
@@ -112,8 +261,34 @@ func run() error {
 
 	// Create the API router
 	apirouter, err := api.New(api.Config{
-		Logger:   logger,
-		Database: db,
+		Logger:        logger,
+		Database:      db,
+		Authenticator: auth,
+		Photos:        photos,
+		PhotoPolicy:   photoPolicy,
+		LoginMode:     cfg.Auth.LoginMode,
+		OIDC:          provider,
+		PhotoURLs:     photoURLs,
+		RateLimits: api.RateLimits{
+			Session: ratelimit.Limit{Requests: cfg.RateLimit.SessionRequests, Period: cfg.RateLimit.SessionPeriod},
+			Writes:  ratelimit.Limit{Requests: cfg.RateLimit.WritesRequests, Period: cfg.RateLimit.WritesPeriod},
+			Reads:   ratelimit.Limit{Requests: cfg.RateLimit.ReadsRequests, Period: cfg.RateLimit.ReadsPeriod},
+		},
+		Reconciler: api.ReconcilerConfig{
+			Interval:    cfg.Reconciler.Interval,
+			GracePeriod: cfg.Reconciler.GracePeriod,
+			DryRun:      cfg.Reconciler.DryRun,
+		},
+		Quotas: api.Quotas{
+			Default:   cfg.Quota.DefaultBytes,
+			Overrides: cfg.Quota.Overrides,
+		},
+		UploadTTL: cfg.Upload.SessionTTL,
+		Similarity: api.SimilarityConfig{
+			MaxDistance:   cfg.Similarity.MaxDistance,
+			Blocklist:     cfg.Similarity.Blocklist,
+			BlockDistance: cfg.Similarity.BlockDistance,
+		},
 	})
 	if err != nil {
 		logger.WithError(err).Error("error creating the API server instance")
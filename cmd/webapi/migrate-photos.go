@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"net/http"
+	"path"
+	"strings"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/blobstore"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/imaging"
+	"github.com/sirupsen/logrus"
+)
+
+// migratePhotoFormats records the format of the photos of the posts uploaded before it was recorded. Those photos were
+// all stored with the .png extension, JPEGs included: mislabeled photos (and their renditions) are moved to the path with
+// the right extension. Posts are migrated one at a time, so that an interrupted migration is resumed at the next start.
+func migratePhotoFormats(db database.AppDatabase, photos blobstore.BlobStore, logger logrus.FieldLogger) error {
+	posts, err := db.GetPostsWithoutMIMEType()
+	if err != nil {
+		return err
+	}
+
+	for _, post := range *posts {
+		data, err := photos.Get(post.Photo)
+		if errors.Is(err, blobstore.ErrNotFound) {
+			logger.WithField("path", post.Photo).Warn("photo of the post missing, format not migrated")
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		mimeType := http.DetectContentType(data)
+		extension, ok := components.PhotoExtensions[mimeType]
+		if !ok {
+			logger.WithField("path", post.Photo).Warnf("photo of the post in unsupported format %q, format not migrated", mimeType)
+			continue
+		}
+		newPath := strings.TrimSuffix(post.Photo, path.Ext(post.Photo)) + extension
+
+		// Copy the files to the new path first, and delete the old ones only after the post points to the new path
+		paths := map[string]string{post.Photo: newPath}
+		for _, width := range imaging.Widths {
+			paths[imaging.RenditionPath(post.Photo, width)] = imaging.RenditionPath(newPath, width)
+		}
+		if newPath != post.Photo {
+			for oldPath, newPath := range paths {
+				if err = blobstore.Copy(photos, oldPath, newPath); err != nil && !errors.Is(err, blobstore.ErrNotFound) {
+					return err
+				}
+			}
+		}
+
+		if err = db.SetPostPhoto(post.PostID, newPath, mimeType); err != nil {
+			return err
+		}
+
+		if newPath != post.Photo {
+			for oldPath := range paths {
+				if err = photos.Delete(oldPath); err != nil {
+					return err
+				}
+			}
+			logger.WithFields(logrus.Fields{"from": post.Photo, "to": newPath}).Info("mislabeled photo moved")
+		}
+	}
+
+	return nil
+}
+
+// migratePhotoDigests moves the photos stored before photos were stored by digest (at the path of their post, or at the
+// path of the profile pic of their user) to the key of their digest, and records the references to them. Users whose
+// profile pic is a copy of the default one are left with the default one, with no copy at all.
+func migratePhotoDigests(db database.AppDatabase, photos blobstore.BlobStore, logger logrus.FieldLogger) error {
+	posts, err := db.GetPostsWithoutDigest()
+	if err != nil {
+		return err
+	}
+
+	for _, post := range *posts {
+		data, err := photos.Get(post.Photo)
+		if errors.Is(err, blobstore.ErrNotFound) {
+			logger.WithField("path", post.Photo).Warn("photo of the post missing, not migrated to its digest")
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		// Copy the files to the key of the digest first (renditions before the original, as uploads do), and delete the
+		// old ones only after the post references the digest
+		digest := blobstore.Digest(data)
+		key := blobstore.DigestKey(digest)
+		exists, err := photos.Exists(key)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			for _, width := range imaging.Widths {
+				err = blobstore.Copy(photos, imaging.RenditionPath(post.Photo, width), imaging.RenditionPath(key, width))
+				if err != nil && !errors.Is(err, blobstore.ErrNotFound) {
+					return err
+				}
+			}
+			if err = photos.Put(key, data); err != nil {
+				return err
+			}
+		}
+
+		if err = db.SetPostDigest(post.PostID, digest, int64(len(data))); err != nil {
+			return err
+		}
+
+		for _, width := range imaging.Widths {
+			if err = photos.Delete(imaging.RenditionPath(post.Photo, width)); err != nil {
+				return err
+			}
+		}
+		if err = photos.Delete(post.Photo); err != nil {
+			return err
+		}
+		logger.WithFields(logrus.Fields{"from": post.Photo, "to": key}).Info("photo moved to its digest")
+	}
+
+	users, err := db.GetUsersWithoutProfilePicDigest()
+	if err != nil {
+		return err
+	}
+	if len(*users) == 0 {
+		return nil
+	}
+
+	defaultPic, err := photos.Get(defaultProfilePic)
+	if err != nil {
+		return err
+	}
+	defaultDigest := blobstore.Digest(defaultPic)
+
+	for _, user := range *users {
+		// Users with no profile pic at all get the default one
+		digest := ""
+		data, err := photos.Get(user.ProfilePic)
+		if err == nil {
+			digest = blobstore.Digest(data)
+		} else if !errors.Is(err, blobstore.ErrNotFound) {
+			return err
+		}
+
+		if digest == defaultDigest {
+			digest = ""
+		} else if digest != "" {
+			if err = photos.Put(blobstore.DigestKey(digest), data); err != nil {
+				return err
+			}
+		}
+
+		var size int64
+		if digest != "" {
+			size = int64(len(data))
+		}
+		if _, err = db.SetProfilePicDigest(user.Username, digest, size, components.Placeholder{}); err != nil {
+			return err
+		}
+
+		if user.ProfilePic != defaultProfilePic {
+			if err = photos.Delete(user.ProfilePic); err != nil {
+				return err
+			}
+		}
+	}
+	logger.WithField("users", len(*users)).Info("profile pics moved to their digest")
+
+	return nil
+}
+
+// migratePostMedia records the photos of the posts uploaded before posts had several images as the only image of their
+// post, with its size. The files stay where they are: images are stored by digest as well.
+func migratePostMedia(db database.AppDatabase, photos blobstore.BlobStore, logger logrus.FieldLogger) error {
+	posts, err := db.GetPostsWithoutMedia()
+	if err != nil {
+		return err
+	}
+
+	for _, post := range *posts {
+		data, err := photos.Get(blobstore.DigestKey(post.Digest))
+		if errors.Is(err, blobstore.ErrNotFound) {
+			logger.WithField("path", post.Photo).Warn("photo of the post missing, not migrated to an image")
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			logger.WithError(err).WithField("path", post.Photo).Warn("photo of the post not readable, not migrated to an image")
+			continue
+		}
+
+		if err = db.SetPostMedia(post.PostID, config.Width, config.Height); err != nil {
+			return err
+		}
+	}
+	if len(*posts) > 0 {
+		logger.WithField("posts", len(*posts)).Info("posts migrated to images")
+	}
+
+	return nil
+}
+
+// migrateBlobSizes records the size of the blobs stored before the sizes were recorded, which count towards the quotas
+// of the users
+func migrateBlobSizes(db database.AppDatabase, photos blobstore.BlobStore, logger logrus.FieldLogger) error {
+	digests, err := db.GetBlobsWithoutSize()
+	if err != nil {
+		return err
+	}
+
+	for _, digest := range *digests {
+		blob, err := photos.Open(blobstore.DigestKey(digest))
+		if errors.Is(err, blobstore.ErrNotFound) {
+			logger.WithField("digest", digest).Warn("photo missing, its size not recorded")
+			continue
+		} else if err != nil {
+			return err
+		}
+		size := blob.Size()
+		_ = blob.Close()
+
+		if err = db.SetBlobSize(digest, size); err != nil {
+			return err
+		}
+	}
+	if len(*digests) > 0 {
+		logger.WithField("blobs", len(*digests)).Info("sizes of the photos recorded")
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/blobstore"
+)
+
+// seedDir is the directory holding the photos shipped with the application (see the Dockerfile)
+const seedDir = "photos"
+
+// defaultProfilePic is the key of the profile pic of the users who never set one
+const defaultProfilePic = "profile_pics/default.png"
+
+// seedPhotos copies the photos the application cannot work without (the default profile pic) from seedDir to the photo
+// store, unless they are already there. This way, stores starting empty (e.g., a new bucket) need no manual setup.
+func seedPhotos(photos blobstore.BlobStore) error {
+	for _, key := range []string{defaultProfilePic} {
+		exists, err := photos.Exists(key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(seedDir, filepath.FromSlash(key)))
+		if err != nil {
+			return fmt.Errorf("seeding %q: %w", key, err)
+		}
+		if err = photos.Put(key, data); err != nil {
+			return fmt.Errorf("seeding %q: %w", key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"github.com/julienschmidt/httprouter"
+)
+
+func (rt _router) createAPIKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Retrieve the username of the authenticated user
+	authUsername := helperAuth(w, r, ps, ctx, rt)
+	if authUsername == nil {
+		return
+	}
+
+	// Retrieve the username from the path
+	username, _ := helperPost(w, r, ps, ctx, rt, false)
+	if username == nil {
+		return
+	}
+
+	// Check if the username in the path and the authenticated one are the same
+	if *username != *authUsername {
+		w.WriteHeader(http.StatusForbidden)
+		ctx.Logger.Error("authenticated user cannot create API keys on behalf of another user")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusForbidden, "authenticated user cannot create API keys on behalf of another user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		ctx.Logger.Error("unsupported media type provided")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusUnsupportedMediaType).Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Retrieve the name, the scopes and the expiration of the key from the request body
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while reading the body of the request")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while reading the body of the request").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	var apiKey components.APIKey
+	if err = json.Unmarshal(body, &apiKey); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx.Logger.WithError(err).Error("error while decoding the API key from the body of the request")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "error while decoding the API key from the body of the request").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Check if the provided name is valid
+	if err = components.CheckIfValid(apiKey.Name, "APIKeyName"); err != nil {
+		var mess []byte
+		if errors.Is(err, components.ErrAPIKeyNameNotValid) {
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.WithError(err).Error("provided API key name not valid")
+			mess = []byte(fmt.Errorf(components.StatusBadRequest, "provided API key name not valid").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while checking if the API key name is valid")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while checking if the API key name is valid").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Check if the provided scopes are known (duplicates are dropped)
+	scopes, err := checkScopes(apiKey.Scopes)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx.Logger.WithError(err).Error("provided scopes not valid")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "provided scopes not valid").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Check if the provided expiration (if any) is valid, and in the future
+	var expiresAt time.Time
+	if apiKey.ExpiresAt != "" {
+		if err = components.CheckIfValid(apiKey.ExpiresAt, "Datetime"); err == nil {
+			expiresAt, err = time.ParseInLocation("2006-01-02 15:04:05", apiKey.ExpiresAt, time.Local)
+		}
+		if err == nil && !expiresAt.After(globaltime.Now()) {
+			err = components.ErrDatetimeNotValid
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.WithError(err).Error("provided expiration not valid")
+			if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "provided expiration not valid").Error())); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			return
+		}
+	}
+
+	// Create the key
+	created, err := rt.db.CreateAPIKey(*username, apiKey.Name, scopes, expiresAt)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while creating the API key")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while creating the API key").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Send the key to the client: this is the only time it is shown
+	response, err := json.MarshalIndent(*created, "", " ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while encoding the response as JSON")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while encoding the response as JSON").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if _, err = w.Write(response); err != nil {
+		ctx.Logger.WithError(err).Error("error while writing the response")
+	}
+
+}
+
+func (rt _router) getMyAPIKeys(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Retrieve the username of the authenticated user
+	authUsername := helperAuth(w, r, ps, ctx, rt)
+	if authUsername == nil {
+		return
+	}
+
+	// Retrieve the username from the path
+	username, _ := helperPost(w, r, ps, ctx, rt, false)
+	if username == nil {
+		return
+	}
+
+	// Check if the username in the path and the authenticated one are the same
+	if *username != *authUsername {
+		w.WriteHeader(http.StatusForbidden)
+		ctx.Logger.Error("authenticated user cannot see the API keys of another user")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusForbidden, "authenticated user cannot see the API keys of another user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Retrieve the API keys of the user
+	apiKeys, err := rt.db.GetUserAPIKeys(*username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while retrieving the API keys of the user")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while retrieving the API keys of the user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Encode the response as JSON
+	response, err := json.MarshalIndent(*apiKeys, "", " ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while encoding the response as JSON")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while encoding the response as JSON").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Send the response to the client, if not empty
+	if len(*apiKeys) > 0 {
+		w.WriteHeader(http.StatusOK)
+		if _, err = w.Write(response); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+}
+
+func (rt _router) revokeAPIKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Retrieve the username of the authenticated user
+	authUsername := helperAuth(w, r, ps, ctx, rt)
+	if authUsername == nil {
+		return
+	}
+
+	// Retrieve the username from the path
+	username, _ := helperPost(w, r, ps, ctx, rt, false)
+	if username == nil {
+		return
+	}
+
+	// Check if the username in the path and the authenticated one are the same
+	if *username != *authUsername {
+		w.WriteHeader(http.StatusForbidden)
+		ctx.Logger.Error("authenticated user cannot revoke the API keys of another user")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusForbidden, "authenticated user cannot revoke the API keys of another user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Revoke the key, if it belongs to the authenticated user
+	if err := rt.db.DeleteAPIKey(*username, ps.ByName("key_id")); err != nil {
+		var mess []byte
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			ctx.Logger.WithError(err).Error("provided API key does not exist")
+			mess = []byte(fmt.Errorf(components.StatusNotFound, "provided API key does not exist").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while revoking the API key")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while revoking the API key").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+// checkScopes checks that at least one scope is provided and that all of them are known, and drops the duplicates
+func checkScopes(scopes []string) ([]string, error) {
+	var checked []string
+	seen := make(map[string]bool)
+	for _, scope := range scopes {
+		known := false
+		for _, s := range components.Scopes {
+			if s == scope {
+				known = true
+			}
+		}
+		if !known {
+			return nil, components.ErrScopeNotValid
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			checked = append(checked, scope)
+		}
+	}
+	if len(checked) == 0 {
+		return nil, components.ErrScopeNotValid
+	}
+	return checked, nil
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/gofrs/uuid"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
+	"net"
 	"net/http"
 )
 
@@ -22,7 +23,12 @@ func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Re
 			return
 		}
 		var ctx = reqcontext.RequestContext{
-			ReqUUID: reqUUID,
+			ReqUUID:   reqUUID,
+			RemoteIP:  r.RemoteAddr,
+			UserAgent: r.UserAgent(),
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			ctx.RemoteIP = host
 		}
 
 		// Create a request-specific logger
@@ -31,7 +37,21 @@ func (rt *_router) wrap(fn httpRouterHandler) func(http.ResponseWriter, *http.Re
 			"remote-ip": r.RemoteAddr,
 		})
 
+		// Resolve the user making the request (if any), and throttle the clients exceeding the limits of the route
+		ctx.Username = rt.identify(r)
+		if !rt.allow(w, r, ctx) {
+			return
+		}
+
 		// Call the next handler in chain (usually, the handler function for the path)
 		fn(w, r, ps, ctx)
 	}
 }
+
+// scoped marks the route handled by fn as accessible with API keys granted any of the given scopes (see helperAuth)
+func scoped(fn httpRouterHandler, scopes ...string) httpRouterHandler {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+		ctx.Scopes = scopes
+		fn(w, r, ps, ctx)
+	}
+}
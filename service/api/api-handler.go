@@ -2,6 +2,8 @@ package api
 
 import (
 	"net/http"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
 )
 
 // Handler returns an instance of httprouter.Router that handle APIs registered here
@@ -39,32 +41,56 @@ func (rt *_router) Handler() http.Handler {
 
 	// Session routes
 	rt.router.POST("/session", rt.wrap(rt.doLogin))
+	rt.router.DELETE("/session", rt.wrap(rt.doLogout))
+	rt.router.GET("/session/oidc", rt.wrap(rt.startOIDCLogin))
+	rt.router.GET("/session/oidc/callback", rt.wrap(rt.finishOIDCLogin))
+	rt.router.GET("/users/:username/sessions", rt.wrap(rt.getMySessions))
+	rt.router.DELETE("/users/:username/sessions/:session_id", rt.wrap(rt.revokeSession))
+	rt.router.PUT("/users/:username/password", rt.wrap(rt.setMyPassword))
+	rt.router.POST("/users/:username/2fa", rt.wrap(rt.enrollTOTP))
+	rt.router.PUT("/users/:username/2fa", rt.wrap(rt.confirmTOTP))
+	rt.router.DELETE("/users/:username/2fa", rt.wrap(rt.disableTOTP))
+
+	// API key routes (only reachable with a session token)
+	rt.router.POST("/users/:username/apikeys", rt.wrap(rt.createAPIKey))
+	rt.router.GET("/users/:username/apikeys", rt.wrap(rt.getMyAPIKeys))
+	rt.router.DELETE("/users/:username/apikeys/:key_id", rt.wrap(rt.revokeAPIKey))
 
 	// Profile routes
-	rt.router.GET("/users/:username/profile/", rt.wrap(rt.getUserProfile))
+	rt.router.GET("/users/:username/profile/", rt.wrap(scoped(rt.getUserProfile, components.ScopeReadProfile)))
 	rt.router.PUT("/users/:username/profile/", rt.wrap(rt.setMyUserName))
+	rt.router.PUT("/users/:username/profile/picture", rt.wrap(rt.setMyProfilePicture))
+	rt.router.DELETE("/users/:username/profile/picture", rt.wrap(rt.deleteMyProfilePicture))
 
 	// Photo routes
-	rt.router.GET("/photos/", rt.wrap(rt.getPhotoFromURL))
+	rt.router.GET("/photos/", rt.wrap(scoped(rt.getPhotoFromURL, components.ScopeReadProfile, components.ScopeReadStream)))
 
 	// Post routes
-	rt.router.PUT("/users/:username/profile/posts/:post_id/likes/:liker_username", rt.wrap(rt.likePhoto))
-	rt.router.DELETE("/users/:username/profile/posts/:post_id/likes/:liker_username", rt.wrap(rt.unlikePhoto))
-	rt.router.POST("/users/:username/profile/posts/:post_id/comments/", rt.wrap(rt.commentPhoto))
-	rt.router.DELETE("/users/:username/profile/posts/:post_id/comments/:comment_id", rt.wrap(rt.uncommentPhoto))
-	rt.router.POST("/users/:username/profile/posts/", rt.wrap(rt.uploadPhoto))
-	rt.router.DELETE("/users/:username/profile/posts/:post_id/", rt.wrap(rt.deletePhoto))
+	rt.router.PUT("/users/:username/profile/posts/:post_id/likes/:liker_username", rt.wrap(scoped(rt.likePhoto, components.ScopeWriteSocial)))
+	rt.router.DELETE("/users/:username/profile/posts/:post_id/likes/:liker_username", rt.wrap(scoped(rt.unlikePhoto, components.ScopeWriteSocial)))
+	rt.router.POST("/users/:username/profile/posts/:post_id/comments/", rt.wrap(scoped(rt.commentPhoto, components.ScopeWriteSocial)))
+	rt.router.DELETE("/users/:username/profile/posts/:post_id/comments/:comment_id", rt.wrap(scoped(rt.uncommentPhoto, components.ScopeWriteSocial)))
+	rt.router.POST("/users/:username/profile/posts/", rt.wrap(scoped(rt.uploadPhoto, components.ScopeWritePosts)))
+	rt.router.DELETE("/users/:username/profile/posts/:post_id/", rt.wrap(scoped(rt.deletePhoto, components.ScopeWritePosts)))
+
+	rt.router.GET("/posts/:post_id/similar", rt.wrap(scoped(rt.getSimilarPosts, components.ScopeReadStream)))
+
+	// Upload routes
+	rt.router.POST("/users/:username/profile/uploads/", rt.wrap(scoped(rt.createUpload, components.ScopeWritePosts)))
+	rt.router.GET("/users/:username/profile/uploads/:upload_id", rt.wrap(scoped(rt.getUpload, components.ScopeWritePosts)))
+	rt.router.PATCH("/users/:username/profile/uploads/:upload_id", rt.wrap(scoped(rt.appendUpload, components.ScopeWritePosts)))
+	rt.router.DELETE("/users/:username/profile/uploads/:upload_id", rt.wrap(scoped(rt.deleteUpload, components.ScopeWritePosts)))
 
 	// Stream routes
-	rt.router.GET("/users/:username/stream", rt.wrap(rt.getMyStream))
+	rt.router.GET("/users/:username/stream", rt.wrap(scoped(rt.getMyStream, components.ScopeReadStream)))
 
 	// Follow routes
-	rt.router.PUT("/users/:username/followings/:followed_username", rt.wrap(rt.followUser))
-	rt.router.DELETE("/users/:username/followings/:followed_username", rt.wrap(rt.unfollowUser))
+	rt.router.PUT("/users/:username/followings/:followed_username", rt.wrap(scoped(rt.followUser, components.ScopeWriteSocial)))
+	rt.router.DELETE("/users/:username/followings/:followed_username", rt.wrap(scoped(rt.unfollowUser, components.ScopeWriteSocial)))
 
 	// Ban routes
-	rt.router.PUT("/users/:username/banned/:banned_username", rt.wrap(rt.banUser))
-	rt.router.DELETE("/users/:username/banned/:banned_username", rt.wrap(rt.unbanUser))
+	rt.router.PUT("/users/:username/banned/:banned_username", rt.wrap(scoped(rt.banUser, components.ScopeWriteSocial)))
+	rt.router.DELETE("/users/:username/banned/:banned_username", rt.wrap(scoped(rt.unbanUser, components.ScopeWriteSocial)))
 
 	return rt.router
 }
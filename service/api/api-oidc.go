@@ -0,0 +1,219 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc"
+	"github.com/dchest/uniuri"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Time the user has to complete the login on the provider
+const oidcLoginTTL = 10 * time.Minute
+
+func (rt _router) startOIDCLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if single sign-on is configured
+	if rt.oidc == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		ctx.Logger.Error("single sign-on is not configured")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusNotImplemented, "single sign-on is not configured").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Generate the state, the nonce and the PKCE code verifier of this login
+	var values [3]string
+	for i := range values {
+		value, err := oidc.NewVerifier()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while generating the login parameters")
+			if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while generating the login parameters").Error())); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			return
+		}
+		values[i] = value
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	// Remember them until the provider redirects the user back
+	if err := rt.db.CreateOIDCLogin(state, verifier, nonce, oidcLoginTTL); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while storing the pending login")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while storing the pending login").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	location, err := rt.oidc.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while reaching the identity provider")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while reaching the identity provider").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Send the user to the provider
+	w.Header().Set("Location", location)
+	w.WriteHeader(http.StatusFound)
+
+}
+
+func (rt _router) finishOIDCLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if single sign-on is configured
+	if rt.oidc == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		ctx.Logger.Error("single sign-on is not configured")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusNotImplemented, "single sign-on is not configured").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// The provider reports failed (or denied) logins in the query
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		ctx.Logger.Error("identity provider refused the login: " + providerErr)
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusUnauthorized, "identity provider refused the login").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	code, state := query.Get("code"), query.Get("state")
+	if code == "" || state == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx.Logger.Error("code or state missing in the callback")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "code or state missing in the callback").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Retrieve the pending login: an unknown state means the callback has not been requested by this server
+	login, err := rt.db.ConsumeOIDCLogin(state)
+	if err != nil {
+		var mess []byte
+		if errors.Is(err, sql.ErrNoRows) || errors.Is(err, components.ErrLoginExpired) {
+			w.WriteHeader(http.StatusUnauthorized)
+			ctx.Logger.WithError(err).Error("unknown or expired login state")
+			mess = []byte(fmt.Errorf(components.StatusUnauthorized, "unknown or expired login state").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while retrieving the pending login")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while retrieving the pending login").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Redeem the code and verify the ID token
+	claims, err := rt.oidc.Exchange(code, login.Verifier, login.Nonce)
+	if err != nil {
+		var mess []byte
+		if errors.Is(err, oidc.ErrInvalidIDToken) {
+			w.WriteHeader(http.StatusUnauthorized)
+			ctx.Logger.WithError(err).Error("invalid ID token received from the identity provider")
+			mess = []byte(fmt.Errorf(components.StatusUnauthorized, "invalid ID token received from the identity provider").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while redeeming the code at the identity provider")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while redeeming the code at the identity provider").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Retrieve the user linked to the subject, creating it on the first login
+	user, err := rt.db.GetUserByOIDCSubject(rt.oidc.Issuer(), claims.Subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		user, err = rt.postOIDCUser(claims)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while retrieving the user linked to the identity")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while retrieving the user linked to the identity").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Open a new session for the user, exactly as POST /session does
+	token, err := rt.auth.IssueToken(user.Username, ctx.UserAgent, ctx.RemoteIP)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while creating the session for the given user")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while creating the session for the given user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+	user.ID = *token
+	rt.signUser(user, user.Username)
+
+	response, err := json.MarshalIndent(&user, "", " ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while enconding the response body as JSON")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while enconding the response body as JSON").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if _, err = w.Write(response); err != nil {
+		ctx.Logger.WithError(err).Error("error while writing the response")
+	}
+
+}
+
+// postOIDCUser creates the local user of a subject logging in for the first time. The username suggested by the
+// provider is used if valid and free, a random one otherwise (the user can change it later).
+func (rt _router) postOIDCUser(claims *oidc.Claims) (*components.User, error) {
+
+	candidates := []string{}
+	if components.CheckIfValid(claims.PreferredUsername, "Username") == nil {
+		candidates = append(candidates, claims.PreferredUsername)
+	}
+	for i := 0; i < 3; i++ {
+		candidates = append(candidates, "user_"+strings.ToLower(uniuri.NewLen(10)))
+	}
+
+	for _, username := range candidates {
+		user, err := rt.db.PostOIDCUser(rt.oidc.Issuer(), claims.Subject, username)
+		if errors.Is(err, components.ErrUsernameTaken) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+
+	return nil, components.ErrUsernameTaken
+
+}
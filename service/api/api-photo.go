@@ -1,61 +1,365 @@
 package api
 
 import (
-	"bufio"
+	"database/sql"
+	"errors"
 	"fmt"
-	"io"
+	"io/fs"
 	"net/http"
-	"os"
+	"strconv"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/blobstore"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/imaging"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/photourl"
 	"github.com/julienschmidt/httprouter"
 )
 
-func (rt _router) getPhotoFromURL(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+// Key of the profile pic of the users who never set one
+const defaultProfilePic = "profile_pics/default.png"
 
-	// ADD AUTHENTICATION
+// Side (in pixels) of the square the profile pics are scaled down to fit in
+const profilePicMaxSize = 1024
 
-	// ADD BAN CHECK
+func (rt _router) getPhotoFromURL(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 
 	w.Header().Set("Content-Type", "application/json")
 
 	// Retrieve the path of the photo
-	path := r.URL.Query().Get("photo_path")
+	query := r.URL.Query()
+	path := query.Get("photo_path")
 
-	// Open the image
-	img, err := os.Open("photos/" + path)
+	// Retrieve the user the photo is requested by: the viewer of a signed URL, or the authenticated user
+	var authUsername *string
+	if signature := query.Get("signature"); signature != "" {
+		viewer := query.Get("viewer")
+		if err := rt.photoURLs.Verify(path, viewer, query.Get("expires"), signature); err != nil {
+			var mess []byte
+			if errors.Is(err, photourl.ErrExpired) {
+				w.WriteHeader(http.StatusUnauthorized)
+				ctx.Logger.WithError(err).Error("the provided photo URL has expired")
+				mess = []byte(fmt.Errorf(components.StatusUnauthorized, "the provided photo URL has expired").Error())
+			} else {
+				w.WriteHeader(http.StatusUnauthorized)
+				ctx.Logger.WithError(err).Error("the provided photo URL is not correctly signed")
+				mess = []byte(fmt.Errorf(components.StatusUnauthorized, "the provided photo URL is not correctly signed").Error())
+			}
+			if _, err = w.Write(mess); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			return
+		}
+		authUsername = &viewer
+	} else if authUsername = helperAuth(w, r, ps, ctx, rt); authUsername == nil {
+		return
+	}
+
+	if path == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx.Logger.Error("no photo path provided")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "no photo path provided").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Check if the requested size (if any) is one of the sizes of the renditions
+	var size int
+	if rawSize := query.Get("size"); rawSize != "" {
+		var err error
+		if size, err = strconv.Atoi(rawSize); err != nil || !imaging.IsWidth(size) {
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.Error("provided size not valid")
+			if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "provided size not valid").Error())); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			return
+		}
+	}
+
+	// Only the paths the database knows about can be served: anything else (e.g., ../ tricks) is not found
+	owner, err := rt.db.GetPhotoOwner(path)
+	if err == nil && !fs.ValidPath(path) {
+		err = sql.ErrNoRows
+	}
 	if err != nil {
+		var mess []byte
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			ctx.Logger.WithError(err).Error("provided photo does not exist")
+			mess = []byte(fmt.Errorf(components.StatusNotFound, "provided photo does not exist").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while retrieving the owner of the photo")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while retrieving the owner of the photo").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Check if the authenticated user banned the owner of the photo, or viceversa
+	if err := rt.db.CheckIfBanned(*authUsername, *owner); err == nil {
+		w.WriteHeader(http.StatusForbidden)
+		ctx.Logger.Error("cannot get the photo of a banned user or that has banned the authenticated user")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusForbidden, "cannot get the photo of a banned user or that has banned the authenticated user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	} else if !errors.Is(err, sql.ErrNoRows) {
 		w.WriteHeader(http.StatusInternalServerError)
-		ctx.Logger.WithError(err).Error("error while opening the file specified by the given path")
-		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while opening the file specified by the given path").Error())); err != nil {
+		ctx.Logger.WithError(err).Error("error while checking if the authenticated user banned the other user or viceversa")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while checking if the authenticated user banned the other user or viceversa").Error())); err != nil {
 			ctx.Logger.WithError(err).Error("error while writing the response")
 		}
 		return
 	}
 
-	// Read the image
-	reader := bufio.NewReader(img)
-	content, err := io.ReadAll(reader)
+	// Retrieve the digest the photo is stored by. Users who never set a profile pic have the default one.
+	digest, err := rt.db.GetPhotoDigest(path)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		ctx.Logger.WithError(err).Error("error while reading the content of the file specified by the given path")
-		ctx.Logger.Info(path)
-		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while reading the content of the file specified by the given path").Error())); err != nil {
+		var mess []byte
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			ctx.Logger.WithError(err).Error("the photo has no digest")
+			mess = []byte(fmt.Errorf(components.StatusNotFound, "provided photo does not exist").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while retrieving the digest of the photo")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while retrieving the digest of the photo").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
 			ctx.Logger.WithError(err).Error("error while writing the response")
 		}
 		return
 	}
+	key := defaultProfilePic
+	if *digest != "" {
+		key = blobstore.DigestKey(*digest)
+	}
 
-	// Send the image to the client
-	w.Header().Set("Content-Type", "image/png")
-	if _, err = w.Write(content); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		ctx.Logger.WithError(err).Error(("error while writing the response in the response body"))
-		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, err).Error())); err != nil {
-			ctx.Logger.WithError(err).Error("error while writing the response in the response body")
+	// Open the image in the store: the rendition of the requested size if there is one (photos narrower than the size
+	// have none), the original otherwise
+	var blob blobstore.Blob
+	rendition := size != 0
+	err = blobstore.ErrNotFound
+	if rendition {
+		blob, err = rt.photos.Open(imaging.RenditionPath(key, size))
+	}
+	if errors.Is(err, blobstore.ErrNotFound) {
+		rendition = false
+		blob, err = rt.photos.Open(key)
+	}
+	if err != nil {
+		var mess []byte
+		if errors.Is(err, blobstore.ErrNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			ctx.Logger.WithError(err).Error("the file of the photo is missing")
+			mess = []byte(fmt.Errorf(components.StatusNotFound, "provided photo does not exist").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while retrieving the photo from the store")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while retrieving the photo from the store").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
 		}
 		return
 	}
+	defer blob.Close()
+
+	// Photos stored by digest are tagged by it (and by the width, for renditions): their content can never change. The
+	// default profile pic is tagged by when it was stored and by its size.
+	etag := strconv.FormatInt(blob.ModTime().UnixNano(), 36) + "-" + strconv.FormatInt(blob.Size(), 36)
+	if *digest != "" {
+		etag = *digest
+		if rendition {
+			etag += ".w" + strconv.Itoa(size)
+		}
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+
+	// Photos are for the viewer only, and profile pics can be replaced at the same path: caches can keep them, but have
+	// to revalidate them (cheaply, by ETag) at each use
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	// Send the image to the client, streaming it from the store. ServeContent answers conditional requests (with 304 Not
+	// Modified) and byte-range requests, and sniffs the content type from the content rather than trusting the extension.
+	w.Header().Del("Content-Type")
+	http.ServeContent(w, r, "", blob.ModTime(), blob)
+
+}
+
+// signUser replaces the path of the profile picture of the user with a URL signed for the viewer
+func (rt _router) signUser(user *components.User, viewer string) {
+	user.ProfilePic = rt.photoURLs.Sign(user.ProfilePic, viewer)
+}
+
+// signUsers replaces the paths of the profile pictures of the users with URLs signed for the viewer
+func (rt _router) signUsers(users []components.User, viewer string) {
+	for i := range users {
+		rt.signUser(&users[i], viewer)
+	}
+}
+
+// signPosts replaces the paths of the photos of the posts (and of their renditions, and of the profile pictures of their
+// likers) with URLs signed for the viewer
+func (rt _router) signPosts(posts []components.Post, viewer string) {
+	for i := range posts {
+		rt.signPost(&posts[i], viewer)
+	}
+}
 
+// signPost replaces the paths of the photos of the post (and of their renditions, and of the profile pictures of its
+// likers) with URLs signed for the viewer
+func (rt _router) signPost(post *components.Post, viewer string) {
+	rt.signRenditions(post.Renditions, post.Photo, viewer)
+	post.Photo = rt.photoURLs.Sign(post.Photo, viewer)
+	for i := range post.Media {
+		rt.signRenditions(post.Media[i].Renditions, post.Media[i].Photo, viewer)
+		post.Media[i].Photo = rt.photoURLs.Sign(post.Media[i].Photo, viewer)
+	}
+	rt.signUsers(post.Likes, viewer)
+}
+
+// signRenditions sets the URLs of the renditions of the photo at the given path, signed for the viewer
+func (rt _router) signRenditions(renditions []components.Rendition, path string, viewer string) {
+	for i := range renditions {
+		renditions[i].Photo = rt.photoURLs.Sign(path, viewer) + "&size=" + strconv.Itoa(renditions[i].Width)
+	}
+}
+
+// signProfile replaces the paths of all the photos in the profile with URLs signed for the viewer
+func (rt _router) signProfile(profile *components.Profile, viewer string) {
+	rt.signUser(&profile.User, viewer)
+	rt.signPosts(profile.Posts, viewer)
+	rt.signUsers(profile.Followings, viewer)
+	rt.signUsers(profile.Followers, viewer)
+	rt.signUsers(profile.Banned, viewer)
+}
+
+// storePhotoBlob stores the photo with the given digest, with its renditions, under the key of the digest. Photos already
+// stored (by another post or profile pic) are not stored again. The caller must not hold blobLock, but must have marked
+// the photo as being stored with beginStoring, so that it is not deleted meanwhile.
+func (rt _router) storePhotoBlob(digest string, content []byte, renditions []imaging.Rendition) error {
+	key := blobstore.DigestKey(digest)
+	exists, err := rt.photos.Exists(key)
+	if err != nil {
+		return err
+	}
+
+	// The same photo can be both a post and a profile pic, with renditions of different widths: the ones missing are
+	// added to the photo already stored
+	if exists {
+		for _, rendition := range renditions {
+			renditionKey := imaging.RenditionPath(key, rendition.Width)
+			if exists, err = rt.photos.Exists(renditionKey); err == nil && !exists {
+				err = rt.photos.Put(renditionKey, rendition.Data)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// The original is stored last: if it exists, its renditions do too. A photo partially stored is deleted by
+	// endStoring, as nothing references it.
+	for _, rendition := range renditions {
+		if err = rt.photos.Put(imaging.RenditionPath(key, rendition.Width), rendition.Data); err != nil {
+			return err
+		}
+	}
+	return rt.photos.Put(key, content)
+}
+
+// beginStoring marks the photos with the given digests as being stored by a request, and reserves their size in the
+// quota of the user, so that the photos can be stored without holding blobLock. The caller must hold blobLock, and call
+// endStoring (holding it again) once the references to the photos have been recorded, or have failed to be.
+func (rt _router) beginStoring(username string, digests []string, size int64) {
+	for _, digest := range digests {
+		rt.storing[digest]++
+	}
+	rt.reserved[username] += size
+}
+
+// endStoring undoes beginStoring. If recording the references failed, the photos that nothing references are deleted,
+// unless another request is storing them: failing that is only logged, the orphans being harmless. The caller must hold
+// blobLock.
+func (rt _router) endStoring(username string, digests []string, size int64, recorded bool) {
+	for _, digest := range digests {
+		if rt.storing[digest]--; rt.storing[digest] == 0 {
+			delete(rt.storing, digest)
+		}
+	}
+	if rt.reserved[username] -= size; rt.reserved[username] == 0 {
+		delete(rt.reserved, username)
+	}
+	if recorded {
+		return
+	}
+
+	for _, digest := range digests {
+		if rt.storing[digest] > 0 {
+			continue
+		}
+		referenced, err := rt.db.IsBlobReferenced(digest)
+		if err == nil && !referenced {
+			err = rt.deletePhotoFiles(blobstore.DigestKey(digest))
+		}
+		if err != nil {
+			rt.baseLogger.WithError(err).Error("error while deleting the photo just stored")
+		}
+	}
+}
+
+// removePost deletes the post, and the photos of the post from the store that no other post or profile pic references,
+// nor any request is storing
+func (rt _router) removePost(postID string) error {
+	rt.blobLock.Lock()
+	defer rt.blobLock.Unlock()
+
+	unreferenced, err := rt.db.DeletePost(postID)
+	if err != nil {
+		return err
+	}
+	rt.hashes.remove(postID)
+	for _, digest := range *unreferenced {
+		// A request storing the same photo is about to reference it again
+		if rt.storing[digest] > 0 {
+			continue
+		}
+		if err = rt.deletePhotoFiles(blobstore.DigestKey(digest)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setProfilePic makes the photo with the given digest, size and placeholder (empty for the default one) the profile pic
+// of the user. The previous profile pic is deleted from the store if nothing else references it (nor is storing it):
+// failing that is only logged, the orphan being harmless. The caller must hold blobLock.
+func (rt _router) setProfilePic(username string, digest string, size int64, placeholder components.Placeholder) error {
+	unreferenced, err := rt.db.SetProfilePicDigest(username, digest, size, placeholder)
+	if err != nil {
+		return err
+	}
+	if *unreferenced != "" && rt.storing[*unreferenced] == 0 {
+		if err := rt.deletePhotoFiles(blobstore.DigestKey(*unreferenced)); err != nil {
+			rt.baseLogger.WithError(err).Error("error while deleting the previous profile pic")
+		}
+	}
+	return nil
+}
+
+// deletePhotoFiles removes the photo stored at the given key from the store, alongside its renditions
+func (rt _router) deletePhotoFiles(key string) error {
+	for _, width := range imaging.AllWidths() {
+		if err := rt.photos.Delete(imaging.RenditionPath(key, width)); err != nil {
+			return err
+		}
+	}
+	return rt.photos.Delete(key)
 }
@@ -5,20 +5,27 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"image"
 
 	_ "image/jpeg" // Blank import for accepting jpeg images with the image package
 	_ "image/png"  // Blank import for accepting png images with the image package
 	"io"
 	"net/http"
-	"os"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/blobstore"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/imaging"
 	"github.com/julienschmidt/httprouter"
 	"github.com/mattn/go-sqlite3"
 )
 
+// Maximum number of photos in a post
+const maxPostMedia = 10
+
+// Maximum size of a multipart form uploading photos, whatever the number of photos in it (each of them is limited to
+// maxUploadSize on its own)
+const maxPhotosBodySize = 32 * 1024 * 1024
+
 func (rt _router) likePhoto(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 
 	w.Header().Set("Content-Type", "application/json")
@@ -342,102 +349,53 @@ func (rt _router) uploadPhoto(w http.ResponseWriter, r *http.Request, ps httprou
 		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, 10*1024*1024)
-
-	// Retrieve the post from the request body
-	if err := r.ParseMultipartForm(10 << 20); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		ctx.Logger.WithError(err).Error("error while decoding the body of the request")
-		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while decoding the body of the request").Error())); err != nil {
-			ctx.Logger.WithError(err).Error("error while writing the response")
-		}
-		return
-	}
-
-	// Access the request body
-	formData := r.MultipartForm
-
-	rawPhoto := formData.File["photoFile"]
-	if len(rawPhoto) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		ctx.Logger.Error("no photo provided")
-		if _, err := w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "no photo provided").Error())); err != nil {
-			ctx.Logger.WithError(err).Error("error while writing the response")
-		}
-		return
-	}
-	photo := rawPhoto[0]
-
-	// Access the photo file
-	fileReader, err := photo.Open()
-	if err != nil {
-		http.Error(w, "Unable to open photo file", http.StatusInternalServerError)
-		return
-	}
-	defer fileReader.Close()
-
-	// Check if the provided file is an image (check the first 512 bytes to determine its Content-Type)
-	buff := make([]byte, 512)
-	if _, err = fileReader.Read(buff); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		ctx.Logger.WithError(err).Error("error while checking if the provided file is an image")
-		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while checking if the provided file is an image").Error())); err != nil {
-			ctx.Logger.WithError(err).Error("error while writing the response")
-		}
-		return
-	}
-	ctx.Logger.Info(http.DetectContentType(buff))
-	if http.DetectContentType(buff) != "image/png" && http.DetectContentType(buff) != "image/jpeg" {
-		w.WriteHeader(http.StatusBadRequest)
-		ctx.Logger.Error("provided file not an image")
-		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "provided file not an image").Error())); err != nil {
-			ctx.Logger.WithError(err).Error("error while writing the response")
-		}
-		return
-	}
-
-	_, err = fileReader.Seek(0, 0) // Move the byte reader back to the beginning of the file
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		ctx.Logger.WithError(err).Error("error while checking the info about the photo (seeking)")
-		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while checking the info about the photo (seeking)").Error())); err != nil {
-			ctx.Logger.WithError(err).Error("error while writing the response")
-		}
-		return
-	}
-
-	conf, _, err := image.DecodeConfig(fileReader)
-	if err != nil {
-		if errors.Is(err, image.ErrFormat) { // err.Error() == "image: unknown format"
-			w.WriteHeader(http.StatusBadRequest)
-			ctx.Logger.Error("provided image not in a valid format")
-			if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "provided image not in a valid format").Error())); err != nil {
+	// Read the photos, and bring them to the policy of the posts. The photos are either sent in a multipart form, with
+	// the description, or sent before as resumable uploads, whose IDs are sent as JSON with the description.
+	var photos []uploadedPhoto
+	var rawDescription []string
+	var uploadIDs []string
+	if r.Header.Get("Content-Type") == "application/json" {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadRequestSize))
+		if err != nil {
+			var mess []byte
+			if isBodyTooLarge(err) {
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				ctx.Logger.WithError(err).Error("the body of the request is too large")
+				mess = []byte(fmt.Errorf(components.StatusRequestEntityTooLarge, "the body of the request is too large").Error())
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+				ctx.Logger.WithError(err).Error("error while reading the body of the request")
+				mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while reading the body of the request").Error())
+			}
+			if _, err = w.Write(mess); err != nil {
 				ctx.Logger.WithError(err).Error("error while writing the response")
 			}
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-			ctx.Logger.WithError(err).Error("error while checking the info about the photo")
-			if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while checking the info about the photo").Error())); err != nil {
+			return
+		}
+		var uploaded components.UploadedPost
+		if err = json.Unmarshal(body, &uploaded); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.WithError(err).Error("error while decoding the post from the body of the request")
+			if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "error while decoding the post from the body of the request").Error())); err != nil {
 				ctx.Logger.WithError(err).Error("error while writing the response")
 			}
+			return
 		}
-		return
-	}
-	// ctx.Logger.Info("Height:" + strconv.FormatInt(int64(conf.Height), 10))
-	// ctx.Logger.Info("Width: " + strconv.FormatInt(int64(conf.Width), 10))
-
-	// Check the size of the image: it must be 16:9
-	if conf.Width/conf.Height != 16/9 {
-		w.WriteHeader(http.StatusBadRequest)
-		ctx.Logger.Error("photo does not satisfy size requirements: it must be 16:9")
-		if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "photo does not satisfy size requirements: it must be 16:9").Error())); err != nil {
-			ctx.Logger.WithError(err).Error("error while writing the response")
+		photos = helperUploadedPhotos(w, ctx, rt, *usernameOwner, uploaded.Uploads, rt.photoPolicy, maxPostMedia)
+		if photos == nil {
+			return
 		}
-		return
+		rawDescription = []string{uploaded.Description}
+		uploadIDs = uploaded.Uploads
+	} else {
+		photos = helperPhotos(w, r, ctx, rt.photoPolicy, maxPostMedia)
+		if photos == nil {
+			return
+		}
+		rawDescription = r.MultipartForm.Value["description"]
 	}
 
 	// Accessing the description field
-	rawDescription := formData.Value["description"]
 	if len(rawDescription) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		ctx.Logger.Error("no comment provided")
@@ -465,54 +423,151 @@ func (rt _router) uploadPhoto(w http.ResponseWriter, r *http.Request, ps httprou
 		return
 	}
 
-	post, err := rt.db.UploadPost(*usernameOwner, description)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		ctx.Logger.WithError(err).Error("error while posting the photo")
-		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while posting the photo").Error())); err != nil {
-			ctx.Logger.WithError(err).Error("error while writing the response")
+	// Generate the renditions, the perceptual hashes and the placeholders of the photos, each decoded once
+	media := make([]components.Media, len(photos))
+	renditions := make([][]imaging.Rendition, len(photos))
+	var size int64
+	for i, photo := range photos {
+		still, err := imaging.DecodeStill(photo.Content)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while decoding the photo")
+			if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while decoding the photo").Error())); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			return
 		}
-		return
-	}
 
-	_, err = fileReader.Seek(0, 0) // Move the byte reader back to the beginning of the file
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		ctx.Logger.WithError(err).Error("error before creating the photo locally")
-		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error before creating the photo locally").Error())); err != nil {
-			ctx.Logger.WithError(err).Error("error while writing the response")
+		if renditions[i], err = still.Renditions(imaging.Widths); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while generating the renditions of the photo")
+			if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while generating the renditions of the photo").Error())); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			return
+		}
+
+		// Reject the photos matching the blocklist, before storing anything
+		hash, err := still.PerceptualHash()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while computing the perceptual hash of the photo")
+			if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while computing the perceptual hash of the photo").Error())); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			return
+		}
+		if rt.blocked(hash) {
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.WithField("phash", hash.String()).Error("photo matching the blocklist provided")
+			if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "photo not allowed").Error())); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			return
+		}
+
+		blurHash, color, err := still.Placeholder()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while computing the placeholder of the photo")
+			if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while computing the placeholder of the photo").Error())); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			return
+		}
+
+		media[i] = components.Media{
+			MIMEType: photo.MIMEType,
+			Digest:   blobstore.Digest(photo.Content),
+			Width:    photo.Width,
+			Height:   photo.Height,
+			Size:     int64(len(photo.Content)),
+			EXIF:     photo.EXIF,
+			PHash:    hash.String(),
+			Placeholder: components.Placeholder{
+				BlurHash: blurHash,
+				Color:    color,
+			},
 		}
+		size += media[i].Size
+	}
+
+	// Reserve the size of the photos in the quota of the user, holding blobLock only to count them: uploads in parallel
+	// cannot exceed the quota together. The photos count towards the quota even if already stored.
+	digests := make([]string, len(media))
+	for i := range media {
+		digests[i] = media[i].Digest
+	}
+	rt.blobLock.Lock()
+	if !helperQuota(w, ctx, rt, *usernameOwner, size) {
+		rt.blobLock.Unlock()
 		return
 	}
+	rt.beginStoring(*usernameOwner, digests, size)
+	rt.blobLock.Unlock()
 
-	// Save the file locally
-	uploadedFile, err := os.Create("photos/" + post.Photo)
+	// Store the photos (and their renditions) by digest, unless identical photos are already stored, then record the post
+	// as a reference to them, claiming the uploads the photos were sent as: of concurrent requests posting the same
+	// uploads, only the first one posts them
+	var err error
+	for i, photo := range photos {
+		if err = rt.storePhotoBlob(media[i].Digest, photo.Content, renditions[i]); err != nil {
+			break
+		}
+	}
+	var post *components.Post
+	rt.blobLock.Lock()
+	if err == nil {
+		post, err = rt.db.UploadPost(*usernameOwner, description, media, uploadIDs)
+	}
+	rt.endStoring(*usernameOwner, digests, size, err == nil)
+	rt.blobLock.Unlock()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		ctx.Logger.WithError(err).Error("error while creating the photo locally")
-		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while creating the photo locally").Error())); err != nil {
-			ctx.Logger.WithError(err).Error("error while writing the response")
+		var mess []byte
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			ctx.Logger.WithError(err).Error("provided upload does not exist")
+			mess = []byte(fmt.Errorf(components.StatusNotFound, "provided upload does not exist").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while posting the photos")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while posting the photos").Error())
 		}
-		if _, err := rt.db.DeletePost(post.PostID); err != nil {
-			ctx.Logger.WithError(err).Error("error while deleting the record just uploaded")
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
 		}
 		return
 	}
-	defer uploadedFile.Close()
 
-	// Copy the file content to the local file
-	_, err = io.Copy(uploadedFile, fileReader)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		ctx.Logger.WithError(err).Error("error while copying the photo locally")
-		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while copying creating the photo locally").Error())); err != nil {
-			ctx.Logger.WithError(err).Error("error while writing the response")
+	// Record the size of the renditions
+	for i := range post.Media {
+		for _, rendition := range renditions[i] {
+			post.Media[i].Renditions = append(post.Media[i].Renditions, components.Rendition{Width: rendition.Width, Height: rendition.Height})
 		}
-		if _, err := rt.db.DeletePost(post.PostID); err != nil {
-			ctx.Logger.WithError(err).Error("error while deleting the record just uploaded")
+		if err = rt.db.AddPhotoRenditions(post.Media[i].Photo, post.Media[i].Renditions); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while recording the renditions of the photo")
+			if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while recording the renditions of the photo").Error())); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			if err := rt.removePost(post.PostID); err != nil {
+				ctx.Logger.WithError(err).Error("error while deleting the post just uploaded")
+			}
+			return
 		}
-		return
 	}
+	post.Renditions = append([]components.Rendition(nil), post.Media[0].Renditions...)
+	if err = rt.hashes.add(*post); err != nil {
+		ctx.Logger.WithError(err).Error("error while recording the perceptual hashes of the photos")
+	}
+
+	// The uploads have been posted, and deleted with it
+	for _, uploadID := range uploadIDs {
+		rt.removeUploadChunks(uploadID)
+	}
+
+	// Send the photo as a URL the client can load
+	rt.signPost(post, *usernameAuth)
 
 	response, err := json.MarshalIndent(*post, "", " ")
 	if err != nil {
@@ -559,22 +614,11 @@ func (rt _router) deletePhoto(w http.ResponseWriter, r *http.Request, ps httprou
 		return
 	}
 
-	// Delete the record representing the post from the database
-	photoPath, err := rt.db.DeletePost(*postID)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		ctx.Logger.WithError(err).Error("error while deleting the post from the database")
-		if _, err := w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while deleting the post from the database").Error())); err != nil {
-			ctx.Logger.WithError(err).Error("error while writing the response")
-		}
-		return
-	}
-
-	// Delete the file
-	if err := os.Remove("photos/" + *photoPath); err != nil {
+	// Delete the post, and its photos (with the renditions) that no other post or profile pic is the same photo as
+	if err := rt.removePost(*postID); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		ctx.Logger.WithError(err).Error("error while deleting the photo frrom the server")
-		if _, err := w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while deleting the photo frrom the server").Error())); err != nil {
+		ctx.Logger.WithError(err).Error("error while deleting the post")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while deleting the post").Error())); err != nil {
 			ctx.Logger.WithError(err).Error("error while writing the response")
 		}
 		return
@@ -632,7 +676,8 @@ func (rt _router) getMyStream(w http.ResponseWriter, r *http.Request, ps httprou
 		return
 	}
 
-	// Encode the response as JSON
+	// Encode the response as JSON, with the photos as URLs the client can load
+	rt.signPosts(*postStream, username)
 	response, err := json.MarshalIndent(*postStream, "", " ")
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
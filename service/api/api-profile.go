@@ -7,10 +7,11 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os/exec"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/blobstore"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/imaging"
 	"github.com/julienschmidt/httprouter"
 	"github.com/mattn/go-sqlite3"
 )
@@ -80,7 +81,22 @@ func (rt _router) getUserProfile(w http.ResponseWriter, r *http.Request, ps http
 		return
 	}
 
-	// Send the profile to the client
+	// The owner also gets how much they stored, against their quota
+	if username == *authUsername {
+		usage, err := rt.db.GetStorageUsage(username)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while retrieving the storage usage of the user")
+			if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while retrieving the storage usage of the user").Error())); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			return
+		}
+		profile.Storage = &components.StorageUsage{UsedBytes: *usage, QuotaBytes: rt.quotas.of(username)}
+	}
+
+	// Send the profile to the client, with the photos as URLs the client can load
+	rt.signProfile(profile, *authUsername)
 	response, err := json.MarshalIndent(profile, "", " ")
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -197,18 +213,7 @@ func (rt _router) setMyUserName(w http.ResponseWriter, r *http.Request, ps httpr
 		return
 	}
 
-	// Change photo profile name
-	srcFolder := "photos/profile_pics/" + username + ".png"
-	destFolder := "photos/profile_pics/" + newUsername + ".png"
-	mvCmd := exec.Command("mv", srcFolder, destFolder)
-	if err := mvCmd.Run(); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		ctx.Logger.WithError(err).Error("error while updating the user's profile pic")
-		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while updating the user's profile pic").Error())); err != nil {
-			ctx.Logger.WithError(err).Error("error while writing the response")
-		}
-		return
-	}
+	rt.auth.ForgetUser(username)
 
 	// Send the new username to the client as confirmation of the its new username
 	response, err := json.MarshalIndent(newUsername, "", " ")
@@ -231,3 +236,131 @@ func (rt _router) setMyUserName(w http.ResponseWriter, r *http.Request, ps httpr
 	}
 
 }
+
+func (rt _router) setMyProfilePicture(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	// Retrieve the username of the authenticated user
+	usernameAuth := helperAuth(w, r, ps, ctx, rt)
+	if usernameAuth == nil {
+		return
+	}
+
+	username, _ := helperPost(w, r, ps, ctx, rt, false)
+	if username == nil {
+		return
+	}
+
+	// Check if the username in the path and the authenticated one are the same
+	if *username != *usernameAuth {
+		w.WriteHeader(http.StatusForbidden)
+		ctx.Logger.Error("not authorized to change the profile picture of another user")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusForbidden, "not authorized to change the profile picture of another user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Read the photo, and crop it square
+	photo := helperPhoto(w, r, ctx, rt.profilePicPolicy)
+	if photo == nil {
+		return
+	}
+
+	// Generate the small and large renditions of the profile picture, and its placeholder, decoding it once
+	still, err := imaging.DecodeStill(photo.Content)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while decoding the profile picture")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while decoding the profile picture").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+	renditions, err := still.Renditions(imaging.ProfilePicWidths)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while generating the renditions of the profile picture")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while generating the renditions of the profile picture").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Compute the placeholder clients show while loading the profile picture
+	blurHash, color, err := still.Placeholder()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while computing the placeholder of the profile picture")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while computing the placeholder of the profile picture").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+	placeholder := components.Placeholder{BlurHash: blurHash, Color: color}
+
+	// Store the profile picture by digest, unless an identical photo is already stored, without holding blobLock, then
+	// make it the one of the user
+	digest := blobstore.Digest(photo.Content)
+	size := int64(len(photo.Content))
+	rt.blobLock.Lock()
+	rt.beginStoring(*username, []string{digest}, size)
+	rt.blobLock.Unlock()
+	err = rt.storePhotoBlob(digest, photo.Content, renditions)
+	rt.blobLock.Lock()
+	if err == nil {
+		err = rt.setProfilePic(*username, digest, size, placeholder)
+	}
+	rt.endStoring(*username, []string{digest}, size, err == nil)
+	rt.blobLock.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while setting the profile picture")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while setting the profile picture").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+func (rt _router) deleteMyProfilePicture(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	// Retrieve the username of the authenticated user
+	usernameAuth := helperAuth(w, r, ps, ctx, rt)
+	if usernameAuth == nil {
+		return
+	}
+
+	username, _ := helperPost(w, r, ps, ctx, rt, false)
+	if username == nil {
+		return
+	}
+
+	// Check if the username in the path and the authenticated one are the same
+	if *username != *usernameAuth {
+		w.WriteHeader(http.StatusForbidden)
+		ctx.Logger.Error("not authorized to delete the profile picture of another user")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusForbidden, "not authorized to delete the profile picture of another user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Revert to the default profile picture, shared by all the users who have none
+	rt.blobLock.Lock()
+	err := rt.setProfilePic(*username, "", 0, components.Placeholder{})
+	rt.blobLock.Unlock()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while deleting the profile picture")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while deleting the profile picture").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
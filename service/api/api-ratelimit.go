@@ -0,0 +1,97 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"github.com/sirupsen/logrus"
+)
+
+// Route groups sharing the same rate limit
+const (
+	routeGroupSession = "session"
+	routeGroupWrites  = "writes"
+	routeGroupReads   = "reads"
+)
+
+// routeGroup returns the rate limiting group of the request: the login routes, then the others split between the ones
+// only reading and the ones changing something
+func routeGroup(r *http.Request) string {
+	if r.URL.Path == "/session" || strings.HasPrefix(r.URL.Path, "/session/") {
+		return routeGroupSession
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return routeGroupReads
+	}
+	return routeGroupWrites
+}
+
+// identify returns the username the Authorization header of the request belongs to, or an empty string if the header
+// is missing or not valid
+func (rt *_router) identify(r *http.Request) string {
+	token := r.Header.Get("Authorization")
+	if len(token) == 0 {
+		return ""
+	}
+
+	var username *string
+	var err error
+	if strings.HasPrefix(token, components.APIKeyPrefix) {
+		username, err = rt.db.GetAPIKeyOwner(token)
+	} else {
+		username, err = rt.auth.Authenticate(token)
+	}
+	if err != nil || username == nil {
+		return ""
+	}
+	return *username
+}
+
+// allow takes a token from the bucket of the client (the authenticated user, or the IP address for anonymous clients)
+// in the group of the request, and sets the X-RateLimit-* headers. If the client is over the limit, the request is
+// answered with 429 and false is returned.
+func (rt *_router) allow(w http.ResponseWriter, r *http.Request, ctx reqcontext.RequestContext) bool {
+
+	group := routeGroup(r)
+	limiter := rt.limiters[group]
+	if !limiter.Enabled() {
+		return true
+	}
+
+	key := "ip:" + ctx.RemoteIP
+	if ctx.Username != "" {
+		key = "user:" + ctx.Username
+	}
+
+	res := limiter.Allow(key)
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	if res.Allowed {
+		return true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+	w.WriteHeader(http.StatusTooManyRequests)
+	ctx.Logger.WithFields(logrus.Fields{
+		"group": group,
+		"key":   key,
+	}).Warn("rate limit exceeded")
+	if _, err := w.Write([]byte(fmt.Errorf(components.StatusTooManyRequests, "rate limit exceeded, retry later").Error())); err != nil {
+		ctx.Logger.WithError(err).Error("error while writing the response")
+	}
+	return false
+
+}
+
+// ceilSeconds rounds the duration up to whole seconds, as expected by the Retry-After and X-RateLimit-Reset headers
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
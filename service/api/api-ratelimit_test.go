@@ -0,0 +1,175 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/authenticator"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/ratelimit"
+	"github.com/julienschmidt/httprouter"
+	"github.com/sirupsen/logrus"
+)
+
+// tokenUsers is an Authenticator resolving fixed tokens to their users. Only Authenticate is implemented.
+type tokenUsers struct {
+	authenticator.Authenticator
+	users map[string]string
+}
+
+func (a tokenUsers) Authenticate(Token string) (*string, error) {
+	username, ok := a.users[Token]
+	if !ok {
+		return nil, authenticator.ErrInvalidToken
+	}
+	return &username, nil
+}
+
+// newRateLimitedHandler returns a handler answering 200 to every request the rate limits of the given groups let
+// through
+func newRateLimitedHandler(limits map[string]ratelimit.Limit) func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	rt := &_router{
+		baseLogger: logger,
+		auth:       tokenUsers{users: map[string]string{"token-alice": "alice_user", "token-bob": "bob_user"}},
+		limiters:   make(map[string]*ratelimit.Limiter),
+	}
+	for _, group := range []string{routeGroupSession, routeGroupWrites, routeGroupReads} {
+		rt.limiters[group] = ratelimit.New(limits[group])
+	}
+	return rt.wrap(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// send makes a request from the given IP address, with the given token (if any), and returns the response
+func send(handle func(http.ResponseWriter, *http.Request, httprouter.Params), method string, path string, ip string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.RemoteAddr = ip + ":12345"
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	rec := httptest.NewRecorder()
+	handle(rec, req, nil)
+	return rec
+}
+
+func TestRouteGroup(t *testing.T) {
+	tests := []struct {
+		method, path, group string
+	}{
+		{http.MethodPost, "/session", routeGroupSession},
+		{http.MethodGet, "/session/oidc", routeGroupSession},
+		{http.MethodGet, "/sessions", routeGroupReads},
+		{http.MethodGet, "/users/alice_user/stream", routeGroupReads},
+		{http.MethodHead, "/photos/", routeGroupReads},
+		{http.MethodPost, "/users/alice_user/posts", routeGroupWrites},
+		{http.MethodDelete, "/users/alice_user/posts/1", routeGroupWrites},
+	}
+	for _, tt := range tests {
+		if group := routeGroup(httptest.NewRequest(tt.method, tt.path, nil)); group != tt.group {
+			t.Errorf("%s %s: group = %s, want %s", tt.method, tt.path, group, tt.group)
+		}
+	}
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	globaltime.FixedTime = time.Unix(1700000000, 0)
+	defer func() { globaltime.FixedTime = time.Time{} }()
+
+	handle := newRateLimitedHandler(map[string]ratelimit.Limit{routeGroupReads: {Requests: 2, Period: time.Minute}})
+	get := func(ip string, token string) int {
+		return send(handle, http.MethodGet, "/users/alice_user/stream", ip, token).Code
+	}
+
+	// Anonymous clients are limited by IP address
+	for i := 0; i < 2; i++ {
+		if code := get("10.0.0.1", ""); code != http.StatusOK {
+			t.Fatalf("anonymous request %d: %d", i+1, code)
+		}
+	}
+	if code := get("10.0.0.1", ""); code != http.StatusTooManyRequests {
+		t.Errorf("anonymous request past the limit: %d, want 429", code)
+	}
+	if code := get("10.0.0.2", ""); code != http.StatusOK {
+		t.Errorf("anonymous request from another IP address: %d", code)
+	}
+
+	// Authenticated users are limited by user, from any IP address, apart from the anonymous clients sharing it; a
+	// token not valid counts as anonymous
+	if code := get("10.0.0.1", "token-alice"); code != http.StatusOK {
+		t.Errorf("authenticated request from a limited IP address: %d", code)
+	}
+	if code := get("10.0.0.3", "token-alice"); code != http.StatusOK {
+		t.Errorf("second authenticated request: %d", code)
+	}
+	if code := get("10.0.0.4", "token-alice"); code != http.StatusTooManyRequests {
+		t.Errorf("authenticated request past the limit, from another IP address: %d, want 429", code)
+	}
+	if code := get("10.0.0.4", "token-bob"); code != http.StatusOK {
+		t.Errorf("request of another user: %d", code)
+	}
+	if code := get("10.0.0.1", "not-a-token"); code != http.StatusTooManyRequests {
+		t.Errorf("request with a token not valid, past the limit of its IP address: %d, want 429", code)
+	}
+}
+
+func TestRateLimitGroups(t *testing.T) {
+	globaltime.FixedTime = time.Unix(1700000000, 0)
+	defer func() { globaltime.FixedTime = time.Time{} }()
+
+	handle := newRateLimitedHandler(map[string]ratelimit.Limit{
+		routeGroupSession: {Requests: 1, Period: time.Minute},
+		routeGroupWrites:  {Requests: 2, Period: time.Minute},
+		// No limit on reads
+	})
+
+	if code := send(handle, http.MethodPost, "/session", "10.0.0.1", "").Code; code != http.StatusOK {
+		t.Fatalf("login: %d", code)
+	}
+	rec := send(handle, http.MethodPost, "/session", "10.0.0.1", "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("login past the limit: %d, want 429", rec.Code)
+	}
+	if retry := rec.Header().Get("Retry-After"); retry != "60" {
+		t.Errorf("Retry-After = %s, want 60", retry)
+	}
+	if limit := rec.Header().Get("X-RateLimit-Limit"); limit != "1" {
+		t.Errorf("X-RateLimit-Limit = %s, want 1", limit)
+	}
+
+	// The other groups have their own buckets
+	for i := 0; i < 2; i++ {
+		rec = send(handle, http.MethodPost, "/users/alice_user/posts", "10.0.0.1", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("write %d: %d", i+1, rec.Code)
+		}
+		if remaining := rec.Header().Get("X-RateLimit-Remaining"); remaining != strconv.Itoa(1-i) {
+			t.Errorf("write %d: X-RateLimit-Remaining = %s, want %d", i+1, remaining, 1-i)
+		}
+	}
+	if code := send(handle, http.MethodPost, "/users/alice_user/posts", "10.0.0.1", "").Code; code != http.StatusTooManyRequests {
+		t.Errorf("write past the limit: %d, want 429", code)
+	}
+	for i := 0; i < 10; i++ {
+		rec = send(handle, http.MethodGet, "/users/alice_user/stream", "10.0.0.1", "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("read %d: %d", i+1, rec.Code)
+		}
+	}
+	if limit := rec.Header().Get("X-RateLimit-Limit"); limit != "" {
+		t.Errorf("X-RateLimit-Limit = %s on a group with no limit", limit)
+	}
+
+	// Once the period is over, the login is allowed again
+	globaltime.FixedTime = globaltime.FixedTime.Add(time.Minute)
+	if code := send(handle, http.MethodPost, "/session", "10.0.0.1", "").Code; code != http.StatusOK {
+		t.Errorf("login after the period: %d", code)
+	}
+}
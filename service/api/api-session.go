@@ -1,6 +1,7 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,16 +9,23 @@ import (
 	"net/http"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/authenticator"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
 	"github.com/julienschmidt/httprouter"
 )
 
+// maxLoginRequestSize is the largest body of the login requests: the credentials never come close to it
+const maxLoginRequestSize = 4 * 1024
+
 func (rt _router) doLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
 
 	w.Header().Set("Content-Type", "application/json")
 
-	// Parse the username of the user is trying to login
-	if contentType := r.Header.Get("Content-Type"); contentType != "text/plain" {
+	// Parse the credentials of the user is trying to login: the username alongside the password (as JSON) in the password
+	// mode; in the legacy mode, either just the username (as plain text) or, for users who enabled two-factor
+	// authentication, the username alongside the code (as JSON)
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" && (rt.loginMode == LoginModePassword || contentType != "text/plain") {
 		w.WriteHeader(http.StatusUnsupportedMediaType)
 		ctx.Logger.Error("unsupported media type provided")
 		if _, err := w.Write([]byte(fmt.Errorf(components.StatusUnsupportedMediaType).Error())); err != nil {
@@ -26,16 +34,38 @@ func (rt _router) doLogin(w http.ResponseWriter, r *http.Request, ps httprouter.
 		return
 	}
 
-	body, err := io.ReadAll(r.Body)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxLoginRequestSize))
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		ctx.Logger.WithError(err).Error("error while reading the body of the request")
-		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while reading the body of the request" /*err*/).Error())); err != nil {
+		var mess []byte
+		if isBodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			ctx.Logger.WithError(err).Error("the body of the request is too large")
+			mess = []byte(fmt.Errorf(components.StatusRequestEntityTooLarge, "the body of the request is too large").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while reading the body of the request")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while reading the body of the request" /*err*/).Error())
+		}
+		if _, err = w.Write(mess); err != nil {
 			ctx.Logger.WithError(err).Error("error while writing the response")
 		}
 		return
 	}
-	username := string(body)
+
+	var credentials components.Credentials
+	if contentType == "application/json" {
+		if err = json.Unmarshal(body, &credentials); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.WithError(err).Error("error while decoding the credentials from the body of the request")
+			if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "error while decoding the credentials from the body of the request").Error())); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			return
+		}
+	} else {
+		credentials.Username = string(body)
+	}
+	username := credentials.Username
 
 	// Check if the provided username is valid
 	if err := components.CheckIfValid(username, "Username"); err != nil {
@@ -55,16 +85,111 @@ func (rt _router) doLogin(w http.ResponseWriter, r *http.Request, ps httprouter.
 		return
 	}
 
-	// Get the ID from the database
-	user, err := rt.db.PostUserID(username)
+	// Check if the provided password is valid
+	if rt.loginMode == LoginModePassword {
+		if err := components.CheckIfValid(credentials.Password, "Password"); err != nil {
+			var mess []byte
+			if errors.Is(err, components.ErrPasswordNotValid) {
+				w.WriteHeader(http.StatusBadRequest)
+				ctx.Logger.WithError(err).Error("provided password not valid")
+				mess = []byte(fmt.Errorf(components.StatusBadRequest, "provided password not valid").Error())
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+				ctx.Logger.WithError(err).Error("error while checking if the password is valid")
+				mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while checking if the password is valid").Error())
+			}
+			if _, err = w.Write(mess); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			return
+		}
+	}
+
+	// Users who sign in with single sign-on cannot login here, in either mode: they have no password, and their username
+	// alone must not be enough
+	sso, err := rt.db.IsSSOUser(username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while checking if the user signs in with single sign-on")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while checking if the user signs in with single sign-on").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+	if sso {
+		w.WriteHeader(http.StatusForbidden)
+		ctx.Logger.Error("password login attempted for single sign-on user " + username)
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusForbidden, "the user signs in with single sign-on only").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Get the user from the database. In the password mode, the password of existing users is checked first, and new
+	// users are created with the provided password; users without a password (created before the password mode was
+	// enabled) cannot login until they set one
+	var user *components.User
+	if rt.loginMode == LoginModePassword {
+		err = rt.db.CheckUserPassword(username, credentials.Password)
+		if err == nil {
+			user, err = rt.db.PostUserID(username)
+		} else if errors.Is(err, sql.ErrNoRows) {
+			user, err = rt.db.PostUserWithPassword(username, credentials.Password)
+		}
+	} else {
+		user, err = rt.db.PostUserID(username)
+	}
+	if err != nil {
+		var mess []byte
+		if errors.Is(err, components.ErrWrongPassword) || errors.Is(err, components.ErrUsernameTaken) {
+			w.WriteHeader(http.StatusUnauthorized)
+			ctx.Logger.WithError(err).Error("wrong password provided for user " + username)
+			mess = []byte(fmt.Errorf(components.StatusUnauthorized, "wrong username or password").Error())
+		} else if errors.Is(err, components.ErrNoPassword) {
+			w.WriteHeader(http.StatusForbidden)
+			ctx.Logger.WithError(err).Error("password login attempted for user " + username + ", who has no password")
+			mess = []byte(fmt.Errorf(components.StatusForbidden, "the user has no password set").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while retrieving the user")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while retrieving the user").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Check the second factor, if the user enabled it (in either mode)
+	if err = rt.db.CheckSecondFactor(username, credentials.Code); err != nil && !errors.Is(err, components.ErrTOTPNotEnabled) {
+		var mess []byte
+		if errors.Is(err, components.ErrCodeRequired) || errors.Is(err, components.ErrWrongCode) {
+			w.WriteHeader(http.StatusUnauthorized)
+			ctx.Logger.WithError(err).Error("second factor missing or wrong for user " + username)
+			mess = []byte(fmt.Errorf(components.StatusUnauthorized, err.Error()).Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while checking the second factor of the user")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while checking the second factor of the user").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Open a new session for the user: its token is the only credential handed out to the client
+	token, err := rt.auth.IssueToken(user.Username, ctx.UserAgent, ctx.RemoteIP)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
-		ctx.Logger.WithError(err).Error("error while parsing the id for the given user")
-		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while parsing the id for the given user" /*err*/).Error())); err != nil {
+		ctx.Logger.WithError(err).Error("error while creating the session for the given user")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while creating the session for the given user" /*err*/).Error())); err != nil {
 			ctx.Logger.WithError(err).Error("error while writing the response")
 		}
 		return
 	}
+	user.ID = *token
+	rt.signUser(user, user.Username)
 
 	response, err := json.MarshalIndent(&user, "", " ")
 	if err != nil {
@@ -88,3 +213,312 @@ func (rt _router) doLogin(w http.ResponseWriter, r *http.Request, ps httprouter.
 		return
 	}
 }
+
+func (rt _router) doLogout(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Check if the provided token belongs to an active session
+	if authUsername := helperAuth(w, r, ps, ctx, rt); authUsername == nil {
+		return
+	}
+
+	// Revoke the session
+	if err := rt.auth.RevokeToken(r.Header.Get("Authorization")); err != nil {
+		var mess []byte
+		if errors.Is(err, authenticator.ErrInvalidToken) {
+			w.WriteHeader(http.StatusUnauthorized)
+			ctx.Logger.WithError(err).Error("no session found with the provided token")
+			mess = []byte(fmt.Errorf(components.StatusUnauthorized, "no session found with the provided token").Error())
+		} else if errors.Is(err, authenticator.ErrRevocationUnsupported) {
+			w.WriteHeader(http.StatusNotImplemented)
+			ctx.Logger.WithError(err).Error("tokens cannot be revoked one at a time, they are signed")
+			mess = []byte(fmt.Errorf(components.StatusNotImplemented, "tokens cannot be revoked one at a time, they are signed").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while revoking the session")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while revoking the session").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+func (rt _router) getMySessions(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Retrieve the username of the authenticated user
+	authUsername := helperAuth(w, r, ps, ctx, rt)
+	if authUsername == nil {
+		return
+	}
+
+	// Retrieve the username from the path and check if it is valid
+	username := ps.ByName("username")
+	if err := components.CheckIfValid(username, "Username"); err != nil {
+		var mess []byte
+		if errors.Is(err, components.ErrUsernameNotValid) {
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.WithError(err).Error("provided username not valid")
+			mess = []byte(fmt.Errorf(components.StatusBadRequest, "provided username not valid").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while checking if the username is valid")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while checking if the username is valid").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Check that the username from the path and the authenticated username is the same
+	if username != *authUsername {
+		w.WriteHeader(http.StatusForbidden)
+		ctx.Logger.Error("authenticated user cannot see the sessions of another user")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusForbidden, "authenticated user cannot see the sessions of another user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Retrieve the active sessions of the user
+	sessions, err := rt.auth.ListSessions(username, r.Header.Get("Authorization"))
+	if err != nil {
+		var mess []byte
+		if errors.Is(err, authenticator.ErrSessionsUnsupported) {
+			w.WriteHeader(http.StatusNotImplemented)
+			ctx.Logger.WithError(err).Error("sessions are not tracked, tokens are signed")
+			mess = []byte(fmt.Errorf(components.StatusNotImplemented, "sessions are not tracked, tokens are signed").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while retrieving the sessions of the user")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while retrieving the sessions of the user").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Encode the response as JSON
+	response, err := json.MarshalIndent(*sessions, "", " ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while encoding the response as JSON")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while encoding the response as JSON").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(response); err != nil {
+		ctx.Logger.WithError(err).Error("error while writing the response")
+	}
+
+}
+
+func (rt _router) revokeSession(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Retrieve the username of the authenticated user
+	authUsername := helperAuth(w, r, ps, ctx, rt)
+	if authUsername == nil {
+		return
+	}
+
+	// Retrieve the username from the path and check if it is valid
+	username := ps.ByName("username")
+	if err := components.CheckIfValid(username, "Username"); err != nil {
+		var mess []byte
+		if errors.Is(err, components.ErrUsernameNotValid) {
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.WithError(err).Error("provided username not valid")
+			mess = []byte(fmt.Errorf(components.StatusBadRequest, "provided username not valid").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while checking if the username is valid")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while checking if the username is valid").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Check that the username from the path and the authenticated username is the same
+	if username != *authUsername {
+		w.WriteHeader(http.StatusForbidden)
+		ctx.Logger.Error("authenticated user cannot revoke the sessions of another user")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusForbidden, "authenticated user cannot revoke the sessions of another user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Revoke the session, if it belongs to the authenticated user
+	sessionID := ps.ByName("session_id")
+	if err := rt.auth.RevokeSession(username, sessionID); err != nil {
+		var mess []byte
+		if errors.Is(err, authenticator.ErrUnknownSession) {
+			w.WriteHeader(http.StatusNotFound)
+			ctx.Logger.WithError(err).Error("provided session does not exist")
+			mess = []byte(fmt.Errorf(components.StatusNotFound, "provided session does not exist").Error())
+		} else if errors.Is(err, authenticator.ErrRevocationUnsupported) {
+			w.WriteHeader(http.StatusNotImplemented)
+			ctx.Logger.WithError(err).Error("tokens cannot be revoked one at a time, they are signed")
+			mess = []byte(fmt.Errorf(components.StatusNotImplemented, "tokens cannot be revoked one at a time, they are signed").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while revoking the session")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while revoking the session").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+func (rt _router) setMyPassword(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Retrieve the username of the authenticated user
+	authUsername := helperAuth(w, r, ps, ctx, rt)
+	if authUsername == nil {
+		return
+	}
+
+	// Retrieve the username from the path and check if it is valid
+	username := ps.ByName("username")
+	if err := components.CheckIfValid(username, "Username"); err != nil {
+		var mess []byte
+		if errors.Is(err, components.ErrUsernameNotValid) {
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.WithError(err).Error("provided username not valid")
+			mess = []byte(fmt.Errorf(components.StatusBadRequest, "provided username not valid").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while checking if the username is valid")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while checking if the username is valid").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Check that the username from the path and the authenticated username is the same
+	if username != *authUsername {
+		w.WriteHeader(http.StatusForbidden)
+		ctx.Logger.Error("authenticated user cannot change the password of another user")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusForbidden, "authenticated user cannot change the password of another user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Retrieve the old and the new password from the request body
+	var change components.PasswordChange
+	if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx.Logger.WithError(err).Error("error while decoding the body of the request")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "error while decoding the body of the request").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	if err := components.CheckIfValid(change.NewPassword, "Password"); err != nil {
+		var mess []byte
+		if errors.Is(err, components.ErrPasswordNotValid) {
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.WithError(err).Error("provided new password not valid")
+			mess = []byte(fmt.Errorf(components.StatusBadRequest, "provided new password not valid").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while checking if the new password is valid")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while checking if the new password is valid").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Users who sign in with single sign-on cannot get a password
+	if sso, err := rt.db.IsSSOUser(username); err != nil || sso {
+		var mess []byte
+		if err == nil {
+			w.WriteHeader(http.StatusForbidden)
+			ctx.Logger.Error("single sign-on user " + username + " cannot set a password")
+			mess = []byte(fmt.Errorf(components.StatusForbidden, "the user signs in with single sign-on only").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while checking if the user signs in with single sign-on")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while checking if the user signs in with single sign-on").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Check the old password, unless the user has none yet
+	if err := rt.db.CheckUserPassword(username, change.OldPassword); err != nil && !errors.Is(err, components.ErrNoPassword) {
+		var mess []byte
+		if errors.Is(err, components.ErrWrongPassword) {
+			w.WriteHeader(http.StatusForbidden)
+			ctx.Logger.WithError(err).Error("wrong old password provided")
+			mess = []byte(fmt.Errorf(components.StatusForbidden, "wrong old password provided").Error())
+		} else if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			ctx.Logger.WithError(err).Error("provided username does not exist")
+			mess = []byte(fmt.Errorf(components.StatusNotFound, "provided username does not exist").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while checking the old password")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while checking the old password").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Update the password
+	if err := rt.db.SetUserPassword(username, change.NewPassword); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while updating the password")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while updating the password").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Sign out every other device, which may have been logged in with the old password (signed tokens are revoked all at
+	// once, this device included)
+	if err := rt.auth.RevokeOtherTokens(username, r.Header.Get("Authorization")); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while revoking the other sessions of the user")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while revoking the other sessions of the user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
@@ -0,0 +1,292 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/imaging"
+	"github.com/julienschmidt/httprouter"
+)
+
+// SimilarityConfig configures the detection of near-duplicate photos, by the Hamming distance (from 0 to 64) between
+// their perceptual hashes (see imaging.PerceptualHash)
+type SimilarityConfig struct {
+	// MaxDistance is the distance up to which posts are returned as similar to a post
+	MaxDistance int
+
+	// Blocklist are the perceptual hashes (16 hex digits each) of the photos that cannot be posted, maintained by the
+	// administrators of the server
+	Blocklist []string
+
+	// BlockDistance is the distance up to which a photo matches a hash of the blocklist
+	BlockDistance int
+}
+
+// Maximum number of similar posts returned, most similar first
+const maxSimilarPosts = 20
+
+func (rt _router) getSimilarPosts(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Retrieve the username of the authenticated user
+	usernameAuth := helperAuth(w, r, ps, ctx, rt)
+	if usernameAuth == nil {
+		return
+	}
+
+	// Retrieve the post
+	postID := ps.ByName("post_id")
+	if err := components.CheckIfValid(postID, "PostID"); err != nil {
+		var mess []byte
+		if errors.Is(err, components.ErrPostIDNotValid) {
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.Error("provided post id not valid")
+			mess = []byte(fmt.Errorf(components.StatusBadRequest, "provided post id not valid").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while checking if the post id is valid")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while checking if the post id is valid").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+	post, err := rt.db.GetPost(postID)
+	if err != nil {
+		var mess []byte
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			ctx.Logger.WithError(err).Error("provided post does not exist")
+			mess = []byte(fmt.Errorf(components.StatusNotFound, "provided post does not exist").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while retrieving the post")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while retrieving the post").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Check if the authenticated user has banned the author of the post or viceversa
+	err = rt.db.CheckIfBanned(*usernameAuth, post.Author)
+	if err == nil {
+		w.WriteHeader(http.StatusForbidden)
+		ctx.Logger.Error("cannot see the posts similar to a post of a banned user or that has banned the authenticated user")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusForbidden, "cannot see the posts similar to a post of a banned user or that has banned the authenticated user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while checking if the authenticated user banned the other user or viceversa")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while checking if the authenticated user banned the other user or viceversa").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Find the posts with an image close to one of the images of the post
+	similar, err := rt.similarPosts(*post, *usernameAuth)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while retrieving the similar posts")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while retrieving the similar posts").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Encode the response as JSON, with the photos as URLs the client can load
+	for i := range similar {
+		rt.signPost(&similar[i].Post, *usernameAuth)
+	}
+	response, err := json.MarshalIndent(similar, "", " ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while encoding the response as JSON")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while encoding the response as JSON").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(response); err != nil {
+		ctx.Logger.WithError(err).Error("error while writing the response")
+	}
+
+}
+
+// similarPosts returns the posts (other than the given one) with an image within the configured distance from one of
+// the images of the given post, most similar first (the most recent first, among equally similar ones). The posts of
+// the users the viewer has banned, or that have banned the viewer, are left out.
+func (rt _router) similarPosts(post components.Post, viewer string) ([]components.SimilarPost, error) {
+	var hashes []imaging.Hash
+	for _, media := range post.Media {
+		if media.PHash == "" {
+			continue
+		}
+		hash, err := imaging.ParseHash(media.PHash)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	distances, err := rt.hashes.within(rt.db, hashes, rt.similarity.MaxDistance)
+	if err != nil {
+		return nil, err
+	}
+	delete(distances, post.PostID)
+
+	postIDs := make([]string, 0, len(distances))
+	for postID := range distances {
+		postIDs = append(postIDs, postID)
+	}
+	sort.Slice(postIDs, func(i, j int) bool {
+		if distances[postIDs[i]] != distances[postIDs[j]] {
+			return distances[postIDs[i]] < distances[postIDs[j]]
+		}
+		a, _ := strconv.ParseInt(postIDs[i], 10, 64)
+		b, _ := strconv.ParseInt(postIDs[j], 10, 64)
+		return a > b
+	})
+
+	// The posts are retrieved in batches, most similar first, until enough of them are left once the posts of banned
+	// users (and the ones deleted in the meantime) are left out
+	similar := []components.SimilarPost{}
+	for len(postIDs) > 0 && len(similar) < maxSimilarPosts {
+		batch := postIDs
+		if len(batch) > maxSimilarPosts {
+			batch = batch[:maxSimilarPosts]
+		}
+		postIDs = postIDs[len(batch):]
+
+		posts, err := rt.db.GetPostsByID(batch, viewer)
+		if err != nil {
+			return nil, err
+		}
+		byID := make(map[string]components.Post, len(*posts))
+		for _, other := range *posts {
+			byID[other.PostID] = other
+		}
+		for _, postID := range batch {
+			if other, ok := byID[postID]; ok && len(similar) < maxSimilarPosts {
+				similar = append(similar, components.SimilarPost{Post: other, Distance: distances[postID]})
+			}
+		}
+	}
+	return similar, nil
+}
+
+// hashIndex keeps the perceptual hashes of the images of all the posts in memory, by post, so that they are not read
+// from the database at each search of the similar posts. It is loaded at the first search, then kept up to date as
+// posts are uploaded and deleted. The posts deleted otherwise (with their author) are left out when the posts found
+// are retrieved.
+type hashIndex struct {
+	mu     sync.RWMutex
+	loaded bool
+	posts  map[string][]imaging.Hash
+}
+
+// within returns the distance of the posts with an image within maxDistance from one of the given hashes, by post ID.
+// The distance of a post is the smallest one between its images and the given hashes.
+func (x *hashIndex) within(db database.AppDatabase, hashes []imaging.Hash, maxDistance int) (map[string]int, error) {
+	if err := x.load(db); err != nil {
+		return nil, err
+	}
+
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	distances := make(map[string]int)
+	for postID, images := range x.posts {
+		for _, image := range images {
+			for _, h := range hashes {
+				distance := h.Distance(image)
+				if distance > maxDistance {
+					continue
+				}
+				if current, ok := distances[postID]; !ok || distance < current {
+					distances[postID] = distance
+				}
+			}
+		}
+	}
+	return distances, nil
+}
+
+// load reads the hashes from the database, unless they have already been
+func (x *hashIndex) load(db database.AppDatabase) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.loaded {
+		return nil
+	}
+
+	hashes, err := db.GetPhotoHashes()
+	if err != nil {
+		return err
+	}
+	x.posts = make(map[string][]imaging.Hash)
+	for _, photoHash := range *hashes {
+		hash, err := imaging.ParseHash(photoHash.PHash)
+		if err != nil {
+			return err
+		}
+		x.posts[photoHash.PostID] = append(x.posts[photoHash.PostID], hash)
+	}
+	x.loaded = true
+	return nil
+}
+
+// add records the hashes of the images of a post just uploaded. Before the index is loaded, the post is left to load.
+func (x *hashIndex) add(post components.Post) error {
+	var hashes []imaging.Hash
+	for _, media := range post.Media {
+		if media.PHash == "" {
+			continue
+		}
+		hash, err := imaging.ParseHash(media.PHash)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.loaded && len(hashes) > 0 {
+		x.posts[post.PostID] = hashes
+	}
+	return nil
+}
+
+// remove forgets the hashes of a post just deleted
+func (x *hashIndex) remove(postID string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.posts, postID)
+}
+
+// blocked reports whether the photo with the given perceptual hash matches a hash of the blocklist
+func (rt _router) blocked(hash imaging.Hash) bool {
+	for _, b := range rt.blocklist {
+		if hash.Distance(b) <= rt.similarity.BlockDistance {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/imaging"
+)
+
+// photoHashes is a database holding the given perceptual hashes. Only GetPhotoHashes is implemented.
+type photoHashes struct {
+	database.AppDatabase
+	hashes []components.PhotoHash
+	loads  *int
+}
+
+func (db photoHashes) GetPhotoHashes() (*[]components.PhotoHash, error) {
+	*db.loads++
+	hashes := append([]components.PhotoHash(nil), db.hashes...)
+	return &hashes, nil
+}
+
+func postWithHashes(postID string, hashes ...string) components.Post {
+	post := components.Post{PostID: postID}
+	for _, hash := range hashes {
+		post.Media = append(post.Media, components.Media{PHash: hash})
+	}
+	return post
+}
+
+func TestHashIndex(t *testing.T) {
+	var loads int
+	db := photoHashes{
+		hashes: []components.PhotoHash{
+			{PostID: "1", PHash: "0000000000000000"},
+			{PostID: "1", PHash: "ffffffffffffffff"},
+			{PostID: "2", PHash: "000000000000000f"},
+		},
+		loads: &loads,
+	}
+	x := &hashIndex{}
+	within := func(maxDistance int) map[string]int {
+		t.Helper()
+		distances, err := x.within(db, []imaging.Hash{0}, maxDistance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return distances
+	}
+
+	// Added before the index is loaded, a post is left to the load, which finds it in the database or not
+	if err := x.add(postWithHashes("9", "0000000000000001")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := within(4), map[string]int{"1": 0, "2": 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after load: %v, want %v", got, want)
+	}
+	if got, want := within(3), map[string]int{"1": 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("within 3: %v, want %v", got, want)
+	}
+
+	// Once loaded, the index follows the uploads and the deletions without reading the database again
+	if err := x.add(postWithHashes("3", "", "0000000000000003")); err != nil {
+		t.Fatal(err)
+	}
+	if err := x.add(postWithHashes("4")); err != nil {
+		t.Fatal(err)
+	}
+	x.remove("1")
+	x.remove("5")
+	if got, want := within(4), map[string]int{"2": 4, "3": 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after add and remove: %v, want %v", got, want)
+	}
+	if loads != 1 {
+		t.Errorf("hashes loaded %d times, want once", loads)
+	}
+
+	if err := x.add(postWithHashes("6", "not a hash")); err == nil {
+		t.Error("post with a hash not valid added")
+	}
+}
+
+func TestBlocked(t *testing.T) {
+	rt := _router{
+		blocklist:  []imaging.Hash{0x00000000000000ff, 0xffff000000000000},
+		similarity: SimilarityConfig{BlockDistance: 4},
+	}
+	tests := []struct {
+		hash imaging.Hash
+		want bool
+	}{
+		{0x00000000000000ff, true},
+		{0x000000000000003f, true},
+		{0x000000000000000f, true},
+		{0x0000000000000007, false},
+		{0xffff00000000000f, true},
+		{0xffff00000000001f, false},
+		{0xfff0000000000000, true},
+		{0xffff0000000000ff, false},
+	}
+	for _, tt := range tests {
+		if got := rt.blocked(tt.hash); got != tt.want {
+			t.Errorf("%v: blocked = %v, want %v", tt.hash, got, tt.want)
+		}
+	}
+
+	// Distance 0 blocks the exact hashes only
+	rt.similarity.BlockDistance = 0
+	if !rt.blocked(0x00000000000000ff) || rt.blocked(0x00000000000001ff) {
+		t.Error("distance 0 not blocking the exact hashes only")
+	}
+}
@@ -0,0 +1,250 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/totp"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Issuer shown by the authenticator apps alongside the codes
+const totpIssuer = "WASAPhoto"
+
+func (rt _router) enrollTOTP(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Retrieve the username of the authenticated user
+	authUsername := helperAuth(w, r, ps, ctx, rt)
+	if authUsername == nil {
+		return
+	}
+
+	// Retrieve the username from the path
+	username, _ := helperPost(w, r, ps, ctx, rt, false)
+	if username == nil {
+		return
+	}
+
+	// Check if the username in the path and the authenticated one are the same
+	if *username != *authUsername {
+		w.WriteHeader(http.StatusForbidden)
+		ctx.Logger.Error("authenticated user cannot enable two-factor authentication on behalf of another user")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusForbidden, "authenticated user cannot enable two-factor authentication on behalf of another user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Generate the secret, which stays pending until confirmed with a code
+	secret, err := rt.db.EnrollTOTP(*username)
+	if err != nil {
+		var mess []byte
+		if errors.Is(err, components.ErrTOTPAlreadyEnabled) {
+			w.WriteHeader(http.StatusConflict)
+			ctx.Logger.WithError(err).Error("two-factor authentication already enabled")
+			mess = []byte(fmt.Errorf(components.StatusConflict, "two-factor authentication already enabled").Error())
+		} else if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			ctx.Logger.WithError(err).Error("provided username does not exist")
+			mess = []byte(fmt.Errorf(components.StatusNotFound, "provided username does not exist").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while generating the two-factor authentication secret")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while generating the two-factor authentication secret").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	response, err := json.MarshalIndent(components.TOTPEnrollment{
+		Secret: *secret,
+		URI:    totp.URI(totpIssuer, *username, *secret),
+	}, "", " ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while encoding the response as JSON")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while encoding the response as JSON").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if _, err = w.Write(response); err != nil {
+		ctx.Logger.WithError(err).Error("error while writing the response")
+	}
+
+}
+
+func (rt _router) confirmTOTP(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Retrieve the username of the authenticated user
+	authUsername := helperAuth(w, r, ps, ctx, rt)
+	if authUsername == nil {
+		return
+	}
+
+	// Retrieve the username from the path
+	username, _ := helperPost(w, r, ps, ctx, rt, false)
+	if username == nil {
+		return
+	}
+
+	// Check if the username in the path and the authenticated one are the same
+	if *username != *authUsername {
+		w.WriteHeader(http.StatusForbidden)
+		ctx.Logger.Error("authenticated user cannot enable two-factor authentication on behalf of another user")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusForbidden, "authenticated user cannot enable two-factor authentication on behalf of another user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Retrieve the code from the request body
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while reading the body of the request")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while reading the body of the request").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Enable two-factor authentication and generate the recovery codes
+	codes, err := rt.db.ConfirmTOTP(*username, strings.TrimSpace(string(body)))
+	if err != nil {
+		var mess []byte
+		if errors.Is(err, components.ErrTOTPAlreadyEnabled) {
+			w.WriteHeader(http.StatusConflict)
+			ctx.Logger.WithError(err).Error("two-factor authentication already enabled")
+			mess = []byte(fmt.Errorf(components.StatusConflict, "two-factor authentication already enabled").Error())
+		} else if errors.Is(err, components.ErrTOTPNotEnabled) {
+			w.WriteHeader(http.StatusConflict)
+			ctx.Logger.WithError(err).Error("two-factor authentication must be enrolled before being confirmed")
+			mess = []byte(fmt.Errorf(components.StatusConflict, "two-factor authentication must be enrolled before being confirmed").Error())
+		} else if errors.Is(err, components.ErrWrongCode) {
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.WithError(err).Error("wrong two-factor authentication code provided")
+			mess = []byte(fmt.Errorf(components.StatusBadRequest, "wrong two-factor authentication code provided").Error())
+		} else if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			ctx.Logger.WithError(err).Error("provided username does not exist")
+			mess = []byte(fmt.Errorf(components.StatusNotFound, "provided username does not exist").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while enabling two-factor authentication")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while enabling two-factor authentication").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Send the recovery codes to the client: this is the only time they are shown
+	response, err := json.MarshalIndent(*codes, "", " ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while encoding the response as JSON")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while encoding the response as JSON").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(response); err != nil {
+		ctx.Logger.WithError(err).Error("error while writing the response")
+	}
+
+}
+
+func (rt _router) disableTOTP(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Retrieve the username of the authenticated user
+	authUsername := helperAuth(w, r, ps, ctx, rt)
+	if authUsername == nil {
+		return
+	}
+
+	// Retrieve the username from the path
+	username, _ := helperPost(w, r, ps, ctx, rt, false)
+	if username == nil {
+		return
+	}
+
+	// Check if the username in the path and the authenticated one are the same
+	if *username != *authUsername {
+		w.WriteHeader(http.StatusForbidden)
+		ctx.Logger.Error("authenticated user cannot disable two-factor authentication on behalf of another user")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusForbidden, "authenticated user cannot disable two-factor authentication on behalf of another user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Retrieve the code from the request body: a stolen session alone must not be enough to disable the second factor
+	var factor components.SecondFactor
+	if err := json.NewDecoder(r.Body).Decode(&factor); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx.Logger.WithError(err).Error("error while decoding the body of the request")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "error while decoding the body of the request").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	if err := rt.db.CheckSecondFactor(*username, strings.TrimSpace(factor.Code)); err != nil {
+		var mess []byte
+		if errors.Is(err, components.ErrTOTPNotEnabled) {
+			w.WriteHeader(http.StatusConflict)
+			ctx.Logger.WithError(err).Error("two-factor authentication not enabled")
+			mess = []byte(fmt.Errorf(components.StatusConflict, "two-factor authentication not enabled").Error())
+		} else if errors.Is(err, components.ErrCodeRequired) || errors.Is(err, components.ErrWrongCode) {
+			w.WriteHeader(http.StatusForbidden)
+			ctx.Logger.WithError(err).Error("two-factor authentication code missing or wrong")
+			mess = []byte(fmt.Errorf(components.StatusForbidden, err.Error()).Error())
+		} else if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			ctx.Logger.WithError(err).Error("provided username does not exist")
+			mess = []byte(fmt.Errorf(components.StatusNotFound, "provided username does not exist").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while checking the two-factor authentication code")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while checking the two-factor authentication code").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Disable two-factor authentication
+	if err := rt.db.DisableTOTP(*username); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while disabling two-factor authentication")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while disabling two-factor authentication").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
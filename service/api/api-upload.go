@@ -0,0 +1,503 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/blobstore"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Resumable uploads let the clients on unreliable connections send a photo in chunks, each in its own request, and
+// resume from the last chunk received after a failure. Once complete, uploads are posted by uploadPhoto, by ID.
+//
+// The chunks are stored under uploadPrefix, each under the offset it starts at, until the upload is posted, deleted or
+// expires.
+const (
+	// uploadPrefix is the prefix of the keys of the chunks of the uploads in the photo store
+	uploadPrefix = "uploads/"
+
+	// maxUploadSize is the largest photo that can be uploaded, as in the multipart forms (see maxPhotosBodySize)
+	maxUploadSize = 10 * 1024 * 1024
+
+	// maxUploadRequestSize is the largest JSON body of the requests starting an upload, or posting uploads
+	maxUploadRequestSize = 64 * 1024
+
+	// maxPendingUploads is how many uploads a user can have at once
+	maxPendingUploads = maxPostMedia
+
+	// uploadExpiryInterval is the time between two deletions of the expired uploads
+	uploadExpiryInterval = 10 * time.Minute
+
+	// uploadChunkType is the content type of the chunks (as in the tus protocol)
+	uploadChunkType = "application/offset+octet-stream"
+)
+
+func (rt _router) createUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	username := helperUploadOwner(w, r, ps, ctx, rt)
+	if username == nil {
+		return
+	}
+
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		ctx.Logger.Error("unsupported media type provided")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusUnsupportedMediaType).Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Retrieve the size and the digest of the photo from the request body
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxUploadRequestSize))
+	if err != nil {
+		var mess []byte
+		if isBodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			ctx.Logger.WithError(err).Error("the body of the request is too large")
+			mess = []byte(fmt.Errorf(components.StatusRequestEntityTooLarge, "the body of the request is too large").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while reading the body of the request")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while reading the body of the request").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	var upload components.Upload
+	if err = json.Unmarshal(body, &upload); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx.Logger.WithError(err).Error("error while decoding the upload from the body of the request")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "error while decoding the upload from the body of the request").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Check if the provided size and digest are valid
+	if upload.Size <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx.Logger.Error("provided size not valid")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "provided size not valid").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+	if upload.Size > maxUploadSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		ctx.Logger.Error("provided size exceeds the maximum size of the photos")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusRequestEntityTooLarge, "provided size exceeds the maximum size of the photos").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+	if err = components.CheckIfValid(upload.Digest, "Digest"); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx.Logger.WithError(err).Error("provided digest not valid")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "provided digest not valid").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Check if the user can start another upload
+	count, err := rt.db.CountUploads(*username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while counting the uploads of the user")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while counting the uploads of the user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+	if *count >= maxPendingUploads {
+		w.WriteHeader(http.StatusConflict)
+		ctx.Logger.Error("too many uploads in progress")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusConflict, "too many uploads in progress").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	created, err := rt.db.CreateUpload(*username, upload.Size, upload.Digest, rt.uploadTTL)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while creating the upload")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while creating the upload").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	writeUpload(w, ctx, created, http.StatusCreated)
+
+}
+
+func (rt _router) getUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	username := helperUploadOwner(w, r, ps, ctx, rt)
+	if username == nil {
+		return
+	}
+
+	upload := helperUpload(w, ps, ctx, rt, *username)
+	if upload == nil {
+		return
+	}
+
+	writeUpload(w, ctx, upload, http.StatusOK)
+
+}
+
+func (rt _router) appendUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	username := helperUploadOwner(w, r, ps, ctx, rt)
+	if username == nil {
+		return
+	}
+
+	if contentType := r.Header.Get("Content-Type"); contentType != uploadChunkType {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		ctx.Logger.Error("unsupported media type provided")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusUnsupportedMediaType).Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Retrieve the offset the chunk starts at
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx.Logger.Error("provided offset not valid")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "provided offset not valid").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	upload := helperUpload(w, ps, ctx, rt, *username)
+	if upload == nil {
+		return
+	}
+
+	// The chunk must start where the previous one ended: the client resumes from the offset of the upload
+	if offset != upload.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.WriteHeader(http.StatusConflict)
+		ctx.Logger.Error("chunk not starting at the offset of the upload")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusConflict, "chunk not starting at the offset of the upload").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Read the chunk, which cannot go past the size of the upload
+	remaining := upload.Size - upload.Offset
+	chunk, err := io.ReadAll(io.LimitReader(r.Body, remaining+1))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while reading the chunk")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while reading the chunk").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+	if int64(len(chunk)) > remaining {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		ctx.Logger.Error("chunk goes past the size of the upload")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusRequestEntityTooLarge, "chunk goes past the size of the upload").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+	if len(chunk) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx.Logger.Error("empty chunk provided")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "empty chunk provided").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	// Store the chunk, then record it. If another chunk at the same offset is recorded first, this one has either been
+	// overwritten or overwrote it: any difference is caught by the digest, when the upload is posted.
+	if err = rt.photos.Put(uploadChunkKey(upload.UploadID, offset), chunk); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while storing the chunk")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while storing the chunk").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+	upload, err = rt.db.AdvanceUpload(*username, upload.UploadID, offset, int64(len(chunk)), rt.uploadTTL)
+	if err != nil {
+		var mess []byte
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			ctx.Logger.WithError(err).Error("provided upload does not exist")
+			mess = []byte(fmt.Errorf(components.StatusNotFound, "provided upload does not exist").Error())
+		} else if errors.Is(err, components.ErrUploadOffset) {
+			w.WriteHeader(http.StatusConflict)
+			ctx.Logger.WithError(err).Error("another chunk received at the same offset")
+			mess = []byte(fmt.Errorf(components.StatusConflict, "another chunk received at the same offset").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while recording the chunk")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while recording the chunk").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	writeUpload(w, ctx, upload, http.StatusOK)
+
+}
+
+func (rt _router) deleteUpload(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext) {
+
+	username := helperUploadOwner(w, r, ps, ctx, rt)
+	if username == nil {
+		return
+	}
+
+	upload := helperUpload(w, ps, ctx, rt, *username)
+	if upload == nil {
+		return
+	}
+
+	if err := rt.removeUpload(*username, upload.UploadID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while deleting the upload")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while deleting the upload").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+}
+
+// helperUploadOwner checks that resumable uploads are enabled, and that the user in the path is the authenticated one,
+// returning it. If not, the response is written and nil is returned.
+func helperUploadOwner(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ctx reqcontext.RequestContext, rt _router) *string {
+
+	if rt.uploadTTL == 0 {
+		w.WriteHeader(http.StatusNotImplemented)
+		ctx.Logger.Error("resumable uploads are not enabled")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusNotImplemented, "resumable uploads are not enabled").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return nil
+	}
+
+	// Retrieve the username of the authenticated user
+	usernameAuth := helperAuth(w, r, ps, ctx, rt)
+	if usernameAuth == nil {
+		return nil
+	}
+
+	username, _ := helperPost(w, r, ps, ctx, rt, false)
+	if username == nil {
+		return nil
+	}
+
+	// Check if the username in the path and the authenticated one are the same
+	if *username != *usernameAuth {
+		w.WriteHeader(http.StatusForbidden)
+		ctx.Logger.Error("authenticated user cannot access the uploads of another user")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusForbidden, "authenticated user cannot access the uploads of another user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return nil
+	}
+
+	return username
+
+}
+
+// helperUpload retrieves the upload of the user with the ID in the path. If it does not exist (or has expired), the
+// response is written and nil is returned.
+func helperUpload(w http.ResponseWriter, ps httprouter.Params, ctx reqcontext.RequestContext, rt _router, username string) *components.Upload {
+
+	uploadID := ps.ByName("upload_id")
+	if err := components.CheckIfValid(uploadID, "ID"); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx.Logger.WithError(err).Error("provided upload ID not valid")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "provided upload ID not valid").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return nil
+	}
+
+	upload, err := rt.db.GetUpload(username, uploadID)
+	if err != nil {
+		var mess []byte
+		if errors.Is(err, sql.ErrNoRows) {
+			w.WriteHeader(http.StatusNotFound)
+			ctx.Logger.WithError(err).Error("provided upload does not exist")
+			mess = []byte(fmt.Errorf(components.StatusNotFound, "provided upload does not exist").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while retrieving the upload")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while retrieving the upload").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return nil
+	}
+
+	return upload
+
+}
+
+// writeUpload sends the upload to the client with the given status, with its offset in the Upload-Offset header too
+func writeUpload(w http.ResponseWriter, ctx reqcontext.RequestContext, upload *components.Upload, status int) {
+
+	response, err := json.MarshalIndent(*upload, "", " ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while encoding the response as JSON")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while encoding the response as JSON").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.WriteHeader(status)
+	if _, err = w.Write(response); err != nil {
+		ctx.Logger.WithError(err).Error("error while writing the response")
+	}
+
+}
+
+// uploadChunkKey returns the key the chunk of the given upload starting at the given offset is stored under
+func uploadChunkKey(uploadID string, offset int64) string {
+	return uploadPrefix + uploadID + "/" + strconv.FormatInt(offset, 10)
+}
+
+// readUpload returns the content of the complete upload, checked against its digest. Returns
+// components.ErrUploadDigest if the chunks do not add up to the photo the upload was started for.
+func (rt _router) readUpload(upload *components.Upload) ([]byte, error) {
+	content := make([]byte, 0, upload.Size)
+	for int64(len(content)) < upload.Size {
+		chunk, err := rt.photos.Get(uploadChunkKey(upload.UploadID, int64(len(content))))
+		if errors.Is(err, blobstore.ErrNotFound) {
+			// A chunk overwritten by another of a different length
+			return nil, components.ErrUploadDigest
+		} else if err != nil {
+			return nil, err
+		}
+		content = append(content, chunk...)
+	}
+	if int64(len(content)) != upload.Size || blobstore.Digest(content) != upload.Digest {
+		return nil, components.ErrUploadDigest
+	}
+	return content, nil
+}
+
+// removeUpload deletes the upload, and then its chunks (see removeUploadChunks)
+func (rt _router) removeUpload(username string, uploadID string) error {
+	if err := rt.db.DeleteUpload(username, uploadID); err != nil {
+		return err
+	}
+
+	rt.removeUploadChunks(uploadID)
+	return nil
+}
+
+// removeUploadChunks deletes the chunks of an upload already deleted. Failing to delete them is only logged: they are
+// deleted with the expired uploads anyway.
+func (rt _router) removeUploadChunks(uploadID string) {
+	chunks, err := rt.photos.List(uploadPrefix + uploadID + "/")
+	if err == nil {
+		for _, chunk := range chunks {
+			if err = rt.photos.Delete(chunk.Key); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		rt.baseLogger.WithError(err).WithField("upload", uploadID).Error("error while deleting the chunks of the upload")
+	}
+}
+
+// runUploadExpiry deletes the expired uploads at every uploadExpiryInterval, until Close is called
+func (rt *_router) runUploadExpiry() {
+	defer rt.background.Done()
+
+	ticker := time.NewTicker(uploadExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rt.stop:
+			return
+		case <-ticker.C:
+		}
+		if err := rt.expireUploads(); err != nil {
+			rt.baseLogger.WithError(err).Error("error while deleting the expired uploads")
+		}
+	}
+}
+
+// expireUploads deletes the expired uploads, and the chunks of the uploads that no longer exist: the ones expired, and
+// any chunk stored while its upload was being deleted
+func (rt _router) expireUploads() error {
+	if err := rt.db.DeleteExpiredUploads(); err != nil {
+		return err
+	}
+
+	// The uploads are retrieved before listing the chunks: uploads are created before their chunks are stored
+	ids, err := rt.db.GetUploadIDs()
+	if err != nil {
+		return err
+	}
+	uploads := make(map[string]bool, len(*ids))
+	for _, id := range *ids {
+		uploads[id] = true
+	}
+
+	chunks, err := rt.photos.List(uploadPrefix)
+	if err != nil {
+		return err
+	}
+	deleted := 0
+	for _, chunk := range chunks {
+		uploadID := strings.SplitN(strings.TrimPrefix(chunk.Key, uploadPrefix), "/", 2)[0]
+		if uploads[uploadID] {
+			continue
+		}
+		if err = rt.photos.Delete(chunk.Key); err != nil {
+			return err
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		rt.baseLogger.WithField("chunks", deleted).Info("chunks of the expired uploads deleted")
+	}
+	return nil
+}
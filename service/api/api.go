@@ -9,8 +9,12 @@ Example:
 
 	// Create the API router
 	apirouter, err := api.New(api.Config{
-		Logger:   logger,
-		Database: appdb,
+		Logger:        logger,
+		Database:      appdb,
+		Authenticator: auth,
+		Photos:        photos,
+		PhotoURLs:     photoURLs,
+		LoginMode:     cfg.Auth.LoginMode,
 	})
 	if err != nil {
 		logger.WithError(err).Error("error creating the API server instance")
@@ -38,10 +42,19 @@ package api
 
 import (
 	"errors"
+	"fmt"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/authenticator"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/blobstore"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/imaging"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/oidc"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/photourl"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/ratelimit"
 	"github.com/julienschmidt/httprouter"
 	"github.com/sirupsen/logrus"
 	"net/http"
+	"sync"
+	"time"
 )
 
 // Config is used to provide dependencies and configuration to the New function.
@@ -51,8 +64,82 @@ type Config struct {
 
 	// Database is the instance of database.AppDatabase where data are saved
 	Database database.AppDatabase
+
+	// Authenticator issues the tokens handed out at login, and verifies the ones sent by the clients
+	Authenticator authenticator.Authenticator
+
+	// Photos is the instance of blobstore.BlobStore where the photos are stored
+	Photos blobstore.BlobStore
+
+	// LoginMode is either LoginModeUsername (legacy, the username is enough to login) or LoginModePassword
+	LoginMode string
+
+	// OIDC is the OpenID Connect provider used for single sign-on. If nil, single sign-on is disabled.
+	OIDC *oidc.Provider
+
+	// PhotoPolicy is the aspect ratio and the resolution the uploaded photos are brought to
+	PhotoPolicy imaging.Policy
+
+	// PhotoURLs signs the URLs of the photos sent to the clients, and verifies them when the photos are requested
+	PhotoURLs *photourl.Signer
+
+	// RateLimits are the limits enforced on each group of routes. A zero limit disables rate limiting for the group.
+	RateLimits RateLimits
+
+	// Reconciler configures the background task quarantining the photos nothing references anymore
+	Reconciler ReconcilerConfig
+
+	// Quotas limit the bytes each user can store
+	Quotas Quotas
+
+	// UploadTTL is how long the resumable uploads are kept without receiving any chunk. If zero, resumable uploads are
+	// disabled.
+	UploadTTL time.Duration
+
+	// Similarity configures the detection of near-duplicate photos, and the blocklist of the photos that cannot be posted
+	Similarity SimilarityConfig
+}
+
+// RateLimits are the rate limits of the route groups. Requests are counted per authenticated user, or per IP address
+// for anonymous clients.
+type RateLimits struct {
+	// Session limits the login routes
+	Session ratelimit.Limit
+
+	// Writes limits the routes changing something (POST, PUT, DELETE)
+	Writes ratelimit.Limit
+
+	// Reads limits the routes only reading something (GET)
+	Reads ratelimit.Limit
 }
 
+// Quotas are the limits on the bytes stored for each user, by the images of their posts and their profile pic. They are
+// enforced on the upload of posts: a profile pic replaces the previous one, hardly adding up.
+type Quotas struct {
+	// Default is the quota of the users without an override, in bytes. Zero means no quota.
+	Default int64
+
+	// Overrides are the quotas of specific users, in bytes, by username. Zero means no quota.
+	Overrides map[string]int64
+}
+
+// of returns the quota of the given user, zero if none
+func (q Quotas) of(username string) int64 {
+	if quota, ok := q.Overrides[username]; ok {
+		return quota
+	}
+	return q.Default
+}
+
+const (
+	// LoginModeUsername lets anyone login by just providing a username
+	LoginModeUsername = "username"
+
+	// LoginModePassword requires a password alongside the username. New accounts are created with the password of their
+	// first login; existing accounts without a password cannot login until they set one (in the username mode)
+	LoginModePassword = "password"
+)
+
 // Router is the package API interface representing an API handler builder
 type Router interface {
 	// Handler returns an HTTP handler for APIs provided in this package
@@ -71,6 +158,45 @@ func New(cfg Config) (Router, error) {
 	if cfg.Database == nil {
 		return nil, errors.New("database is required")
 	}
+	if cfg.Authenticator == nil {
+		return nil, errors.New("authenticator is required")
+	}
+	if cfg.Photos == nil {
+		return nil, errors.New("photo store is required")
+	}
+	if err := cfg.PhotoPolicy.Check(); err != nil {
+		return nil, fmt.Errorf("photo policy not valid: %w", err)
+	}
+	if cfg.PhotoURLs == nil {
+		return nil, errors.New("photo URL signer is required")
+	}
+	if cfg.LoginMode != LoginModeUsername && cfg.LoginMode != LoginModePassword {
+		return nil, errors.New("login mode must be either \"" + LoginModeUsername + "\" or \"" + LoginModePassword + "\"")
+	}
+	if cfg.Reconciler.Interval < 0 || cfg.Reconciler.GracePeriod < 0 {
+		return nil, errors.New("reconciler interval and grace period must not be negative")
+	}
+	if cfg.Quotas.Default < 0 {
+		return nil, errors.New("default quota must not be negative")
+	}
+	for username, quota := range cfg.Quotas.Overrides {
+		if quota < 0 {
+			return nil, fmt.Errorf("quota of %q must not be negative", username)
+		}
+	}
+	if cfg.UploadTTL < 0 {
+		return nil, errors.New("upload TTL must not be negative")
+	}
+	if cfg.Similarity.MaxDistance < 0 || cfg.Similarity.MaxDistance > 64 || cfg.Similarity.BlockDistance < 0 || cfg.Similarity.BlockDistance > 64 {
+		return nil, errors.New("similarity distances must be between 0 and 64")
+	}
+	blocklist := make([]imaging.Hash, len(cfg.Similarity.Blocklist))
+	for i, hash := range cfg.Similarity.Blocklist {
+		var err error
+		if blocklist[i], err = imaging.ParseHash(hash); err != nil {
+			return nil, fmt.Errorf("blocklist not valid: %w", err)
+		}
+	}
 
 	// Create a new router where we will register HTTP endpoints. The server will pass requests to this router to be
 	// handled.
@@ -78,11 +204,51 @@ func New(cfg Config) (Router, error) {
 	router.RedirectTrailingSlash = false
 	router.RedirectFixedPath = false
 
-	return &_router{
-		router:     router,
-		baseLogger: cfg.Logger,
-		db:         cfg.Database,
-	}, nil
+	// Profile pics are cropped square, with the same limits on animations as the photos of the posts
+	profilePicPolicy := cfg.PhotoPolicy
+	profilePicPolicy.RatioWidth, profilePicPolicy.RatioHeight = 1, 1
+	profilePicPolicy.Aspect = imaging.AspectCrop
+	profilePicPolicy.MaxWidth, profilePicPolicy.MaxHeight = profilePicMaxSize, profilePicMaxSize
+
+	rt := &_router{
+		router:           router,
+		baseLogger:       cfg.Logger,
+		db:               cfg.Database,
+		auth:             cfg.Authenticator,
+		photos:           cfg.Photos,
+		loginMode:        cfg.LoginMode,
+		oidc:             cfg.OIDC,
+		photoPolicy:      cfg.PhotoPolicy,
+		profilePicPolicy: profilePicPolicy,
+		photoURLs:        cfg.PhotoURLs,
+		blobLock:         &sync.Mutex{},
+		storing:          make(map[string]int),
+		reserved:         make(map[string]int64),
+		limiters: map[string]*ratelimit.Limiter{
+			routeGroupSession: ratelimit.New(cfg.RateLimits.Session),
+			routeGroupWrites:  ratelimit.New(cfg.RateLimits.Writes),
+			routeGroupReads:   ratelimit.New(cfg.RateLimits.Reads),
+		},
+		reconciler: cfg.Reconciler,
+		quotas:     cfg.Quotas,
+		uploadTTL:  cfg.UploadTTL,
+		similarity: cfg.Similarity,
+		blocklist:  blocklist,
+		hashes:     &hashIndex{},
+		stop:       make(chan struct{}),
+		background: &sync.WaitGroup{},
+	}
+
+	// Start the background tasks
+	if cfg.Reconciler.Interval > 0 {
+		rt.background.Add(1)
+		go rt.runReconciler()
+	}
+	if cfg.UploadTTL > 0 {
+		rt.background.Add(1)
+		go rt.runUploadExpiry()
+	}
+	return rt, nil
 }
 
 type _router struct {
@@ -93,4 +259,52 @@ type _router struct {
 	baseLogger logrus.FieldLogger
 
 	db database.AppDatabase
+
+	auth authenticator.Authenticator
+
+	photos blobstore.BlobStore
+
+	loginMode string
+
+	oidc *oidc.Provider
+
+	photoPolicy imaging.Policy
+
+	// profilePicPolicy crops the profile pics square
+	profilePicPolicy imaging.Policy
+
+	photoURLs *photourl.Signer
+
+	// blobLock serializes the changes to the references to the photos with the deleting of the photos, so that a photo
+	// is not deleted while a new reference to it is being recorded. Photos are stored outside it (see beginStoring).
+	blobLock *sync.Mutex
+
+	// storing counts, by digest, the requests storing a photo: photos being stored are not deleted, even if nothing
+	// references them yet. Guarded by blobLock.
+	storing map[string]int
+
+	// reserved is the size, by user, of the photos being stored, counted towards their quota until the references to
+	// them are recorded. Guarded by blobLock.
+	reserved map[string]int64
+
+	// limiters are the rate limiters of the route groups (see routeGroup)
+	limiters map[string]*ratelimit.Limiter
+
+	reconciler ReconcilerConfig
+
+	quotas Quotas
+
+	uploadTTL time.Duration
+
+	similarity SimilarityConfig
+
+	// blocklist are the hashes of the similarity blocklist, parsed
+	blocklist []imaging.Hash
+
+	// hashes are the perceptual hashes of the images of the posts, searched for the similar posts
+	hashes *hashIndex
+
+	// stop is closed by Close to stop the background tasks, which are tracked by background
+	stop       chan struct{}
+	background *sync.WaitGroup
 }
@@ -1,13 +1,20 @@
 package api
 
 import (
+	"bytes"
 	"database/sql"
 	"errors"
 	"fmt"
+	"image"
+	"io"
+	"mime/multipart"
 	"net/http"
+	"strings"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/api/reqcontext"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/authenticator"
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/imaging"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -24,31 +31,57 @@ func helperAuth(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ct
 		return nil
 	}
 
-	if err := components.CheckIfValid(token, "ID"); err != nil {
-		if errors.Is(err, components.ErrIDNotValid) {
-			w.WriteHeader(http.StatusBadRequest)
-			ctx.Logger.WithError(err).Error("provided auth token not valid")
-			if _, err = w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "provided auth token not valid").Error())); err != nil {
+	// API keys are only accepted on the routes requiring a scope they have been granted
+	if strings.HasPrefix(token, components.APIKeyPrefix) {
+		username, err := rt.db.GetUsernameByAPIKey(token, ctx.Scopes)
+		if err != nil {
+			var mess []byte
+			if errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusUnauthorized)
+				ctx.Logger.WithError(err).Error("no API key found with the provided token")
+				mess = []byte(fmt.Errorf(components.StatusUnauthorized, "no API key found with the provided token").Error())
+			} else if errors.Is(err, components.ErrAPIKeyExpired) {
+				w.WriteHeader(http.StatusUnauthorized)
+				ctx.Logger.WithError(err).Error("the provided API key has expired")
+				mess = []byte(fmt.Errorf(components.StatusUnauthorized, "the provided API key has expired").Error())
+			} else if errors.Is(err, components.ErrScopeMissing) {
+				w.WriteHeader(http.StatusForbidden)
+				ctx.Logger.WithError(err).Error("the provided API key has not been granted any of the scopes " + strings.Join(ctx.Scopes, ", "))
+				mess = []byte(fmt.Errorf(components.StatusForbidden, "the provided API key has not been granted the scope required by this operation").Error())
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+				ctx.Logger.WithError(err).Error("error while getting the username associated with the given API key")
+				mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while getting the username associated with the given API key").Error())
+			}
+			if _, err = w.Write(mess); err != nil {
 				ctx.Logger.WithError(err).Error("error while writing the response")
 			}
 			return nil
 		}
-		w.WriteHeader(http.StatusInternalServerError)
-		ctx.Logger.WithError(err).Error("error while checking if the auth token is valid")
-		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while checking if the auth token is valid" /*err*/).Error())); err != nil {
-			ctx.Logger.WithError(err).Error("error while writing the response")
-		}
-		return nil
+		return username
+	}
+
+	// The token has already been verified when the request came in
+	if ctx.Username != "" {
+		return &ctx.Username
 	}
 
-	// Retrieve the username (if valid) associated to the given Auth token and check if there exists an user registered with such token
-	username, err := rt.db.GetUsernameByToken(token)
+	// Retrieve the username (if valid) associated to the given Auth token
+	username, err := rt.auth.Authenticate(token)
 	if err != nil {
 		var mess []byte
-		if errors.Is(err, sql.ErrNoRows) {
+		if errors.Is(err, authenticator.ErrMalformedToken) {
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.WithError(err).Error("provided auth token not valid")
+			mess = []byte(fmt.Errorf(components.StatusBadRequest, "provided auth token not valid").Error())
+		} else if errors.Is(err, authenticator.ErrInvalidToken) {
+			w.WriteHeader(http.StatusUnauthorized)
+			ctx.Logger.WithError(err).Error("no session found with the provided authenticated token")
+			mess = []byte(fmt.Errorf(components.StatusUnauthorized, "no session found with the provided token").Error())
+		} else if errors.Is(err, authenticator.ErrExpiredToken) {
 			w.WriteHeader(http.StatusUnauthorized)
-			ctx.Logger.WithError(err).Error("no user found with the provided authenticated token")
-			mess = []byte(fmt.Errorf(components.StatusUnauthorized, "no user found with the provided token").Error())
+			ctx.Logger.WithError(err).Error("the session associated with the provided token has expired")
+			mess = []byte(fmt.Errorf(components.StatusUnauthorized, "the session associated with the provided token has expired").Error())
 		} else {
 			w.WriteHeader(http.StatusInternalServerError)
 			ctx.Logger.WithError(err).Error("error while getting the username associated with the given token")
@@ -129,3 +162,320 @@ func helperPost(w http.ResponseWriter, r *http.Request, ps httprouter.Params, ct
 	return &ownerUsername, &postID
 
 }
+
+// helperPhotos reads the photos uploaded in the photoFile fields of the multipart form of the request (at least one, at
+// most maxPhotos, in order, each of at most maxUploadSize bytes), checks that they are images in one of the accepted
+// formats, and brings them to the given policy. If anything goes wrong, the response is written and nil is returned.
+// The other fields of the form are left in r.MultipartForm.
+func helperPhotos(w http.ResponseWriter, r *http.Request, ctx reqcontext.RequestContext, policy imaging.Policy, maxPhotos int) []uploadedPhoto {
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxPhotosBodySize)
+
+	// Retrieve the photos from the request body
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		var mess []byte
+		if isBodyTooLarge(err) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			ctx.Logger.WithError(err).Error("the body of the request is too large")
+			mess = []byte(fmt.Errorf(components.StatusRequestEntityTooLarge, "the body of the request is too large").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while decoding the body of the request")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while decoding the body of the request").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return nil
+	}
+
+	rawPhotos := r.MultipartForm.File["photoFile"]
+	if len(rawPhotos) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx.Logger.Error("no photo provided")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "no photo provided").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return nil
+	}
+	if len(rawPhotos) > maxPhotos {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx.Logger.Error("too many photos provided")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "too many photos provided").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return nil
+	}
+
+	for _, rawPhoto := range rawPhotos {
+		if rawPhoto.Size > maxUploadSize {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			ctx.Logger.Error("provided photo exceeds the maximum size of the photos")
+			if _, err := w.Write([]byte(fmt.Errorf(components.StatusRequestEntityTooLarge, "provided photo exceeds the maximum size of the photos").Error())); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			return nil
+		}
+	}
+
+	photos := make([]uploadedPhoto, 0, len(rawPhotos))
+	for _, rawPhoto := range rawPhotos {
+		photo := helperReadPhoto(w, ctx, rawPhoto, policy)
+		if photo == nil {
+			return nil
+		}
+		photos = append(photos, *photo)
+	}
+
+	return photos
+
+}
+
+// isBodyTooLarge tells whether the given error comes from reading past the limit set by http.MaxBytesReader, which only
+// tells it by its message before Go 1.19
+func isBodyTooLarge(err error) bool {
+	return strings.Contains(err.Error(), "http: request body too large")
+}
+
+// helperUploadedPhotos reads the photos sent as the given resumable uploads of the user (at least one, at most
+// maxPhotos, each once, in order), checks them against the digests the uploads were started for, then checks that they
+// are images in one of the accepted formats, and brings them to the given policy. If anything goes wrong, the response
+// is written and nil is returned.
+func helperUploadedPhotos(w http.ResponseWriter, ctx reqcontext.RequestContext, rt _router, username string, uploadIDs []string, policy imaging.Policy, maxPhotos int) []uploadedPhoto {
+
+	if len(uploadIDs) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx.Logger.Error("no photo provided")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "no photo provided").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return nil
+	}
+	if len(uploadIDs) > maxPhotos {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx.Logger.Error("too many photos provided")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "too many photos provided").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return nil
+	}
+
+	provided := make(map[string]bool, len(uploadIDs))
+	for _, uploadID := range uploadIDs {
+		if provided[uploadID] {
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.Error("upload provided more than once")
+			if _, err := w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "upload provided more than once").Error())); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			return nil
+		}
+		provided[uploadID] = true
+	}
+
+	photos := make([]uploadedPhoto, 0, len(uploadIDs))
+	for _, uploadID := range uploadIDs {
+		upload, err := rt.db.GetUpload(username, uploadID)
+		if err != nil {
+			var mess []byte
+			if errors.Is(err, sql.ErrNoRows) {
+				w.WriteHeader(http.StatusNotFound)
+				ctx.Logger.WithError(err).Error("provided upload does not exist")
+				mess = []byte(fmt.Errorf(components.StatusNotFound, "provided upload does not exist").Error())
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+				ctx.Logger.WithError(err).Error("error while retrieving the upload")
+				mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while retrieving the upload").Error())
+			}
+			if _, err = w.Write(mess); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			return nil
+		}
+		if upload.Offset < upload.Size {
+			w.WriteHeader(http.StatusConflict)
+			ctx.Logger.Error("provided upload not complete")
+			if _, err = w.Write([]byte(fmt.Errorf(components.StatusConflict, "provided upload not complete").Error())); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			return nil
+		}
+
+		content, err := rt.readUpload(upload)
+		if err != nil {
+			var mess []byte
+			if errors.Is(err, components.ErrUploadDigest) {
+				w.WriteHeader(http.StatusBadRequest)
+				ctx.Logger.WithError(err).Error("content of the upload does not match its digest")
+				mess = []byte(fmt.Errorf(components.StatusBadRequest, "content of the upload does not match its digest").Error())
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+				ctx.Logger.WithError(err).Error("error while reading the upload")
+				mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while reading the upload").Error())
+			}
+			if _, err = w.Write(mess); err != nil {
+				ctx.Logger.WithError(err).Error("error while writing the response")
+			}
+			return nil
+		}
+
+		photo := helperCheckPhoto(w, ctx, content, policy)
+		if photo == nil {
+			return nil
+		}
+		photos = append(photos, *photo)
+	}
+
+	return photos
+
+}
+
+// helperPhoto is helperPhotos for the requests uploading a single photo
+func helperPhoto(w http.ResponseWriter, r *http.Request, ctx reqcontext.RequestContext, policy imaging.Policy) *uploadedPhoto {
+
+	photos := helperPhotos(w, r, ctx, policy, 1)
+	if photos == nil {
+		return nil
+	}
+	return &photos[0]
+
+}
+
+// helperReadPhoto reads a photo uploaded in a multipart form, checks that it is an image in one of the accepted formats,
+// and brings it to the given policy. If anything goes wrong, the response is written and nil is returned.
+func helperReadPhoto(w http.ResponseWriter, ctx reqcontext.RequestContext, photo *multipart.FileHeader, policy imaging.Policy) *uploadedPhoto {
+
+	// Access the photo file
+	fileReader, err := photo.Open()
+	if err != nil {
+		http.Error(w, "Unable to open photo file", http.StatusInternalServerError)
+		return nil
+	}
+	defer fileReader.Close()
+
+	// Read the file content
+	content, err := io.ReadAll(fileReader)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while reading the photo")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while reading the photo").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return nil
+	}
+
+	return helperCheckPhoto(w, ctx, content, policy)
+
+}
+
+// helperCheckPhoto checks that the content of a photo is an image in one of the accepted formats, and brings it to the
+// given policy. If anything goes wrong, the response is written and nil is returned.
+func helperCheckPhoto(w http.ResponseWriter, ctx reqcontext.RequestContext, content []byte, policy imaging.Policy) *uploadedPhoto {
+
+	// Check if the provided file is an image (only the first 512 bytes determine its Content-Type)
+	mimeType := http.DetectContentType(content)
+	if _, ok := components.PhotoExtensions[mimeType]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		ctx.Logger.Error("provided file not an image")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusBadRequest, "provided file not an image").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return nil
+	}
+
+	// Drop the metadata of the photo, and bring it upright and to the aspect ratio and resolution of the policy (or reject it)
+	content, exif, err := policy.Apply(content)
+	if err != nil {
+		var mess []byte
+		if errors.Is(err, image.ErrFormat) { // err.Error() == "image: unknown format"
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.Error("provided image not in a valid format")
+			mess = []byte(fmt.Errorf(components.StatusBadRequest, "provided image not in a valid format").Error())
+		} else if errors.Is(err, imaging.ErrTooManyPixels) {
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.Error("photo has too many pixels")
+			mess = []byte(fmt.Errorf(components.StatusBadRequest, "photo has too many pixels").Error())
+		} else if errors.Is(err, imaging.ErrAspectRatio) {
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.Error("photo does not satisfy the aspect ratio requirements")
+			mess = []byte(fmt.Errorf(components.StatusBadRequest, "photo does not satisfy the aspect ratio requirements").Error())
+		} else if errors.Is(err, imaging.ErrAnimation) {
+			w.WriteHeader(http.StatusBadRequest)
+			ctx.Logger.Error("animation has too many frames or lasts too long")
+			mess = []byte(fmt.Errorf(components.StatusBadRequest, "animation has too many frames or lasts too long").Error())
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+			ctx.Logger.WithError(err).Error("error while processing the photo")
+			mess = []byte(fmt.Errorf(components.StatusInternalServerError, "error while processing the photo").Error())
+		}
+		if _, err = w.Write(mess); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return nil
+	}
+
+	// The policy can change the format of the photo (e.g., WebPs are re-encoded as PNGs)
+	mimeType = http.DetectContentType(content)
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while reading the size of the photo")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while reading the size of the photo").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return nil
+	}
+
+	return &uploadedPhoto{Content: content, MIMEType: mimeType, EXIF: exif, Width: config.Width, Height: config.Height}
+
+}
+
+// uploadedPhoto is a photo read by helperPhotos
+type uploadedPhoto struct {
+	Content  []byte
+	MIMEType string
+	EXIF     map[string]string // EXIF tags kept by the policy
+	Width    int               // Size of the photo, once brought to the policy
+	Height   int
+}
+
+// helperQuota checks that the user can store the given number of bytes more without exceeding their quota, counting the
+// photos they are storing in the meantime (see beginStoring). Must be called holding blobLock, so that uploads in
+// parallel cannot exceed the quota together. If the quota would be exceeded,
+// it writes the error response (413 if the bytes alone exceed the quota, 507 otherwise) and returns false.
+func helperQuota(w http.ResponseWriter, ctx reqcontext.RequestContext, rt _router, username string, size int64) bool {
+	quota := rt.quotas.of(username)
+	if quota == 0 {
+		return true
+	}
+
+	if size > quota {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		ctx.Logger.WithField("quota", quota).Error("the photos exceed the storage quota of the user")
+		if _, err := w.Write([]byte(fmt.Errorf(components.StatusRequestEntityTooLarge, "the photos exceed the storage quota of the user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return false
+	}
+
+	usage, err := rt.db.GetStorageUsage(username)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		ctx.Logger.WithError(err).Error("error while retrieving the storage usage of the user")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInternalServerError, "error while retrieving the storage usage of the user").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return false
+	}
+	if *usage+rt.reserved[username]+size > quota {
+		w.WriteHeader(http.StatusInsufficientStorage)
+		ctx.Logger.WithField("usage", *usage).WithField("quota", quota).Error("storage quota of the user exceeded")
+		if _, err = w.Write([]byte(fmt.Errorf(components.StatusInsufficientStorage, "storage quota of the user exceeded").Error())); err != nil {
+			ctx.Logger.WithError(err).Error("error while writing the response")
+		}
+		return false
+	}
+
+	return true
+}
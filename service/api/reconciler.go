@@ -0,0 +1,190 @@
+package api
+
+import (
+	"strings"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/blobstore"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/imaging"
+	"github.com/sirupsen/logrus"
+)
+
+// ReconcilerConfig configures the background task comparing the photo store with the posts and the users in the
+// database. Photos nothing references are moved under quarantinePrefix, and references to photos missing from the store
+// are reported in the log.
+type ReconcilerConfig struct {
+	// Interval is the time between two runs. A zero interval disables the reconciler.
+	Interval time.Duration
+
+	// GracePeriod is how long a photo must have been stored before it can be quarantined, so that the photos of the
+	// requests in progress are left alone
+	GracePeriod time.Duration
+
+	// DryRun only reports the photos that would be quarantined, without moving them
+	DryRun bool
+}
+
+// quarantinePrefix is the prefix of the keys the unreferenced photos are moved to. The reconciler never touches them:
+// they can be inspected, restored or deleted by hand.
+const quarantinePrefix = "quarantine/"
+
+// skipPrefixes are the prefixes of the keys the reconciler leaves alone: the photos quarantined, and the chunks of the
+// resumable uploads, deleted when the uploads expire
+var skipPrefixes = []string{quarantinePrefix, uploadPrefix}
+
+// runReconciler reconciles the photo store with the database right away, and then at every interval, until Close is
+// called
+func (rt *_router) runReconciler() {
+	defer rt.background.Done()
+
+	ticker := time.NewTicker(rt.reconciler.Interval)
+	defer ticker.Stop()
+	for {
+		if err := rt.reconcile(); err != nil {
+			rt.baseLogger.WithError(err).Error("error while reconciling the photo store with the database")
+		}
+		select {
+		case <-rt.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcile quarantines the photos in the store that no post and no profile pic references anymore, and reports the
+// posts and the profile pics whose photo is missing from the store
+func (rt *_router) reconcile() error {
+	logger := rt.baseLogger.WithField("dryRun", rt.reconciler.DryRun)
+
+	// The references are retrieved before listing the store: photos are stored before being referenced, so any
+	// reference found is to a photo that is either listed or really missing
+	references, err := rt.db.GetPhotoReferences()
+	if err != nil {
+		return err
+	}
+	blobs, err := rt.photos.List("")
+	if err != nil {
+		return err
+	}
+
+	referenced := referencedKeys(*references)
+	stored := make(map[string]bool, len(blobs))
+	var candidates []string
+	deadline := globaltime.Now().Add(-rt.reconciler.GracePeriod)
+	for _, blob := range blobs {
+		stored[blob.Key] = true
+		if !skipped(blob.Key) && !referenced[blob.Key] && blob.ModTime.Before(deadline) {
+			candidates = append(candidates, blob.Key)
+		}
+	}
+
+	if !stored[defaultProfilePic] {
+		logger.WithField("key", defaultProfilePic).Warn("the default profile pic is missing from the store")
+	}
+	missing := 0
+	for _, reference := range *references {
+		if key := photoKey(reference.PhotoPath, reference.Digest); !stored[key] {
+			missing++
+			logger.WithFields(logrus.Fields{
+				"path":   reference.PhotoPath,
+				"digest": reference.Digest,
+				"owner":  reference.Owner,
+				"key":    key,
+			}).Warn("photo referenced by the database missing from the store")
+		}
+	}
+
+	quarantined, err := rt.quarantine(candidates)
+	logger.WithFields(logrus.Fields{
+		"stored":      len(blobs),
+		"references":  len(*references),
+		"missing":     missing,
+		"quarantined": quarantined,
+	}).Info("photo store reconciled with the database")
+	return err
+}
+
+// quarantine moves the given photos under quarantinePrefix, unless they have been referenced in the meantime. Returns how
+// many photos have been (or, in dry-run mode, would have been) quarantined.
+func (rt *_router) quarantine(candidates []string) (int, error) {
+	if len(candidates) == 0 {
+		return 0, nil
+	}
+
+	// Photos are referenced under blobLock: holding it, the references (and the photos being stored) are up to date with
+	// the store
+	rt.blobLock.Lock()
+	defer rt.blobLock.Unlock()
+
+	references, err := rt.db.GetPhotoReferences()
+	if err != nil {
+		return 0, err
+	}
+
+	// The photos being stored are referenced as soon as they are
+	for digest := range rt.storing {
+		*references = append(*references, components.PhotoReference{Digest: digest})
+	}
+	referenced := referencedKeys(*references)
+
+	quarantined := 0
+	for _, key := range candidates {
+		if referenced[key] {
+			continue
+		}
+		select {
+		case <-rt.stop:
+			return quarantined, nil
+		default:
+		}
+
+		logger := rt.baseLogger.WithField("key", key)
+		if rt.reconciler.DryRun {
+			logger.Info("unreferenced photo would be quarantined")
+		} else if err = blobstore.Move(rt.photos, key, quarantinePrefix+key); err != nil {
+			return quarantined, err
+		} else {
+			logger.Info("unreferenced photo quarantined")
+		}
+		quarantined++
+	}
+	return quarantined, nil
+}
+
+// referencedKeys returns the set of the keys of the photos referenced, with their renditions and the default profile pic
+func referencedKeys(references []components.PhotoReference) map[string]bool {
+	originals := []string{defaultProfilePic}
+	for _, reference := range references {
+		originals = append(originals, photoKey(reference.PhotoPath, reference.Digest))
+	}
+
+	keys := make(map[string]bool, len(originals)*(len(imaging.AllWidths())+1))
+	for _, key := range originals {
+		keys[key] = true
+		for _, width := range imaging.AllWidths() {
+			keys[imaging.RenditionPath(key, width)] = true
+		}
+	}
+	return keys
+}
+
+// skipped reports whether the reconciler leaves the given key alone
+func skipped(key string) bool {
+	for _, prefix := range skipPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// photoKey returns the key the photo at the given path is stored under: the key of its digest, or the path itself for
+// the photos not stored by digest yet
+func photoKey(photoPath string, digest string) string {
+	if digest == "" {
+		return photoPath
+	}
+	return blobstore.DigestKey(digest)
+}
@@ -18,4 +18,18 @@ type RequestContext struct {
 
 	// Logger is a custom field logger for the request
 	Logger logrus.FieldLogger
+
+	// RemoteIP is the IP address of the client, without the port
+	RemoteIP string
+
+	// UserAgent is the User-Agent header sent by the client
+	UserAgent string
+
+	// Username is the user the Authorization header belongs to, resolved before the request is handled (for rate
+	// limiting). Empty if the header is missing or not valid: handlers still have to go through helperAuth.
+	Username string
+
+	// Scopes are the scopes an API key must be granted (any of them) to access the matched route. Empty if the route
+	// cannot be accessed with API keys (e.g., account and session management).
+	Scopes []string
 }
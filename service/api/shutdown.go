@@ -2,5 +2,10 @@ package api
 
 // Close should close everything opened in the lifecycle of the `_router`; for example, background goroutines.
 func (rt *_router) Close() error {
+	if rt.stop != nil {
+		close(rt.stop)
+		rt.background.Wait()
+		rt.stop = nil
+	}
 	return nil
 }
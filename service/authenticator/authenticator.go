@@ -0,0 +1,68 @@
+/*
+Package authenticator issues and verifies the tokens the clients use to authenticate against the API.
+
+Two implementations of Authenticator are available:
+
+  - NewSessionAuthenticator returns opaque tokens, each one bound to a session stored in the database. Sessions can be
+    listed and revoked, but every request costs a database lookup.
+  - NewSignedAuthenticator returns self-contained tokens (JWT-style claims signed with HMAC-SHA256), verified without
+    any session lookup. Signing keys are identified by a key ID, so that they can be rotated: tokens signed with an
+    old key stay valid as long as the key is still configured. Tokens carry the immutable ID of their user (its
+    username too, but tokens are resolved by ID, since usernames can change hands) and a per-user generation: they
+    cannot be listed nor revoked one at a time, but every token of a user can be revoked at once. The current username
+    and generation of the users are cached for a short while, so that most requests need no database lookup either.
+*/
+package authenticator
+
+import (
+	"errors"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+)
+
+// Authenticator issues tokens to users logging in, and resolves the tokens sent by the clients back to their users
+type Authenticator interface {
+	// IssueToken returns a new token for the given user, logging in from the given device
+	IssueToken(Username string, UserAgent string, RemoteIP string) (*string, error)
+
+	// Authenticate returns the username of the owner of the given token. Returns ErrMalformedToken, ErrInvalidToken or
+	// ErrExpiredToken if the token cannot be used to authenticate.
+	Authenticate(Token string) (*string, error)
+
+	// RevokeToken invalidates the given token. Returns ErrRevocationUnsupported if tokens cannot be revoked.
+	RevokeToken(Token string) error
+
+	// ListSessions returns the active sessions of the given user, flagging the one of the given token as the current
+	// one. Returns ErrSessionsUnsupported if the authenticator keeps no track of the tokens it issues.
+	ListSessions(Username string, Token string) (*[]components.Session, error)
+
+	// RevokeSession invalidates the session of the given user with the given ID. Returns ErrUnknownSession if the user
+	// has no such session, ErrRevocationUnsupported if tokens cannot be revoked one at a time.
+	RevokeSession(Username string, SessionID string) error
+
+	// RevokeOtherTokens invalidates every token of the given user but the given one. Authenticators that cannot tell
+	// the tokens of a user apart invalidate the given one as well.
+	RevokeOtherTokens(Username string, Token string) error
+
+	// ForgetUser drops whatever the authenticator caches about the given user, which has just been renamed: no token
+	// must keep resolving to its old username, which anyone can take from now on
+	ForgetUser(Username string)
+}
+
+// ErrMalformedToken is returned when the token is not in the format the authenticator expects
+var ErrMalformedToken = errors.New("malformed token")
+
+// ErrInvalidToken is returned when the token is unknown, revoked or not correctly signed
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrExpiredToken is returned when the token has expired
+var ErrExpiredToken = errors.New("expired token")
+
+// ErrRevocationUnsupported is returned by authenticators whose tokens cannot be revoked one at a time
+var ErrRevocationUnsupported = errors.New("token revocation not supported")
+
+// ErrSessionsUnsupported is returned by authenticators keeping no track of the tokens they issue
+var ErrSessionsUnsupported = errors.New("sessions not supported")
+
+// ErrUnknownSession is returned when the user has no session with the given ID
+var ErrUnknownSession = errors.New("unknown session")
@@ -0,0 +1,77 @@
+package authenticator
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+)
+
+type sessionAuthenticator struct {
+	db  database.AppDatabase
+	ttl time.Duration
+}
+
+// NewSessionAuthenticator returns an Authenticator backed by the sessions stored in the database. A session expires after
+// being unused for the given TTL.
+func NewSessionAuthenticator(db database.AppDatabase, TTL time.Duration) (Authenticator, error) {
+	if db == nil {
+		return nil, errors.New("database is required")
+	}
+	if TTL <= 0 {
+		return nil, errors.New("session TTL must be positive")
+	}
+	return &sessionAuthenticator{db: db, ttl: TTL}, nil
+}
+
+func (a *sessionAuthenticator) IssueToken(Username string, UserAgent string, RemoteIP string) (*string, error) {
+	return a.db.CreateSession(Username, UserAgent, RemoteIP, a.ttl)
+}
+
+func (a *sessionAuthenticator) Authenticate(Token string) (*string, error) {
+	if err := components.CheckIfValid(Token, "ID"); err != nil {
+		if errors.Is(err, components.ErrIDNotValid) {
+			return nil, ErrMalformedToken
+		}
+		return nil, err
+	}
+
+	username, err := a.db.GetUsernameByToken(Token, a.ttl)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	} else if errors.Is(err, components.ErrSessionExpired) {
+		return nil, ErrExpiredToken
+	}
+	return username, err
+}
+
+func (a *sessionAuthenticator) RevokeToken(Token string) error {
+	if err := a.db.DeleteSession(Token); errors.Is(err, sql.ErrNoRows) {
+		return ErrInvalidToken
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *sessionAuthenticator) ListSessions(Username string, Token string) (*[]components.Session, error) {
+	return a.db.GetUserSessions(Username, Token)
+}
+
+func (a *sessionAuthenticator) RevokeSession(Username string, SessionID string) error {
+	if err := a.db.DeleteUserSession(Username, SessionID); errors.Is(err, sql.ErrNoRows) {
+		return ErrUnknownSession
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *sessionAuthenticator) RevokeOtherTokens(Username string, Token string) error {
+	return a.db.DeleteOtherSessions(Username, Token)
+}
+
+// ForgetUser does nothing: sessions follow their user through renames, with nothing cached
+func (a *sessionAuthenticator) ForgetUser(Username string) {}
@@ -0,0 +1,281 @@
+package authenticator
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// signedHeader is the header of a signed token. KeyID identifies the key the token has been signed with.
+type signedHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// signedClaims are the claims carried by a signed token. Subject is the ID of the user, Name its username and
+// Generation its token generation when the token has been issued (see database.AppDatabase.IncrementTokenGeneration).
+type signedClaims struct {
+	Subject    string `json:"sub"`
+	Name       string `json:"name"`
+	Generation int64  `json:"gen"`
+	IssuedAt   int64  `json:"iat"`
+	ExpiresAt  int64  `json:"exp"`
+}
+
+// generationTTL is how long the current username and token generation of a user are cached: revocations and renames
+// made through another instance of the server are seen within it
+const generationTTL = 30 * time.Second
+
+// maxGenerations is the number of users whose username and token generation are cached at most
+const maxGenerations = 10000
+
+// cachedGeneration is the current username and token generation of a user, as cached by signedAuthenticator
+type cachedGeneration struct {
+	username   string
+	generation int64
+	loaded     time.Time
+}
+
+type signedAuthenticator struct {
+	db           database.AppDatabase
+	keys         map[string][]byte
+	currentKeyID string
+	ttl          time.Duration
+
+	// generations caches the current username and token generation of the users, by ID, so that tokens are verified
+	// with no database lookup most of the time
+	mu          sync.Mutex
+	generations map[string]cachedGeneration
+}
+
+// NewSignedAuthenticator returns an Authenticator issuing self-contained tokens signed with HMAC-SHA256, valid for the
+// given TTL. New tokens are signed with the key identified by currentKeyID; tokens signed with any of the given keys are
+// accepted, as long as their user still exists and has not revoked them.
+func NewSignedAuthenticator(db database.AppDatabase, keys map[string][]byte, currentKeyID string, TTL time.Duration) (Authenticator, error) {
+	if db == nil {
+		return nil, errors.New("database is required")
+	}
+	if _, ok := keys[currentKeyID]; !ok {
+		return nil, fmt.Errorf("no signing key found with ID %q", currentKeyID)
+	}
+	for kid, key := range keys {
+		if len(key) < sha256.Size {
+			return nil, fmt.Errorf("signing key %q must be at least %d bytes long", kid, sha256.Size)
+		}
+	}
+	if TTL <= 0 {
+		return nil, errors.New("token TTL must be positive")
+	}
+	return &signedAuthenticator{db: db, keys: keys, currentKeyID: currentKeyID, ttl: TTL, generations: make(map[string]cachedGeneration)}, nil
+}
+
+// ParseSigningKeys parses a comma separated list of "<key ID>:<base64 encoded key>" pairs
+func ParseSigningKeys(s string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		fields := strings.SplitN(pair, ":", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			return nil, fmt.Errorf("signing key %q not in the <key ID>:<base64 key> format", pair)
+		}
+		kid := fields[0]
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("decoding signing key %q: %w", kid, err)
+		}
+		keys[kid] = key
+	}
+	return keys, nil
+}
+
+func (a *signedAuthenticator) IssueToken(Username string, UserAgent string, RemoteIP string) (*string, error) {
+	header, err := json.Marshal(signedHeader{Algorithm: "HS256", Type: "JWT", KeyID: a.currentKeyID})
+	if err != nil {
+		return nil, err
+	}
+
+	subject, err := a.db.GetTokenSubject(Username)
+	if err != nil {
+		return nil, err
+	}
+
+	now := globaltime.Now()
+	a.remember(subject, now)
+	claims, err := json.Marshal(signedClaims{
+		Subject:    subject.UserID,
+		Name:       subject.Username,
+		Generation: subject.Generation,
+		IssuedAt:   now.Unix(),
+		ExpiresAt:  now.Add(a.ttl).Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	token := payload + "." + base64.RawURLEncoding.EncodeToString(sign(a.keys[a.currentKeyID], payload))
+	return &token, nil
+}
+
+func (a *signedAuthenticator) Authenticate(Token string) (*string, error) {
+	parts := strings.Split(Token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	var header signedHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrMalformedToken
+	}
+	if header.Algorithm != "HS256" {
+		return nil, ErrInvalidToken
+	}
+
+	// Check the signature before trusting anything in the claims
+	key, ok := a.keys[header.KeyID]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	if !hmac.Equal(signature, sign(key, parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidToken
+	}
+
+	var claims signedClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrMalformedToken
+	}
+	if claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+	if globaltime.Now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+
+	// The user may have been renamed (its current username is returned), deleted or may have revoked its tokens since.
+	// A token newer than the cached generation has been issued after a revocation made elsewhere: the generation is
+	// loaded again rather than rejecting the token.
+	current, err := a.currentGeneration(claims.Subject, false)
+	if err == nil && claims.Generation > current.generation {
+		current, err = a.currentGeneration(claims.Subject, true)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+	if claims.Generation != current.generation {
+		return nil, ErrInvalidToken
+	}
+	return &current.username, nil
+}
+
+func (a *signedAuthenticator) RevokeToken(Token string) error {
+	return ErrRevocationUnsupported
+}
+
+func (a *signedAuthenticator) ListSessions(Username string, Token string) (*[]components.Session, error) {
+	return nil, ErrSessionsUnsupported
+}
+
+func (a *signedAuthenticator) RevokeSession(Username string, SessionID string) error {
+	return ErrRevocationUnsupported
+}
+
+// RevokeOtherTokens revokes the given token too: signed tokens can only be revoked all at once, by moving the user to a
+// new token generation
+func (a *signedAuthenticator) RevokeOtherTokens(Username string, Token string) error {
+	if err := a.db.IncrementTokenGeneration(Username); err != nil {
+		return err
+	}
+	subject, err := a.db.GetTokenSubject(Username)
+	if err != nil {
+		return err
+	}
+	a.remember(subject, globaltime.Now())
+	return nil
+}
+
+func (a *signedAuthenticator) ForgetUser(Username string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for userID, cached := range a.generations {
+		if cached.username == Username {
+			delete(a.generations, userID)
+		}
+	}
+}
+
+// currentGeneration returns the current username and token generation of the user with the given ID, from the cache unless
+// reload is set or the cached ones are older than generationTTL. Returns sql.ErrNoRows if the user does not exist.
+func (a *signedAuthenticator) currentGeneration(UserID string, reload bool) (*cachedGeneration, error) {
+	now := globaltime.Now()
+	if !reload {
+		a.mu.Lock()
+		cached, ok := a.generations[UserID]
+		a.mu.Unlock()
+		if ok && now.Sub(cached.loaded) < generationTTL {
+			return &cached, nil
+		}
+	}
+
+	subject, err := a.db.GetTokenSubjectByUserID(UserID)
+	if err != nil {
+		return nil, err
+	}
+	return a.remember(subject, now), nil
+}
+
+// remember caches the current username and token generation of the user. Once the cache is full, the entries past
+// generationTTL are dropped, or all of them if none is.
+func (a *signedAuthenticator) remember(subject *components.TokenSubject, now time.Time) *cachedGeneration {
+	cached := cachedGeneration{username: subject.Username, generation: subject.Generation, loaded: now}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.generations[subject.UserID]; !ok && len(a.generations) >= maxGenerations {
+		for userID, old := range a.generations {
+			if now.Sub(old.loaded) >= generationTTL {
+				delete(a.generations, userID)
+			}
+		}
+		if len(a.generations) >= maxGenerations {
+			a.generations = make(map[string]cachedGeneration)
+		}
+	}
+	a.generations[subject.UserID] = cached
+	return &cached
+}
+
+// sign returns the HMAC-SHA256 of the payload with the given key
+func sign(key []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token into v
+func decodeSegment(segment string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
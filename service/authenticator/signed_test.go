@@ -0,0 +1,327 @@
+package authenticator
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/database"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// fakeUsers implements the queries of database.AppDatabase used by the signed authenticator, counting the lookups.
+// Any other query panics.
+type fakeUsers struct {
+	database.AppDatabase
+
+	mu      sync.Mutex
+	users   map[string]*components.TokenSubject // By ID
+	lookups int
+}
+
+func newFakeUsers(usernames ...string) *fakeUsers {
+	f := &fakeUsers{users: make(map[string]*components.TokenSubject)}
+	for i, username := range usernames {
+		id := "id-" + string(rune('a'+i))
+		f.users[id] = &components.TokenSubject{UserID: id, Username: username}
+	}
+	return f
+}
+
+func (f *fakeUsers) byUsername(Username string) *components.TokenSubject {
+	for _, subject := range f.users {
+		if subject.Username == Username {
+			return subject
+		}
+	}
+	return nil
+}
+
+func (f *fakeUsers) GetTokenSubject(Username string) (*components.TokenSubject, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lookups++
+	subject := f.byUsername(Username)
+	if subject == nil {
+		return nil, sql.ErrNoRows
+	}
+	copied := *subject
+	return &copied, nil
+}
+
+func (f *fakeUsers) GetTokenSubjectByUserID(UserID string) (*components.TokenSubject, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lookups++
+	subject, ok := f.users[UserID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	copied := *subject
+	return &copied, nil
+}
+
+func (f *fakeUsers) IncrementTokenGeneration(Username string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if subject := f.byUsername(Username); subject != nil {
+		subject.Generation++
+	}
+	return nil
+}
+
+func (f *fakeUsers) rename(OldUsername string, NewUsername string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.byUsername(OldUsername).Username = NewUsername
+}
+
+func (f *fakeUsers) lookupCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lookups
+}
+
+var (
+	testKey1 = []byte("0123456789abcdef0123456789abcdef")
+	testKey2 = []byte("fedcba9876543210fedcba9876543210")
+)
+
+func newTestSigned(t *testing.T, db database.AppDatabase, keys map[string][]byte, currentKeyID string) Authenticator {
+	t.Helper()
+	auth, err := NewSignedAuthenticator(db, keys, currentKeyID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return auth
+}
+
+func issue(t *testing.T, auth Authenticator, username string) string {
+	t.Helper()
+	token, err := auth.IssueToken(username, "test", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *token
+}
+
+// resign re-encodes a segment of the token, changed by edit, keeping its signature
+func resign(t *testing.T, token string, segment int, edit func(map[string]interface{})) string {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	raw, err := base64.RawURLEncoding.DecodeString(parts[segment])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal(raw, &fields); err != nil {
+		t.Fatal(err)
+	}
+	edit(fields)
+	if raw, err = json.Marshal(fields); err != nil {
+		t.Fatal(err)
+	}
+	parts[segment] = base64.RawURLEncoding.EncodeToString(raw)
+	return strings.Join(parts, ".")
+}
+
+func TestSignedRoundTrip(t *testing.T) {
+	db := newFakeUsers("alice_user")
+	auth := newTestSigned(t, db, map[string][]byte{"k1": testKey1}, "k1")
+	token := issue(t, auth, "alice_user")
+
+	var claims signedClaims
+	if err := decodeSegment(strings.Split(token, ".")[1], &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "id-a" || claims.Name != "alice_user" || claims.Generation != 0 {
+		t.Errorf("claims = %+v, want the ID, the username and the generation of the user", claims)
+	}
+
+	lookups := db.lookupCount()
+	for i := 0; i < 10; i++ {
+		username, err := auth.Authenticate(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *username != "alice_user" {
+			t.Errorf("username = %s, want alice_user", *username)
+		}
+	}
+	if n := db.lookupCount() - lookups; n != 0 {
+		t.Errorf("%d database lookups to authenticate, want none", n)
+	}
+}
+
+func TestSignedRejects(t *testing.T) {
+	db := newFakeUsers("alice_user", "bob_user")
+	auth := newTestSigned(t, db, map[string][]byte{"k1": testKey1}, "k1")
+	token := issue(t, auth, "alice_user")
+	parts := strings.Split(token, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"not a token", "abc", ErrMalformedToken},
+		{"header not JSON", "!!." + parts[1] + "." + parts[2], ErrMalformedToken},
+		{"signature not base64", parts[0] + "." + parts[1] + ".!!", ErrMalformedToken},
+		{"other subject", resign(t, token, 1, func(c map[string]interface{}) { c["sub"] = "id-b" }), ErrInvalidToken},
+		{"later expiry", resign(t, token, 1, func(c map[string]interface{}) { c["exp"] = c["exp"].(float64) + 3600 }), ErrInvalidToken},
+		{"no algorithm", resign(t, token, 0, func(h map[string]interface{}) { h["alg"] = "none" }), ErrInvalidToken},
+		{"unknown key", resign(t, token, 0, func(h map[string]interface{}) { h["kid"] = "k9" }), ErrInvalidToken},
+		{"no signature", parts[0] + "." + parts[1] + ".", ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		if _, err := auth.Authenticate(tt.token); !errors.Is(err, tt.err) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestSignedExpiry(t *testing.T) {
+	globaltime.FixedTime = time.Unix(1700000000, 0)
+	defer func() { globaltime.FixedTime = time.Time{} }()
+
+	auth := newTestSigned(t, newFakeUsers("alice_user"), map[string][]byte{"k1": testKey1}, "k1")
+	token := issue(t, auth, "alice_user")
+
+	globaltime.FixedTime = globaltime.FixedTime.Add(time.Hour - time.Second)
+	if _, err := auth.Authenticate(token); err != nil {
+		t.Errorf("token rejected before its expiry: %v", err)
+	}
+	globaltime.FixedTime = globaltime.FixedTime.Add(time.Second)
+	if _, err := auth.Authenticate(token); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("error = %v, want %v", err, ErrExpiredToken)
+	}
+}
+
+func TestSignedKeyRotation(t *testing.T) {
+	db := newFakeUsers("alice_user")
+	old := newTestSigned(t, db, map[string][]byte{"k1": testKey1}, "k1")
+	oldToken := issue(t, old, "alice_user")
+
+	// The new key signs the new tokens, the old one still verifies the tokens signed before
+	rotated := newTestSigned(t, db, map[string][]byte{"k1": testKey1, "k2": testKey2}, "k2")
+	newToken := issue(t, rotated, "alice_user")
+	var header signedHeader
+	if err := decodeSegment(strings.Split(newToken, ".")[0], &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.KeyID != "k2" {
+		t.Errorf("kid = %s, want k2", header.KeyID)
+	}
+	for _, token := range []string{oldToken, newToken} {
+		if _, err := rotated.Authenticate(token); err != nil {
+			t.Errorf("token rejected during the rotation: %v", err)
+		}
+	}
+	if _, err := old.Authenticate(newToken); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("token signed with an unknown key: error = %v, want %v", err, ErrInvalidToken)
+	}
+
+	// Once the old key is dropped, the tokens it signed are not valid anymore
+	retired := newTestSigned(t, db, map[string][]byte{"k2": testKey2}, "k2")
+	if _, err := retired.Authenticate(oldToken); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("token signed with a retired key: error = %v, want %v", err, ErrInvalidToken)
+	}
+	if _, err := retired.Authenticate(newToken); err != nil {
+		t.Errorf("token rejected after the rotation: %v", err)
+	}
+
+	// The same key ID with another key does not verify the tokens signed before
+	replaced := newTestSigned(t, db, map[string][]byte{"k1": testKey2}, "k1")
+	if _, err := replaced.Authenticate(oldToken); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("token signed with a replaced key: error = %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestSignedRevocation(t *testing.T) {
+	globaltime.FixedTime = time.Unix(1700000000, 0)
+	defer func() { globaltime.FixedTime = time.Time{} }()
+
+	// Two instances of the server, sharing the database
+	db := newFakeUsers("alice_user")
+	keys := map[string][]byte{"k1": testKey1}
+	here := newTestSigned(t, db, keys, "k1")
+	there := newTestSigned(t, db, keys, "k1")
+
+	token := issue(t, here, "alice_user")
+	if _, err := there.Authenticate(token); err != nil {
+		t.Fatal(err)
+	}
+	if err := here.RevokeOtherTokens("alice_user", token); err != nil {
+		t.Fatal(err)
+	}
+
+	// The instance revoking the tokens rejects them at once, the other one within generationTTL
+	if _, err := here.Authenticate(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("revoked token: error = %v, want %v", err, ErrInvalidToken)
+	}
+	if _, err := there.Authenticate(token); err != nil {
+		t.Errorf("revoked token rejected before the cache expired: %v", err)
+	}
+	globaltime.FixedTime = globaltime.FixedTime.Add(generationTTL)
+	if _, err := there.Authenticate(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("revoked token after the cache expired: error = %v, want %v", err, ErrInvalidToken)
+	}
+
+	// A token issued after a revocation is accepted at once, even by an instance caching the previous generation
+	stale := newTestSigned(t, db, keys, "k1")
+	if _, err := stale.Authenticate(issue(t, stale, "alice_user")); err != nil {
+		t.Fatal(err)
+	}
+	if err := here.RevokeOtherTokens("alice_user", token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stale.Authenticate(issue(t, here, "alice_user")); err != nil {
+		t.Errorf("token newer than the cached generation rejected: %v", err)
+	}
+}
+
+func TestSignedRename(t *testing.T) {
+	db := newFakeUsers("alice_user")
+	auth := newTestSigned(t, db, map[string][]byte{"k1": testKey1}, "k1")
+	token := issue(t, auth, "alice_user")
+
+	db.rename("alice_user", "alice_renamed")
+	auth.ForgetUser("alice_user")
+	username, err := auth.Authenticate(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *username != "alice_renamed" {
+		t.Errorf("username = %s, want alice_renamed", *username)
+	}
+}
+
+func TestParseSigningKeys(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString(testKey1)
+	keys, err := ParseSigningKeys(" k1:" + encoded + ", k2:" + base64.StdEncoding.EncodeToString(testKey2) + ",")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || string(keys["k1"]) != string(testKey1) || string(keys["k2"]) != string(testKey2) {
+		t.Errorf("keys = %v", keys)
+	}
+
+	for _, s := range []string{"k1", ":" + encoded, "k1:not base64!"} {
+		if _, err := ParseSigningKeys(s); err == nil {
+			t.Errorf("ParseSigningKeys(%q) succeeded", s)
+		}
+	}
+
+	if _, err := NewSignedAuthenticator(newFakeUsers(), map[string][]byte{"k1": []byte("short")}, "k1", time.Hour); err == nil {
+		t.Error("key shorter than 32 bytes accepted")
+	}
+	if _, err := NewSignedAuthenticator(newFakeUsers(), map[string][]byte{"k1": testKey1}, "k2", time.Hour); err == nil {
+		t.Error("current key ID not among the keys accepted")
+	}
+}
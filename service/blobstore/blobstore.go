@@ -0,0 +1,114 @@
+/*
+Package blobstore stores the photos (and any other binary content) the API serves.
+
+Blobs are identified by keys shaped like slash-separated relative paths (e.g., "posts/1.png"). Three implementations of
+BlobStore are available:
+
+  - NewFilesystem stores each blob as a file under a root directory.
+  - NewMemory keeps the blobs in memory: they are lost when the process exits, which makes it handy for tests.
+  - NewS3 stores the blobs as the objects of a bucket of an S3-compatible service (AWS S3, MinIO, ...), using
+    path-style requests signed with AWS Signature Version 4.
+
+Blobs can also be stored content-addressed, under the key DigestKey returns for the SHA-256 digest of their content:
+identical content is then stored once, whoever stores it.
+*/
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// BlobStore stores blobs by key
+type BlobStore interface {
+	// Get returns the content of the blob with the given key. Returns ErrNotFound if there is no such blob.
+	Get(Key string) ([]byte, error)
+
+	// Open opens the blob with the given key for reading, without loading it in memory. Returns ErrNotFound if there is
+	// no such blob. The blob must be closed.
+	Open(Key string) (Blob, error)
+
+	// Put creates the blob with the given key, replacing it if it already exists
+	Put(Key string, Data []byte) error
+
+	// Delete removes the blob with the given key. Deleting a blob that does not exist is not an error.
+	Delete(Key string) error
+
+	// Exists reports whether the blob with the given key exists
+	Exists(Key string) (bool, error)
+
+	// List returns the blobs whose key starts with the given prefix (all of them if the prefix is empty), in no
+	// particular order
+	List(Prefix string) ([]BlobInfo, error)
+}
+
+// BlobInfo describes a stored blob, as listed by BlobStore.List
+type BlobInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Blob is a blob opened for reading, in any order (e.g., to serve byte ranges of it)
+type Blob interface {
+	io.ReadSeekCloser
+
+	// Size returns the size of the blob, in bytes
+	Size() int64
+
+	// ModTime returns when the blob was last put
+	ModTime() time.Time
+}
+
+// ErrNotFound is returned when the requested blob does not exist
+var ErrNotFound = errors.New("blob not found")
+
+// ErrInvalidKey is returned when the key is not a valid slash-separated relative path (e.g., it contains "..")
+var ErrInvalidKey = errors.New("invalid blob key")
+
+// Copy copies the blob with the key src to the key dst
+func Copy(s BlobStore, src string, dst string) error {
+	data, err := s.Get(src)
+	if err != nil {
+		return err
+	}
+	return s.Put(dst, data)
+}
+
+// Move moves the blob with the key src to the key dst
+func Move(s BlobStore, src string, dst string) error {
+	if src == dst {
+		return nil
+	}
+	if err := Copy(s, src, dst); err != nil {
+		return err
+	}
+	return s.Delete(src)
+}
+
+// Digest returns the SHA-256 digest of the data, hex-encoded
+func Digest(Data []byte) string {
+	sum := sha256.Sum256(Data)
+	return hex.EncodeToString(sum[:])
+}
+
+// DigestKey returns the key the blob with the given digest is stored under when stored content-addressed. Blobs are
+// spread across directories by the first two characters of the digest (e.g., "sha256/9f/9f86d081...").
+func DigestKey(Digest string) string {
+	if len(Digest) < 2 {
+		return "sha256/" + Digest
+	}
+	return "sha256/" + Digest[:2] + "/" + Digest
+}
+
+// checkKey returns ErrInvalidKey if the key cannot be used
+func checkKey(Key string) error {
+	if Key == "." || !fs.ValidPath(Key) {
+		return ErrInvalidKey
+	}
+	return nil
+}
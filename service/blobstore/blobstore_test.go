@@ -0,0 +1,331 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// s3StandIn is a minimal S3-compatible service, holding a single bucket in memory. It checks that requests are signed
+// for the expected credentials and that the signed payload hash matches the body, and pages listings by listPageSize
+// objects.
+type s3StandIn struct {
+	t      *testing.T
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+const listPageSize = 2
+
+func newS3StandIn(t *testing.T, bucket string) *httptest.Server {
+	s := &s3StandIn{t: t, bucket: bucket, objects: make(map[string][]byte)}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *s3StandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sum := sha256.Sum256(body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access-key/") ||
+		r.Header.Get("X-Amz-Date") == "" || r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/"+s.bucket) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+s.bucket), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		s.list(w, r)
+	case r.Method == http.MethodPut:
+		s.objects[key] = body
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := s.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, "", time.Unix(1700000000, 0), bytes.NewReader(data))
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// list answers a ListObjectsV2 request, continuing after the key in the continuation token
+func (s *s3StandIn) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	after := r.URL.Query().Get("continuation-token")
+
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) && key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	type object struct {
+		Key          string
+		Size         int64
+		LastModified string
+	}
+	var result struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []object
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}
+	if len(keys) > listPageSize {
+		keys = keys[:listPageSize]
+		result.IsTruncated = true
+		result.NextContinuationToken = keys[len(keys)-1]
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, object{
+			Key:          key,
+			Size:         int64(len(s.objects[key])),
+			LastModified: time.Unix(1700000000, 0).UTC().Format(time.RFC3339),
+		})
+	}
+	if err := xml.NewEncoder(w).Encode(result); err != nil {
+		s.t.Error(err)
+	}
+}
+
+// stores returns an empty store of each implementation
+func stores(t *testing.T) map[string]BlobStore {
+	filesystem, err := NewFilesystem(filepath.Join(t.TempDir(), "photos"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newS3StandIn(t, "photos")
+	s3, err := NewS3(S3Config{Endpoint: server.URL, Bucket: "photos", AccessKeyID: "access-key", SecretAccessKey: "secret-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]BlobStore{"memory": NewMemory(), "filesystem": filesystem, "s3": s3}
+}
+
+func TestPutGet(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range []string{"posts/1.png", "posts/a b+c.png", DigestKey(Digest([]byte("photo")))} {
+				if err := s.Put(key, []byte("first")); err != nil {
+					t.Fatalf("Put(%q): %v", key, err)
+				}
+				if err := s.Put(key, []byte("second")); err != nil {
+					t.Fatalf("Put(%q) again: %v", key, err)
+				}
+				data, err := s.Get(key)
+				if err != nil || string(data) != "second" {
+					t.Errorf("Get(%q) = %q, %v; want %q", key, data, err, "second")
+				}
+			}
+			if _, err := s.Get("posts/missing.png"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get of a missing blob: err = %v, want %v", err, ErrNotFound)
+			}
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	content := "0123456789abcdef"
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := s.Put("posts/1.png", []byte(content)); err != nil {
+				t.Fatal(err)
+			}
+			blob, err := s.Open("posts/1.png")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer blob.Close()
+
+			if blob.Size() != int64(len(content)) {
+				t.Errorf("Size() = %d, want %d", blob.Size(), len(content))
+			}
+			if blob.ModTime().IsZero() {
+				t.Error("ModTime() is zero")
+			}
+
+			buf := make([]byte, 4)
+			if _, err = blob.Seek(10, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			if _, err = io.ReadFull(blob, buf); err != nil || string(buf) != content[10:14] {
+				t.Errorf("read at 10 = %q, %v; want %q", buf, err, content[10:14])
+			}
+			if _, err = blob.Seek(-2, io.SeekEnd); err != nil {
+				t.Fatal(err)
+			}
+			if rest, err := io.ReadAll(blob); err != nil || string(rest) != content[14:] {
+				t.Errorf("read of the tail = %q, %v; want %q", rest, err, content[14:])
+			}
+			if _, err = blob.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			if all, err := io.ReadAll(blob); err != nil || string(all) != content {
+				t.Errorf("read from the start = %q, %v; want %q", all, err, content)
+			}
+
+			if _, err = s.Open("posts/missing.png"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Open of a missing blob: err = %v, want %v", err, ErrNotFound)
+			}
+		})
+	}
+}
+
+func TestDeleteExists(t *testing.T) {
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := s.Put("posts/1.png", []byte("photo")); err != nil {
+				t.Fatal(err)
+			}
+			if ok, err := s.Exists("posts/1.png"); err != nil || !ok {
+				t.Errorf("Exists of a stored blob = %v, %v", ok, err)
+			}
+			if err := s.Delete("posts/1.png"); err != nil {
+				t.Fatal(err)
+			}
+			if ok, err := s.Exists("posts/1.png"); err != nil || ok {
+				t.Errorf("Exists of a deleted blob = %v, %v", ok, err)
+			}
+			if _, err := s.Get("posts/1.png"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get of a deleted blob: err = %v, want %v", err, ErrNotFound)
+			}
+			if err := s.Delete("posts/1.png"); err != nil {
+				t.Errorf("Delete of a missing blob: %v", err)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	blobs := map[string]string{
+		"posts/1.png":          "a",
+		"posts/2.jpg":          "bb",
+		"posts/3.gif":          "ccc",
+		"posts/4.webp":         "dddd",
+		"profile_pics/bob.png": "eeeee",
+	}
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			for key, data := range blobs {
+				if err := s.Put(key, []byte(data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, prefix := range []string{"", "posts/", "profile_pics/", "missing/"} {
+				listed, err := s.List(prefix)
+				if err != nil {
+					t.Fatalf("List(%q): %v", prefix, err)
+				}
+				got := make(map[string]int64)
+				for _, info := range listed {
+					got[info.Key] = info.Size
+				}
+				want := make(map[string]int64)
+				for key, data := range blobs {
+					if strings.HasPrefix(key, prefix) {
+						want[key] = int64(len(data))
+					}
+				}
+				if len(got) != len(listed) || len(got) != len(want) {
+					t.Errorf("List(%q) = %v, want %v", prefix, listed, want)
+					continue
+				}
+				for key, size := range want {
+					if got[key] != size {
+						t.Errorf("List(%q): %q has size %d, want %d", prefix, key, got[key], size)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestInvalidKey(t *testing.T) {
+	keys := []string{"", ".", "..", "../posts/1.png", "posts/../1.png", "/posts/1.png", "posts/", "posts//1.png"}
+	for name, s := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, key := range keys {
+				if _, err := s.Get(key); !errors.Is(err, ErrInvalidKey) {
+					t.Errorf("Get(%q): err = %v", key, err)
+				}
+				if _, err := s.Open(key); !errors.Is(err, ErrInvalidKey) {
+					t.Errorf("Open(%q): err = %v", key, err)
+				}
+				if err := s.Put(key, []byte("photo")); !errors.Is(err, ErrInvalidKey) {
+					t.Errorf("Put(%q): err = %v", key, err)
+				}
+				if err := s.Delete(key); !errors.Is(err, ErrInvalidKey) {
+					t.Errorf("Delete(%q): err = %v", key, err)
+				}
+				if _, err := s.Exists(key); !errors.Is(err, ErrInvalidKey) {
+					t.Errorf("Exists(%q): err = %v", key, err)
+				}
+			}
+		})
+	}
+}
+
+func TestFilesystemPut(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewFilesystem(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put("posts/1.png", []byte("photo")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(root, "posts", "1.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o644 {
+		t.Errorf("mode = %v, want %v", info.Mode().Perm(), os.FileMode(0o644))
+	}
+
+	// Leftovers of interrupted puts are not blobs
+	if err = os.WriteFile(filepath.Join(root, "posts", ".blob-"+strconv.Itoa(os.Getpid())), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	listed, err := s.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 || listed[0].Key != "posts/1.png" {
+		t.Errorf("List() = %v, want only posts/1.png", listed)
+	}
+}
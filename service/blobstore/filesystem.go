@@ -0,0 +1,168 @@
+package blobstore
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// tempPattern is the name of the temporary files blobs are written to before being renamed, which List skips
+const tempPattern = ".blob-*"
+
+type filesystemStore struct {
+	root string
+}
+
+// NewFilesystem returns a BlobStore keeping each blob in a file under the given root directory, which is created if
+// missing
+func NewFilesystem(Root string) (BlobStore, error) {
+	if Root == "" {
+		return nil, errors.New("root directory is required")
+	}
+	if err := os.MkdirAll(Root, 0o755); err != nil {
+		return nil, err
+	}
+	return &filesystemStore{root: Root}, nil
+}
+
+// path returns the path of the file of the blob with the given key
+func (s *filesystemStore) path(Key string) (string, error) {
+	if err := checkKey(Key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, filepath.FromSlash(Key)), nil
+}
+
+func (s *filesystemStore) Get(Key string) ([]byte, error) {
+	path, err := s.path(Key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s *filesystemStore) Open(Key string) (Blob, error) {
+	path, err := s.path(Key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return fileBlob{File: f, info: info}, nil
+}
+
+func (s *filesystemStore) Put(Key string, Data []byte) error {
+	path, err := s.path(Key)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// Write a temporary file first, so that readers never see a partially written blob
+	tmp, err := os.CreateTemp(filepath.Dir(path), tempPattern)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err = tmp.Write(Data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	// Temporary files are created readable by their owner only
+	if err = os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *filesystemStore) Delete(Key string) error {
+	path, err := s.path(Key)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *filesystemStore) Exists(Key string) (bool, error) {
+	path, err := s.path(Key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *filesystemStore) List(Prefix string) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	err := filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if temp, _ := filepath.Match(tempPattern, d.Name()); temp {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, Prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// Deleted while walking
+			return nil
+		} else if err != nil {
+			return err
+		}
+		blobs = append(blobs, BlobInfo{Key: key, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return blobs, err
+}
+
+// fileBlob is a blob opened from its file
+type fileBlob struct {
+	*os.File
+	info fs.FileInfo
+}
+
+func (b fileBlob) Size() int64 {
+	return b.info.Size()
+}
+
+func (b fileBlob) ModTime() time.Time {
+	return b.info.ModTime()
+}
@@ -0,0 +1,108 @@
+package blobstore
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+type memoryStore struct {
+	mu    sync.RWMutex
+	blobs map[string]memoryBlob
+}
+
+type memoryBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemory returns a BlobStore keeping the blobs in memory
+func NewMemory() BlobStore {
+	return &memoryStore{blobs: make(map[string]memoryBlob)}
+}
+
+func (s *memoryStore) Get(Key string) ([]byte, error) {
+	if err := checkKey(Key); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	blob, ok := s.blobs[Key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), blob.data...), nil
+}
+
+func (s *memoryStore) Open(Key string) (Blob, error) {
+	if err := checkKey(Key); err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	blob, ok := s.blobs[Key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	// Blobs are never modified in place (Put replaces the slice), so the reader can share the data
+	return &memoryReader{Reader: bytes.NewReader(blob.data), blob: blob}, nil
+}
+
+func (s *memoryStore) Put(Key string, Data []byte) error {
+	if err := checkKey(Key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[Key] = memoryBlob{data: append([]byte(nil), Data...), modTime: globaltime.Now()}
+	return nil
+}
+
+func (s *memoryStore) Delete(Key string) error {
+	if err := checkKey(Key); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, Key)
+	return nil
+}
+
+func (s *memoryStore) Exists(Key string) (bool, error) {
+	if err := checkKey(Key); err != nil {
+		return false, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.blobs[Key]
+	return ok, nil
+}
+
+func (s *memoryStore) List(Prefix string) ([]BlobInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var blobs []BlobInfo
+	for key, blob := range s.blobs {
+		if strings.HasPrefix(key, Prefix) {
+			blobs = append(blobs, BlobInfo{Key: key, Size: int64(len(blob.data)), ModTime: blob.modTime})
+		}
+	}
+	return blobs, nil
+}
+
+// memoryReader is a blob opened from memory
+type memoryReader struct {
+	*bytes.Reader
+	blob memoryBlob
+}
+
+func (r *memoryReader) Close() error {
+	return nil
+}
+
+func (r *memoryReader) ModTime() time.Time {
+	return r.blob.modTime
+}
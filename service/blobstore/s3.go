@@ -0,0 +1,395 @@
+package blobstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// DefaultS3Timeout bounds how long the service may take to answer each request, unless a custom HTTPClient is
+// configured. Only the response headers are waited for: objects are then streamed as fast as the clients read them.
+const DefaultS3Timeout = 30 * time.Second
+
+// S3Config describes the bucket of an S3-compatible service the blobs are stored in
+type S3Config struct {
+	// Endpoint is the base URL of the service (e.g., "https://s3.eu-south-1.amazonaws.com" or "http://localhost:9000")
+	Endpoint string
+
+	// Region is the region the requests are signed for. MinIO accepts any region, by default "us-east-1".
+	Region string
+
+	// Bucket is the name of the bucket. It must already exist.
+	Bucket string
+
+	// AccessKeyID and SecretAccessKey are the credentials the requests are signed with
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// HTTPClient is used to reach the service. If nil, a client with DefaultS3Timeout is used.
+	HTTPClient *http.Client
+}
+
+type s3Store struct {
+	cfg      S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3 returns a BlobStore keeping each blob as an object of the configured bucket
+func NewS3(cfg S3Config) (BlobStore, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("endpoint is required")
+	}
+	if cfg.Bucket == "" {
+		return nil, errors.New("bucket is required")
+	}
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, errors.New("credentials are required")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing the endpoint: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("endpoint %q is not an HTTP(S) URL", cfg.Endpoint)
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ResponseHeaderTimeout = DefaultS3Timeout
+		client = &http.Client{Transport: transport}
+	}
+	return &s3Store{cfg: cfg, endpoint: endpoint, client: client}, nil
+}
+
+func (s *s3Store) Get(Key string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, Key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("getting %q from the bucket: %s", Key, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+func (s *s3Store) Open(Key string) (Blob, error) {
+	resp, err := s.do(http.MethodHead, Key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("opening %q in the bucket: %s", Key, resp.Status)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &s3Blob{store: s, key: Key, size: resp.ContentLength, modTime: modTime}, nil
+}
+
+func (s *s3Store) Put(Key string, Data []byte) error {
+	resp, err := s.do(http.MethodPut, Key, Data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("putting %q in the bucket: %s", Key, resp.Status)
+	}
+	return nil
+}
+
+func (s *s3Store) Delete(Key string) error {
+	resp, err := s.do(http.MethodDelete, Key, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Deleting a missing object succeeds on S3, but some compatible services answer 404
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("deleting %q from the bucket: %s", Key, resp.Status)
+	}
+	return nil
+}
+
+func (s *s3Store) Exists(Key string) (bool, error) {
+	resp, err := s.do(http.MethodHead, Key, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("checking %q in the bucket: %s", Key, resp.Status)
+	}
+}
+
+func (s *s3Store) List(Prefix string) ([]BlobInfo, error) {
+	var blobs []BlobInfo
+	query := url.Values{"list-type": {"2"}, "prefix": {Prefix}}
+	for {
+		req, err := s.signedRequest(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		page, err := s.listPage(req)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			blobs = append(blobs, BlobInfo{Key: object.Key, Size: object.Size, ModTime: object.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return blobs, nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+// listBucketResult is a page of the listing of the objects of a bucket (ListObjectsV2)
+type listBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// listPage sends a ListObjectsV2 request, and parses the page of the listing in the response
+func (s *s3Store) listPage(req *http.Request) (*listBucketResult, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("listing the bucket: %s", resp.Status)
+	}
+	var page listBucketResult
+	if err = xml.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, fmt.Errorf("parsing the listing of the bucket: %w", err)
+	}
+	return &page, nil
+}
+
+// do sends a signed request for the object with the given key
+func (s *s3Store) do(method string, Key string, body []byte) (*http.Response, error) {
+	req, err := s.request(method, Key, body)
+	if err != nil {
+		return nil, err
+	}
+	return s.client.Do(req)
+}
+
+// request returns a signed request for the object with the given key
+func (s *s3Store) request(method string, Key string, body []byte) (*http.Request, error) {
+	if err := checkKey(Key); err != nil {
+		return nil, err
+	}
+	return s.signedRequest(method, "/"+Key, nil, body)
+}
+
+// signedRequest returns a signed request for the given path in the bucket (empty for the bucket itself), with the
+// given query
+func (s *s3Store) signedRequest(method string, path string, query url.Values, body []byte) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = s.endpoint.Path + "/" + s.cfg.Bucket + path
+	u.RawPath = s.endpoint.Path + "/" + uriEncode(s.cfg.Bucket) + uriEncode(path)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	s.sign(req, u.RawPath, u.RawQuery, body)
+	return req, nil
+}
+
+// sign adds to the request the headers of AWS Signature Version 4
+func (s *s3Store) sign(req *http.Request, canonicalURI string, canonicalQueryString string, body []byte) {
+	now := globaltime.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI,
+		canonicalQueryString,
+		"host:" + req.URL.Host + "\n" + "x-amz-content-sha256:" + payloadHash + "\n" + "x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + s.cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + s.cfg.SecretAccessKey)
+	for _, part := range []string{day, s.cfg.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.cfg.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// uriEncode percent-encodes everything but the unreserved characters and the slashes, as Signature Version 4 requires
+func uriEncode(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes the query as Signature Version 4 requires: sorted by name, with the slashes percent-encoded too
+func canonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var params []string
+	for _, name := range names {
+		for _, value := range query[name] {
+			params = append(params, queryEncode(name)+"="+queryEncode(value))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// queryEncode percent-encodes everything but the unreserved characters
+func queryEncode(s string) string {
+	return strings.ReplaceAll(uriEncode(s), "/", "%2F")
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Blob is an object opened for reading. The object is downloaded only as it is read, from the current offset on: each
+// seek to another offset starts another download (a ranged GET).
+type s3Blob struct {
+	store   *s3Store
+	key     string
+	size    int64
+	modTime time.Time
+
+	offset int64
+	body   io.ReadCloser
+}
+
+func (b *s3Blob) Read(p []byte) (int, error) {
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+	if b.body == nil {
+		req, err := b.store.request(http.MethodGet, b.key, nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(b.offset, 10)+"-")
+		resp, err := b.store.client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		// Services ignoring the range answer with the whole object, which is fine only when reading from the start
+		if resp.StatusCode != http.StatusPartialContent && (resp.StatusCode != http.StatusOK || b.offset != 0) {
+			_ = resp.Body.Close()
+			return 0, fmt.Errorf("getting %q from the bucket: %s", b.key, resp.Status)
+		}
+		b.body = resp.Body
+	}
+
+	n, err := b.body.Read(p)
+	b.offset += int64(n)
+	return n, err
+}
+
+func (b *s3Blob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seeking before the start of the blob")
+	}
+	if offset != b.offset && b.body != nil {
+		_ = b.body.Close()
+		b.body = nil
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+func (b *s3Blob) Close() error {
+	if b.body == nil {
+		return nil
+	}
+	err := b.body.Close()
+	b.body = nil
+	return err
+}
+
+func (b *s3Blob) Size() int64 {
+	return b.size
+}
+
+func (b *s3Blob) ModTime() time.Time {
+	return b.modTime
+}
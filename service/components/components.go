@@ -7,11 +7,19 @@ import (
 )
 
 type User struct {
-	ID         string
-	Username   string
-	Birthdate  string
-	Name       string
-	ProfilePic string // Base64 encoded image
+	ID                    string
+	Username              string
+	Birthdate             string
+	Name                  string
+	ProfilePic            string // Base64 encoded image
+	ProfilePicPlaceholder Placeholder
+}
+
+// What clients can show while loading a photo. Both fields are empty if the placeholder of the photo is unknown (e.g.,
+// for the default profile pic, or until the photos stored before placeholders were computed are backfilled).
+type Placeholder struct {
+	BlurHash string // Blurred preview of the photo, encoded as a BlurHash
+	Color    string // Dominant color of the photo, as "#rrggbb"
 }
 
 type Profile struct {
@@ -20,16 +28,76 @@ type Profile struct {
 	Followings []User
 	Followers  []User
 	Banned     []User
+	Storage    *StorageUsage // Only in the profile of the authenticated user, null otherwise
+}
+
+// Bytes stored for a user, by the images of their posts and their profile pic
+type StorageUsage struct {
+	UsedBytes  int64
+	QuotaBytes int64 // Zero if the user has no quota
 }
 
 type Post struct {
 	PostID           string
 	Author           string
 	Photo            string // URL path to the image, stored server-side
+	MIMEType         string // Format of the image, detected at upload
+	Digest           string // SHA-256 digest of the image, hex-encoded: identical images have the same digest
 	CreationDatetime string
 	Description      string
 	Likes            []User
 	Comments         []Comment
+	Renditions       []Rendition       // Smaller copies of the photo, narrowest first
+	EXIF             map[string]string // EXIF tags kept from the photo (e.g., DateTimeOriginal), by name
+	Media            []Media           // Images of the post, in order: the first one is also the photo above
+	PHash            string            // Perceptual hash of the photo, hex-encoded: similar images have close hashes
+	Placeholder      Placeholder
+}
+
+// One of the images of a post
+type Media struct {
+	Photo       string // URL path to the image, stored server-side
+	MIMEType    string
+	Digest      string
+	Width       int
+	Height      int
+	Size        int64 // In bytes
+	Renditions  []Rendition
+	EXIF        map[string]string
+	PHash       string
+	Placeholder Placeholder
+}
+
+// Post similar to another one, with the smallest Hamming distance between the perceptual hashes of their images
+type SimilarPost struct {
+	Post
+	Distance int
+}
+
+type Rendition struct {
+	Width  int
+	Height int
+	Photo  string // URL of the rendition
+}
+
+type Credentials struct {
+	Username string
+	Password string
+	Code     string // TOTP or recovery code, required only if the user enabled two-factor authentication
+}
+
+type TOTPEnrollment struct {
+	Secret string // Base32 encoded
+	URI    string // otpauth:// URI, to be shown as a QR code
+}
+
+type SecondFactor struct {
+	Code string // TOTP or recovery code
+}
+
+type PasswordChange struct {
+	OldPassword string // Empty if the user has no password yet
+	NewPassword string
 }
 
 type Comment struct {
@@ -40,6 +108,69 @@ type Comment struct {
 	Author           string
 }
 
+type Session struct {
+	SessionID string
+	UserAgent string
+	RemoteIP  string
+	IssuedAt  string
+	LastUsed  string
+	ExpiresAt string
+	Current   bool // Whether this is the session used to make the request
+}
+
+// User a signed token has been issued to. Its ID never changes (unlike its username), and its generation is increased to
+// invalidate every token issued before. Not exposed by the API.
+type TokenSubject struct {
+	UserID     string
+	Username   string // Current username of the user
+	Generation int64
+}
+
+type APIKey struct {
+	KeyID            string
+	Name             string
+	Scopes           []string
+	CreationDatetime string
+	ExpiresAt        string // Empty if the key never expires
+	LastUsed         string // Empty if the key has never been used
+	Key              string // Returned only once, when the key is created: only its hash is stored
+}
+
+// Pending OpenID Connect login, between the redirect to the provider and the callback. Not exposed by the API.
+type OIDCLogin struct {
+	State    string
+	Verifier string // PKCE code verifier
+	Nonce    string
+}
+
+// Resumable upload of a photo, sent in chunks. Once complete, it can be posted in place of a photo sent in a form.
+type Upload struct {
+	UploadID  string
+	Size      int64  // Size of the whole photo, in bytes
+	Digest    string // SHA-256 digest of the whole photo, hex-encoded, checked when the upload is posted
+	Offset    int64  // Bytes received so far: the next chunk starts there
+	ExpiresAt string // The upload is deleted if no chunk is received until then
+}
+
+// Post of photos sent as resumable uploads
+type UploadedPost struct {
+	Uploads     []string // IDs of the complete uploads, in order
+	Description string
+}
+
+// Perceptual hash of an image of a post. Not exposed by the API.
+type PhotoHash struct {
+	PostID string
+	PHash  string
+}
+
+// Reference from the database to a photo in the store, by an image of a post or a profile pic. Not exposed by the API.
+type PhotoReference struct {
+	PhotoPath string
+	Digest    string // Empty if the photo is not stored by digest yet, but at PhotoPath
+	Owner     string
+}
+
 type Error struct {
 	ErrorCode   int
 	Description string
@@ -53,12 +184,24 @@ func CheckIfValid(content string, contentType string) error {
 	if contentType == "ID" {
 		REGEXP = ID_REGEXP
 		regexpErr = ErrIDNotValid
+	} else if contentType == "PostID" {
+		REGEXP = POST_ID_REGEXP
+		regexpErr = ErrPostIDNotValid
 	} else if contentType == "Username" {
 		REGEXP = USERNAME_REGEXP
 		regexpErr = ErrUsernameNotValid
 	} else if contentType == "Comment" {
 		REGEXP = COMMENT_REGEXP
 		regexpErr = ErrCommentNotValid
+	} else if contentType == "APIKeyName" {
+		REGEXP = APIKEY_NAME_REGEXP
+		regexpErr = ErrAPIKeyNameNotValid
+	} else if contentType == "Password" {
+		REGEXP = PASSWORD_REGEXP
+		regexpErr = ErrPasswordNotValid
+	} else if contentType == "Digest" {
+		REGEXP = DIGEST_REGEXP
+		regexpErr = ErrDigestNotValid
 	} else if contentType == "Datetime" {
 		REGEXP = DATETIME_REGEXP
 		regexpErr = ErrDatetimeNotValid
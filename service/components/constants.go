@@ -4,20 +4,69 @@ import "fmt"
 
 const USERNAME_REGEXP = "^[a-zA-Z0-9_-]{8,16}$"
 const ID_REGEXP = "^[a-zA-Z0-9]{64}$"
+const POST_ID_REGEXP = "^[0-9]{1,18}$"
 const DATETIME_REGEXP = "^([0-9]{4})-(0[1-9]|1[0-2])-(0[1-9]|[12][0-9]|3[01]) (0[0-9]|1[0-9]|2[0-3]):([0-5][0-9]):([0-5][0-9])$"
 const DATE_REGEXP = "^([0-9]{4})-(0[1-9]|1[0-2])-(0[1-9]|[1-2][0-9]|3[01])$"
+const PASSWORD_REGEXP = "^[\\x21-\\x7E]{8,64}$"
+const APIKEY_NAME_REGEXP = "^[a-zA-Z0-9 _.-]{1,64}$"
+const DIGEST_REGEXP = "^[0-9a-f]{64}$"
 const COMMENT_REGEXP = "^[a-zA-ZÀ-ÿ0-9.,!?@#%^&*()_+-=:;'\"<>/[\\]{}`~\\s]{1,128}$"
 
+// API keys are told apart from session tokens by this prefix
+const APIKeyPrefix = "wpk_"
+
+// Scopes an API key can be granted: each route accessible with API keys requires one of them
+const ScopeReadProfile = "read:profile"
+const ScopeReadStream = "read:stream"
+const ScopeWritePosts = "write:posts"
+const ScopeWriteSocial = "write:social"
+
+var Scopes = []string{ScopeReadProfile, ScopeReadStream, ScopeWritePosts, ScopeWriteSocial}
+
+// Formats of the photos that can be uploaded, by MIME type, with the extension of the files they are stored in
+var PhotoExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/webp": ".webp",
+	"image/gif":  ".gif",
+}
+
 const StatusInternalServerError = "{\"ErrorCode\": 500, \"Description\": \"Internal Server Error: %s\"}"
 const StatusBadRequest = "{\"ErrorCode\": 400, \"Description\": \"Bad Request: %s\"}"
 const StatusUnauthorized = "{\"ErrorCode\": 401, \"Description\": \"Unauthorized: %s\"}"
 const StatusForbidden = "{\"ErrorCode\": 403, \"Description\": \"Forbidden: %s\"}"
 const StatusNotFound = "{\"ErrorCode\": 404, \"Description\": \"Resource Not Found: %s\"}"
 const StatusNotAcceptable = "{\"ErrorCode\": 406, \"Description\": \"Not Acceptable: %s\"}"
+const StatusConflict = "{\"ErrorCode\": 409, \"Description\": \"Conflict: %s\"}"
+const StatusRequestEntityTooLarge = "{\"ErrorCode\": 413, \"Description\": \"Request Entity Too Large: %s\"}"
+const StatusTooManyRequests = "{\"ErrorCode\": 429, \"Description\": \"Too Many Requests: %s\"}"
+const StatusNotImplemented = "{\"ErrorCode\": 501, \"Description\": \"Not Implemented: %s\"}"
+const StatusInsufficientStorage = "{\"ErrorCode\": 507, \"Description\": \"Insufficient Storage: %s\"}"
 const StatusUnsupportedMediaType = "{\"ErrorCode\": 415, \"Description\": \"Unsupported media type\"}"
 
 var ErrIDNotValid = fmt.Errorf("provided ID not valid")
+var ErrPostIDNotValid = fmt.Errorf("provided post ID not valid")
 var ErrUsernameNotValid = fmt.Errorf("provided username not valid")
 var ErrCommentNotValid = fmt.Errorf("provided comment not valid")
 var ErrDatetimeNotValid = fmt.Errorf("provided datetime not valid")
 var ErrDateNotValid = fmt.Errorf("provided date not valid")
+var ErrPasswordNotValid = fmt.Errorf("provided password not valid")
+var ErrSessionExpired = fmt.Errorf("session expired")
+var ErrWrongPassword = fmt.Errorf("wrong password")
+var ErrNoPassword = fmt.Errorf("no password set")
+var ErrTOTPAlreadyEnabled = fmt.Errorf("two-factor authentication already enabled")
+var ErrTOTPNotEnabled = fmt.Errorf("two-factor authentication not enabled")
+var ErrCodeRequired = fmt.Errorf("two-factor authentication code required")
+var ErrWrongCode = fmt.Errorf("wrong two-factor authentication code")
+var ErrUsernameTaken = fmt.Errorf("username already taken")
+var ErrSSOOnly = fmt.Errorf("user signs in with single sign-on only")
+var ErrLoginExpired = fmt.Errorf("login expired")
+var ErrAPIKeyNameNotValid = fmt.Errorf("provided API key name not valid")
+var ErrScopeNotValid = fmt.Errorf("provided scope not valid")
+var ErrAPIKeyExpired = fmt.Errorf("API key expired")
+var ErrScopeMissing = fmt.Errorf("API key not granted the scope required by this operation")
+var ErrFormatNotValid = fmt.Errorf("provided image format not supported")
+var ErrNoMedia = fmt.Errorf("post with no image")
+var ErrDigestNotValid = fmt.Errorf("provided digest not valid")
+var ErrUploadOffset = fmt.Errorf("chunk not starting at the offset of the upload")
+var ErrUploadDigest = fmt.Errorf("content of the upload not matching its digest")
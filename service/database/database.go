@@ -34,6 +34,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"time"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
 )
@@ -47,10 +48,43 @@ type AppDatabase interface {
 	Ping() error
 
 	// User queries
-	GetUsernameByToken(Id string) (*string, error)
 	GetOwnerUsernameOfComment(CommentID string) (*string, error)
 	PostUserID(Username string) (*components.User, error)
+	PostUserWithPassword(Username string, Password string) (*components.User, error)
+	IsSSOUser(Username string) (bool, error)
 	UpdateUsername(NewUsername string, OldUsername string) error
+	SetUserPassword(Username string, Password string) error
+	CheckUserPassword(Username string, Password string) error
+
+	// Two-factor authentication queries
+	EnrollTOTP(Username string) (*string, error)
+	ConfirmTOTP(Username string, Code string) (*[]string, error)
+	DisableTOTP(Username string) error
+	CheckSecondFactor(Username string, Code string) error
+
+	// Session queries
+	CreateSession(Username string, UserAgent string, RemoteIP string, TTL time.Duration) (*string, error)
+	GetUsernameByToken(Token string, TTL time.Duration) (*string, error)
+	DeleteSession(Token string) error
+	GetUserSessions(Username string, Token string) (*[]components.Session, error)
+	DeleteUserSession(Username string, SessionID string) error
+	DeleteOtherSessions(Username string, Token string) error
+	GetTokenSubject(Username string) (*components.TokenSubject, error)
+	GetTokenSubjectByUserID(UserID string) (*components.TokenSubject, error)
+	IncrementTokenGeneration(Username string) error
+
+	// API key queries
+	CreateAPIKey(Username string, Name string, Scopes []string, ExpiresAt time.Time) (*components.APIKey, error)
+	GetUsernameByAPIKey(Key string, Scopes []string) (*string, error)
+	GetAPIKeyOwner(Key string) (*string, error)
+	GetUserAPIKeys(Username string) (*[]components.APIKey, error)
+	DeleteAPIKey(Username string, KeyID string) error
+
+	// OpenID Connect queries
+	CreateOIDCLogin(State string, Verifier string, Nonce string, TTL time.Duration) error
+	ConsumeOIDCLogin(State string) (*components.OIDCLogin, error)
+	GetUserByOIDCSubject(Issuer string, Subject string) (*components.User, error)
+	PostOIDCUser(Issuer string, Subject string, Username string) (*components.User, error)
 
 	// Post queries
 	CheckIfOwnerPost(Username string, PostID string) error
@@ -59,10 +93,44 @@ type AppDatabase interface {
 	AddCommentToPost(PostID string, Body string, Author string) (*components.Comment, error)
 	RemoveCommentFromPost(PostID string, CommentID string) error
 	GetUserStream(username string) (*[]components.Post, error)
-	UploadPost(username string, description string) (*components.Post, error)
-	DeletePost(postID string) (*string, error)
+	GetPost(PostID string) (*components.Post, error)
+	UploadPost(username string, description string, Media []components.Media, Uploads []string) (*components.Post, error)
+	GetPostMedia(PostID string) (*[]components.Media, error)
+	GetPostsWithoutMedia() (*[]components.Post, error)
+	SetPostMedia(PostID string, Width int, Height int) error
+	GetPostsWithoutMIMEType() (*[]components.Post, error)
+	SetPostPhoto(PostID string, PhotoPath string, MIMEType string) error
+	GetPostsWithoutDigest() (*[]components.Post, error)
+	SetPostDigest(PostID string, Digest string, Size int64) error
+	GetUsersWithoutProfilePicDigest() (*[]components.User, error)
+	SetProfilePicDigest(Username string, Digest string, Size int64, Placeholder components.Placeholder) (*string, error)
+	GetPhotoReferences() (*[]components.PhotoReference, error)
+	GetBlobsWithoutSize() (*[]string, error)
+	SetBlobSize(Digest string, Size int64) error
+	GetBlobsWithoutPlaceholder() (*[]string, error)
+	SetBlobPlaceholder(Digest string, Placeholder components.Placeholder) error
+	GetStorageUsage(Username string) (*int64, error)
+	IsBlobReferenced(Digest string) (bool, error)
+	GetPostsByID(PostIDs []string, Viewer string) (*[]components.Post, error)
+	GetPhotoHashes() (*[]components.PhotoHash, error)
+	GetPostMediaWithoutHash() (*[]components.Media, error)
+	SetPostMediaHash(PhotoPath string, PHash string) error
+	DeletePost(postID string) (*[]string, error)
 	GetPostComments(postID string) (*[]components.Comment, error)
 	GetPostLikes(postID string) (*[]components.User, error)
+	GetPhotoOwner(PhotoPath string) (*string, error)
+	GetPhotoDigest(PhotoPath string) (*string, error)
+	AddPhotoRenditions(PhotoPath string, Renditions []components.Rendition) error
+	GetPhotoRenditions(PhotoPath string) (*[]components.Rendition, error)
+
+	// Upload queries
+	CreateUpload(Username string, Size int64, Digest string, TTL time.Duration) (*components.Upload, error)
+	GetUpload(Username string, UploadID string) (*components.Upload, error)
+	CountUploads(Username string) (*int, error)
+	AdvanceUpload(Username string, UploadID string, Offset int64, Length int64, TTL time.Duration) (*components.Upload, error)
+	DeleteUpload(Username string, UploadID string) error
+	DeleteExpiredUploads() error
+	GetUploadIDs() (*[]string, error)
 
 	// Profile queries
 	GetUserProfile(Username string) (*components.Profile, error)
@@ -84,6 +152,11 @@ type appdbimpl struct {
 	c *sql.DB
 }
 
+// querier runs queries either on the DB or within a transaction
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
 // New returns a new instance of AppDatabase based on the SQLite connection `db`.
 // `db` is required - an error will be returned if `db` is `nil`.
 func New(db *sql.DB) (AppDatabase, error) {
@@ -150,11 +223,134 @@ func New(db *sql.DB) (AppDatabase, error) {
 		PRIMARY KEY (Banner, Banned),
 		FOREIGN KEY (Banned) REFERENCES User(Username) ON DELETE CASCADE ON UPDATE CASCADE,
 		FOREIGN KEY (Banner) REFERENCES User(Username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS Session (
+		SessionID INTEGER PRIMARY KEY AUTOINCREMENT,
+		TokenHash STRING UNIQUE NOT NULL,
+		Username STRING NOT NULL,
+		IssuedAt INTEGER NOT NULL,
+		ExpiresAt INTEGER NOT NULL,
+		LastUsed INTEGER NOT NULL,
+		UserAgent STRING,
+		RemoteIP STRING,
+		FOREIGN KEY (Username) REFERENCES User(Username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS RecoveryCode (
+		Username STRING NOT NULL,
+		CodeHash STRING NOT NULL,
+		PRIMARY KEY (Username, CodeHash),
+		FOREIGN KEY (Username) REFERENCES User(Username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS APIKey (
+		KeyID INTEGER PRIMARY KEY AUTOINCREMENT,
+		KeyHash STRING UNIQUE NOT NULL,
+		Username STRING NOT NULL,
+		Name STRING NOT NULL,
+		Scopes STRING NOT NULL,
+		CreatedAt INTEGER NOT NULL,
+		ExpiresAt INTEGER,
+		LastUsed INTEGER,
+		FOREIGN KEY (Username) REFERENCES User(Username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS OIDCIdentity (
+		Issuer STRING NOT NULL,
+		Subject STRING NOT NULL,
+		Username STRING NOT NULL,
+		CreationDatetime STRING NOT NULL,
+		PRIMARY KEY (Issuer, Subject),
+		FOREIGN KEY (Username) REFERENCES User(Username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS Rendition (
+		PhotoPath STRING NOT NULL,
+		Width INTEGER NOT NULL,
+		Height INTEGER NOT NULL,
+		PRIMARY KEY (PhotoPath, Width)
+	);
+	CREATE TABLE IF NOT EXISTS PostMedia (
+		PostID INTEGER NOT NULL,
+		Position INTEGER NOT NULL,
+		PhotoPath STRING UNIQUE NOT NULL,
+		MIMEType STRING NOT NULL,
+		EXIF STRING,
+		Digest STRING NOT NULL,
+		Width INTEGER NOT NULL,
+		Height INTEGER NOT NULL,
+		PHash TEXT,
+		PRIMARY KEY (PostID, Position),
+		FOREIGN KEY (PostID) REFERENCES Post(PostID) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS Blob (
+		Digest STRING PRIMARY KEY NOT NULL,
+		RefCount INTEGER NOT NULL,
+		Size INTEGER,
+		BlurHash TEXT,
+		Color TEXT
+	);
+	CREATE TABLE IF NOT EXISTS Upload (
+		UploadID STRING PRIMARY KEY NOT NULL,
+		Username STRING NOT NULL,
+		Size INTEGER NOT NULL,
+		Digest STRING NOT NULL,
+		Received INTEGER NOT NULL,
+		ExpiresAt INTEGER NOT NULL,
+		FOREIGN KEY (Username) REFERENCES User(Username) ON DELETE CASCADE ON UPDATE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS OIDCLogin (
+		State STRING PRIMARY KEY NOT NULL,
+		Verifier STRING NOT NULL,
+		Nonce STRING NOT NULL,
+		ExpiresAt INTEGER NOT NULL
 	);`)
 	if err != nil {
 		return nil, err
 	}
 
+	// Columns added after the first release: databases created before need to be migrated
+	if err = addColumnIfMissing(db, "User", "PasswordHash", "STRING"); err != nil {
+		return nil, fmt.Errorf("error migrating database structure: %w", err)
+	}
+	if err = addColumnIfMissing(db, "User", "TOTPSecret", "STRING"); err != nil {
+		return nil, fmt.Errorf("error migrating database structure: %w", err)
+	}
+	if err = addColumnIfMissing(db, "User", "TOTPEnabled", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, fmt.Errorf("error migrating database structure: %w", err)
+	}
+	if err = addColumnIfMissing(db, "User", "TOTPLastStep", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, fmt.Errorf("error migrating database structure: %w", err)
+	}
+	if err = addColumnIfMissing(db, "Post", "MIMEType", "STRING"); err != nil {
+		return nil, fmt.Errorf("error migrating database structure: %w", err)
+	}
+	if err = addColumnIfMissing(db, "Post", "EXIF", "STRING"); err != nil {
+		return nil, fmt.Errorf("error migrating database structure: %w", err)
+	}
+	if err = addColumnIfMissing(db, "Post", "Digest", "STRING"); err != nil {
+		return nil, fmt.Errorf("error migrating database structure: %w", err)
+	}
+	if err = addColumnIfMissing(db, "User", "ProfilePicDigest", "STRING"); err != nil {
+		return nil, fmt.Errorf("error migrating database structure: %w", err)
+	}
+	if err = addColumnIfMissing(db, "Blob", "Size", "INTEGER"); err != nil {
+		return nil, fmt.Errorf("error migrating database structure: %w", err)
+	}
+	if err = addColumnIfMissing(db, "Blob", "BlurHash", "TEXT"); err != nil {
+		return nil, fmt.Errorf("error migrating database structure: %w", err)
+	}
+	if err = addColumnIfMissing(db, "Blob", "Color", "TEXT"); err != nil {
+		return nil, fmt.Errorf("error migrating database structure: %w", err)
+	}
+	if err = addColumnIfMissing(db, "PostMedia", "PHash", "TEXT"); err != nil {
+		return nil, fmt.Errorf("error migrating database structure: %w", err)
+	}
+	if err = addColumnIfMissing(db, "User", "TokenGeneration", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, fmt.Errorf("error migrating database structure: %w", err)
+	}
+
+	// Posts created before their photo stopped being copied from their first image still have the copy
+	if _, err = db.Exec(clearPostPhoto + " WHERE PhotoPath IS NOT NULL AND PostID IN (SELECT PostID FROM PostMedia)"); err != nil {
+		return nil, fmt.Errorf("error migrating database structure: %w", err)
+	}
+
 	return &appdbimpl{
 		c: db,
 	}, nil
@@ -163,3 +359,32 @@ func New(db *sql.DB) (AppDatabase, error) {
 func (db *appdbimpl) Ping() error {
 	return db.c.Ping()
 }
+
+// clearPostPhoto clears the photo recorded on a post. The photo of a post is recorded on the post only until it is
+// recorded as its first image (see GetPostsWithoutMedia), which is then the only copy of it.
+const clearPostPhoto = "UPDATE Post SET PhotoPath = NULL, MIMEType = NULL, EXIF = NULL, Digest = NULL"
+
+// addColumnIfMissing adds the given column to the given table, unless the table already has it
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
@@ -0,0 +1,187 @@
+package database
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"github.com/dchest/uniuri"
+)
+
+// Create a new API key for the given user, granted the given scopes. A zero ExpiresAt means the key never expires.
+// The (plain) key is returned only here: like session tokens, only its hash is stored.
+func (db appdbimpl) CreateAPIKey(Username string, Name string, Scopes []string, ExpiresAt time.Time) (*components.APIKey, error) {
+
+	stmt, err := db.c.Prepare("INSERT INTO APIKey (KeyHash, Username, Name, Scopes, CreatedAt, ExpiresAt) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	now := globaltime.Now()
+	apiKey := components.APIKey{
+		Name:             Name,
+		Scopes:           Scopes,
+		CreationDatetime: formatUnix(now.Unix()),
+		Key:              components.APIKeyPrefix + uniuri.NewLen(48),
+	}
+
+	var expiresAt sql.NullInt64
+	if !ExpiresAt.IsZero() {
+		expiresAt = sql.NullInt64{Int64: ExpiresAt.Unix(), Valid: true}
+		apiKey.ExpiresAt = formatUnix(ExpiresAt.Unix())
+	}
+
+	res, err := stmt.Exec(hashToken(apiKey.Key), Username, Name, strings.Join(Scopes, " "), now.Unix(), expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	apiKey.KeyID = strconv.FormatInt(keyID, 10)
+
+	return &apiKey, nil
+
+}
+
+// Retrieve the username of the owner of the given API key, provided that the key has been granted any of the given scopes.
+// Returns sql.ErrNoRows if the key does not exist (or has been revoked), components.ErrAPIKeyExpired if it has expired,
+// components.ErrScopeMissing if it has not been granted any of the scopes.
+func (db appdbimpl) GetUsernameByAPIKey(Key string, Scopes []string) (*string, error) {
+
+	stmt, err := db.c.Prepare("SELECT Username, Scopes, ExpiresAt FROM APIKey WHERE KeyHash = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var username, scopes string
+	var expiresAt sql.NullInt64
+	if err = stmt.QueryRow(hashToken(Key)).Scan(&username, &scopes, &expiresAt); err != nil {
+		return nil, err
+	}
+
+	now := globaltime.Now()
+	if expiresAt.Valid && now.Unix() >= expiresAt.Int64 {
+		return nil, components.ErrAPIKeyExpired
+	}
+
+	granted := false
+	for _, s := range strings.Fields(scopes) {
+		for _, required := range Scopes {
+			if s == required {
+				granted = true
+			}
+		}
+	}
+	if !granted {
+		return nil, components.ErrScopeMissing
+	}
+
+	if _, err = db.c.Exec("UPDATE APIKey SET LastUsed = ? WHERE KeyHash = ?", now.Unix(), hashToken(Key)); err != nil {
+		return nil, err
+	}
+
+	return &username, nil
+
+}
+
+// Retrieve the username of the owner of the given API key, whatever its scopes. Returns sql.ErrNoRows if the key does not
+// exist (or has been revoked), components.ErrAPIKeyExpired if it has expired.
+func (db appdbimpl) GetAPIKeyOwner(Key string) (*string, error) {
+
+	stmt, err := db.c.Prepare("SELECT Username, ExpiresAt FROM APIKey WHERE KeyHash = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var username string
+	var expiresAt sql.NullInt64
+	if err = stmt.QueryRow(hashToken(Key)).Scan(&username, &expiresAt); err != nil {
+		return nil, err
+	}
+
+	if expiresAt.Valid && globaltime.Now().Unix() >= expiresAt.Int64 {
+		return nil, components.ErrAPIKeyExpired
+	}
+
+	return &username, nil
+
+}
+
+// Retrieve the API keys of the given user, most recently created first. Expired keys are listed as well.
+func (db appdbimpl) GetUserAPIKeys(Username string) (*[]components.APIKey, error) {
+
+	stmt, err := db.c.Prepare("SELECT KeyID, Name, Scopes, CreatedAt, ExpiresAt, LastUsed FROM APIKey WHERE Username = ? ORDER BY CreatedAt DESC, KeyID DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(Username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var apiKeyList []components.APIKey
+	for rows.Next() {
+		var apiKey components.APIKey
+		var scopes string
+		var createdAt int64
+		var expiresAt, lastUsed sql.NullInt64
+		if err = rows.Scan(&apiKey.KeyID, &apiKey.Name, &scopes, &createdAt, &expiresAt, &lastUsed); err != nil {
+			return nil, err
+		}
+		apiKey.Scopes = strings.Fields(scopes)
+		apiKey.CreationDatetime = formatUnix(createdAt)
+		if expiresAt.Valid {
+			apiKey.ExpiresAt = formatUnix(expiresAt.Int64)
+		}
+		if lastUsed.Valid {
+			apiKey.LastUsed = formatUnix(lastUsed.Int64)
+		}
+
+		apiKeyList = append(apiKeyList, apiKey)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &apiKeyList, nil
+
+}
+
+// Revoke the API key with the given ID, provided that it belongs to the given user. Returns sql.ErrNoRows otherwise.
+func (db appdbimpl) DeleteAPIKey(Username string, KeyID string) error {
+
+	stmt, err := db.c.Prepare("DELETE FROM APIKey WHERE Username = ? AND KeyID = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(Username, KeyID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+
+}
@@ -84,7 +84,7 @@ func (db appdbimpl) UnbanUser(bannerUsername string, bannedUsername string) erro
 
 func (db appdbimpl) GetBanUserList(bannerUsername string) (*[]components.User, error) {
 
-	stmt, err := db.c.Prepare("SELECT U.Username, U.ProfilePicPath, COALESCE(U.Birthdate, ''), COALESCE(U.Name, '') FROM Ban B JOIN User U ON B.Banned = U.Username WHERE B.Banner = ? ORDER BY B.CreationDatetime DESC")
+	stmt, err := db.c.Prepare("SELECT U.Username, U.ProfilePicPath, COALESCE(U.Birthdate, ''), COALESCE(U.Name, ''), COALESCE(PB.BlurHash, ''), COALESCE(PB.Color, '') FROM Ban B JOIN User U ON B.Banned = U.Username LEFT JOIN Blob PB ON U.ProfilePicDigest = PB.Digest WHERE B.Banner = ? ORDER BY B.CreationDatetime DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -99,7 +99,7 @@ func (db appdbimpl) GetBanUserList(bannerUsername string) (*[]components.User, e
 	var bannedUserList []components.User
 	for rows.Next() {
 		var bannedUser components.User
-		if err = rows.Scan(&bannedUser.Username, &bannedUser.ProfilePic, &bannedUser.Birthdate, &bannedUser.Name); err != nil {
+		if err = rows.Scan(&bannedUser.Username, &bannedUser.ProfilePic, &bannedUser.Birthdate, &bannedUser.Name, &bannedUser.ProfilePicPlaceholder.BlurHash, &bannedUser.ProfilePicPlaceholder.Color); err != nil {
 			return nil, err
 		}
 
@@ -0,0 +1,264 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+)
+
+// Retrieve the users whose profile pic was stored before photos were stored by digest. Only their usernames and profile
+// pic paths are filled.
+func (db appdbimpl) GetUsersWithoutProfilePicDigest() (*[]components.User, error) {
+
+	rows, err := db.c.Query("SELECT Username, ProfilePicPath FROM User WHERE ProfilePicDigest IS NULL ORDER BY Username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userList []components.User
+	for rows.Next() {
+		var user components.User
+		if err := rows.Scan(&user.Username, &user.ProfilePic); err != nil {
+			return nil, err
+		}
+		userList = append(userList, user)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &userList, nil
+
+}
+
+// Set the digest of the profile pic of the given user (empty for the default profile pic), recording the user as a
+// reference to the blob of the given size and placeholder. Returns the digest of the previous profile pic if the user was the last reference to its blob,
+// so that the blob can be deleted, an empty string otherwise.
+func (db appdbimpl) SetProfilePicDigest(Username string, Digest string, Size int64, Placeholder components.Placeholder) (*string, error) {
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var oldDigest string
+	if err = tx.QueryRow("SELECT COALESCE(ProfilePicDigest, '') FROM User WHERE Username = ?", Username).Scan(&oldDigest); err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec("UPDATE User SET ProfilePicDigest = ? WHERE Username = ?", Digest, Username); err != nil {
+		return nil, err
+	}
+
+	unreferenced := ""
+	if Digest != "" {
+		if err = acquireBlob(tx, Digest, Size, Placeholder); err != nil {
+			return nil, err
+		}
+	}
+	if oldDigest != "" {
+		last, err := releaseBlob(tx, oldDigest)
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			unreferenced = oldDigest
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &unreferenced, nil
+
+}
+
+// Retrieve every reference to a photo in the store: the images of the posts, and the profile pics. The users who never
+// set a profile pic, having the default one, are left out.
+func (db appdbimpl) GetPhotoReferences() (*[]components.PhotoReference, error) {
+
+	rows, err := db.c.Query(`SELECT M.PhotoPath, M.Digest, P.Author FROM PostMedia M JOIN Post P ON M.PostID = P.PostID
+							UNION ALL SELECT PhotoPath, COALESCE(Digest, ''), Author FROM Post
+								WHERE PhotoPath IS NOT NULL AND PostID NOT IN (SELECT PostID FROM PostMedia)
+							UNION ALL SELECT ProfilePicPath, COALESCE(ProfilePicDigest, ''), Username FROM User
+								WHERE ProfilePicDigest IS NULL OR ProfilePicDigest != ''`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var references []components.PhotoReference
+	for rows.Next() {
+		var reference components.PhotoReference
+		if err := rows.Scan(&reference.PhotoPath, &reference.Digest, &reference.Owner); err != nil {
+			return nil, err
+		}
+		references = append(references, reference)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &references, nil
+
+}
+
+// Retrieve the digests of the blobs whose size is unknown, recorded before the sizes were
+func (db appdbimpl) GetBlobsWithoutSize() (*[]string, error) {
+
+	rows, err := db.c.Query("SELECT Digest FROM Blob WHERE Size IS NULL ORDER BY Digest")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var digests []string
+	for rows.Next() {
+		var digest string
+		if err := rows.Scan(&digest); err != nil {
+			return nil, err
+		}
+		digests = append(digests, digest)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &digests, nil
+
+}
+
+// Set the size, in bytes, of the blob with the given digest
+func (db appdbimpl) SetBlobSize(Digest string, Size int64) error {
+
+	res, err := db.c.Exec("UPDATE Blob SET Size = ? WHERE Digest = ?", Size, Digest)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+
+}
+
+// Retrieve the digests of the blobs whose placeholder is unknown, stored before the placeholders were computed
+func (db appdbimpl) GetBlobsWithoutPlaceholder() (*[]string, error) {
+
+	rows, err := db.c.Query("SELECT Digest FROM Blob WHERE BlurHash IS NULL OR Color IS NULL ORDER BY Digest")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var digests []string
+	for rows.Next() {
+		var digest string
+		if err := rows.Scan(&digest); err != nil {
+			return nil, err
+		}
+		digests = append(digests, digest)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &digests, nil
+
+}
+
+// Set the placeholder of the blob with the given digest
+func (db appdbimpl) SetBlobPlaceholder(Digest string, Placeholder components.Placeholder) error {
+
+	res, err := db.c.Exec("UPDATE Blob SET BlurHash = ?, Color = ? WHERE Digest = ?", Placeholder.BlurHash, Placeholder.Color, Digest)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+
+}
+
+// Retrieve the bytes stored for the given user: the sizes of the images of their posts and of their profile pic. Each
+// image counts in full, even if its blob is shared with other posts or users. Blobs whose size is unknown count as
+// empty.
+func (db appdbimpl) GetStorageUsage(Username string) (*int64, error) {
+
+	var usage int64
+	err := db.c.QueryRow(`SELECT COALESCE(SUM(B.Size), 0) FROM (
+								SELECT M.Digest FROM PostMedia M JOIN Post P ON M.PostID = P.PostID WHERE P.Author = ?
+								UNION ALL SELECT Digest FROM Post WHERE Author = ? AND PostID NOT IN (SELECT PostID FROM PostMedia)
+								UNION ALL SELECT ProfilePicDigest FROM User WHERE Username = ?
+							) R JOIN Blob B ON R.Digest = B.Digest`, Username, Username, Username).Scan(&usage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &usage, nil
+
+}
+
+// Check whether anything (a post or a profile pic) references the blob with the given digest
+func (db appdbimpl) IsBlobReferenced(Digest string) (bool, error) {
+
+	stmt, err := db.c.Prepare("SELECT EXISTS (SELECT 1 FROM Blob WHERE Digest = ? AND RefCount > 0)")
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	var referenced bool
+	if err = stmt.QueryRow(Digest).Scan(&referenced); err != nil {
+		return false, err
+	}
+
+	return referenced, nil
+
+}
+
+// acquireBlob records a new reference (a post or a profile pic) to the blob with the given digest, and its size (zero if
+// unknown) and placeholder (empty if unknown)
+func acquireBlob(tx *sql.Tx, Digest string, Size int64, Placeholder components.Placeholder) error {
+	_, err := tx.Exec(`INSERT INTO Blob (Digest, RefCount, Size, BlurHash, Color) VALUES (?, 1, NULLIF(?, 0), NULLIF(?, ''), NULLIF(?, ''))
+						ON CONFLICT (Digest) DO UPDATE SET RefCount = RefCount + 1, Size = COALESCE(Size, excluded.Size),
+							BlurHash = COALESCE(BlurHash, excluded.BlurHash), Color = COALESCE(Color, excluded.Color)`,
+		Digest, Size, Placeholder.BlurHash, Placeholder.Color)
+	return err
+}
+
+// releaseBlob drops a reference to the blob with the given digest, reporting whether it was the last one. Blobs with no
+// references left are forgotten.
+func releaseBlob(tx *sql.Tx, Digest string) (bool, error) {
+	if _, err := tx.Exec("UPDATE Blob SET RefCount = RefCount - 1 WHERE Digest = ?", Digest); err != nil {
+		return false, err
+	}
+
+	var refCount int
+	err := tx.QueryRow("SELECT RefCount FROM Blob WHERE Digest = ?", Digest).Scan(&refCount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	if refCount > 0 {
+		return false, nil
+	}
+
+	_, err = tx.Exec("DELETE FROM Blob WHERE Digest = ?", Digest)
+	return true, err
+}
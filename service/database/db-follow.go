@@ -11,7 +11,7 @@ import (
 
 func (db appdbimpl) GetFollowersList(followedUsername string) (*[]components.User, error) {
 
-	stmt, err := db.c.Prepare("SELECT U.Username, COALESCE('', U.Birthdate), U.ProfilePicPath,  COALESCE('', U.Name) FROM Follow F JOIN User U ON F.Follower = U.Username WHERE F.Followed = ? ORDER BY F.CreationDatetime DESC")
+	stmt, err := db.c.Prepare("SELECT U.Username, COALESCE('', U.Birthdate), U.ProfilePicPath,  COALESCE('', U.Name), COALESCE(PB.BlurHash, ''), COALESCE(PB.Color, '') FROM Follow F JOIN User U ON F.Follower = U.Username LEFT JOIN Blob PB ON U.ProfilePicDigest = PB.Digest WHERE F.Followed = ? ORDER BY F.CreationDatetime DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -26,7 +26,7 @@ func (db appdbimpl) GetFollowersList(followedUsername string) (*[]components.Use
 	var userList []components.User
 	for rows.Next() {
 		var user components.User
-		err = rows.Scan(&user.Username, &user.Birthdate, &user.ProfilePic, &user.Name)
+		err = rows.Scan(&user.Username, &user.Birthdate, &user.ProfilePic, &user.Name, &user.ProfilePicPlaceholder.BlurHash, &user.ProfilePicPlaceholder.Color)
 		if err != nil {
 			return nil, err
 		}
@@ -44,7 +44,7 @@ func (db appdbimpl) GetFollowersList(followedUsername string) (*[]components.Use
 
 func (db appdbimpl) GetFollowingList(followerUsername string) (*[]components.User, error) {
 
-	stmt, err := db.c.Prepare("SELECT U.Username, COALESCE(U.Birthdate, ''), U.ProfilePicPath, COALESCE(U.Name, '') FROM Follow F JOIN User U ON F.Followed = U.Username WHERE F.Follower = ? ORDER BY F.CreationDatetime DESC")
+	stmt, err := db.c.Prepare("SELECT U.Username, COALESCE(U.Birthdate, ''), U.ProfilePicPath, COALESCE(U.Name, ''), COALESCE(PB.BlurHash, ''), COALESCE(PB.Color, '') FROM Follow F JOIN User U ON F.Followed = U.Username LEFT JOIN Blob PB ON U.ProfilePicDigest = PB.Digest WHERE F.Follower = ? ORDER BY F.CreationDatetime DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -59,7 +59,7 @@ func (db appdbimpl) GetFollowingList(followerUsername string) (*[]components.Use
 	var userList []components.User
 	for rows.Next() {
 		var user components.User
-		err = rows.Scan(&user.Username, &user.Birthdate, &user.ProfilePic, &user.Name)
+		err = rows.Scan(&user.Username, &user.Birthdate, &user.ProfilePic, &user.Name, &user.ProfilePicPlaceholder.BlurHash, &user.ProfilePicPlaceholder.Color)
 		if err != nil {
 			return nil, err
 		}
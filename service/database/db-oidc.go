@@ -0,0 +1,123 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"github.com/dchest/uniuri"
+)
+
+// Store a pending OpenID Connect login, to be consumed by the callback within the given TTL.
+// Expired pending logins are cleaned up in the process.
+func (db appdbimpl) CreateOIDCLogin(State string, Verifier string, Nonce string, TTL time.Duration) error {
+
+	now := globaltime.Now()
+	if _, err := db.c.Exec("DELETE FROM OIDCLogin WHERE ExpiresAt <= ?", now.Unix()); err != nil {
+		return err
+	}
+
+	stmt, err := db.c.Prepare("INSERT INTO OIDCLogin (State, Verifier, Nonce, ExpiresAt) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	if _, err = stmt.Exec(State, Verifier, Nonce, now.Add(TTL).Unix()); err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// Retrieve and delete the pending OpenID Connect login with the given state, so that it cannot be used twice.
+// Returns sql.ErrNoRows if no such login exists, components.ErrLoginExpired if it has expired.
+func (db appdbimpl) ConsumeOIDCLogin(State string) (*components.OIDCLogin, error) {
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	login := components.OIDCLogin{State: State}
+	var expiresAt int64
+	if err = tx.QueryRow("SELECT Verifier, Nonce, ExpiresAt FROM OIDCLogin WHERE State = ?", State).Scan(&login.Verifier, &login.Nonce, &expiresAt); err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec("DELETE FROM OIDCLogin WHERE State = ?", State); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if globaltime.Now().Unix() >= expiresAt {
+		return nil, components.ErrLoginExpired
+	}
+
+	return &login, nil
+
+}
+
+// Retrieve the user linked to the given subject of the given provider. Returns sql.ErrNoRows if the subject is not linked to any user.
+func (db appdbimpl) GetUserByOIDCSubject(Issuer string, Subject string) (*components.User, error) {
+
+	stmt, err := db.c.Prepare(`SELECT U.ID, U.Username, U.ProfilePicPath, COALESCE(U.Birthdate, ''), COALESCE(U.Name, ''), COALESCE(PB.BlurHash, ''), COALESCE(PB.Color, '')
+								FROM OIDCIdentity I JOIN User U ON I.Username = U.Username LEFT JOIN Blob PB ON U.ProfilePicDigest = PB.Digest
+								WHERE I.Issuer = ? AND I.Subject = ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var user components.User
+	if err = stmt.QueryRow(Issuer, Subject).Scan(&user.ID, &user.Username, &user.ProfilePic, &user.Birthdate, &user.Name, &user.ProfilePicPlaceholder.BlurHash, &user.ProfilePicPlaceholder.Color); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+
+}
+
+// Create a new user with the given username, linked to the given subject of the given provider.
+// Returns components.ErrUsernameTaken if a user with the given username already exists: existing accounts are never
+// taken over by a provider.
+func (db appdbimpl) PostOIDCUser(Issuer string, Subject string, Username string) (*components.User, error) {
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var existing string
+	err = tx.QueryRow("SELECT Username FROM User WHERE Username = ?", Username).Scan(&existing)
+	if err == nil {
+		return nil, components.ErrUsernameTaken
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	user := components.User{
+		ID:         uniuri.NewLen(64),
+		Username:   Username,
+		ProfilePic: "profile_pics/" + Username + ".png",
+	}
+
+	if _, err = tx.Exec("INSERT INTO User (Username, ID, ProfilePicPath, ProfilePicDigest) VALUES (?, ?, ?, '')", user.Username, user.ID, user.ProfilePic); err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec("INSERT INTO OIDCIdentity (Issuer, Subject, Username, CreationDatetime) VALUES (?, ?, ?, ?)", Issuer, Subject, user.Username, formatUnix(globaltime.Now().Unix())); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+
+}
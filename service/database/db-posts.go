@@ -2,11 +2,13 @@ package database
 
 import (
 	"database/sql"
-	"errors"
+	"encoding/json"
 	"strconv"
+	"strings"
 	"time"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
 )
 
 func (db appdbimpl) CheckIfOwnerPost(Username string, PostID string) error {
@@ -121,8 +123,14 @@ func (db appdbimpl) GetUserStream(username string) (*[]components.Post, error) {
 									P.Author, 
 									P.CreationDatetime, 
 									P.Description, 
-									P.PhotoPath
-							FROM Post P JOIN Follow F ON P.Author = F.Followed WHERE F.Follower = ? ORDER BY P.PostID DESC`)
+									COALESCE(M.PhotoPath, P.PhotoPath),
+									COALESCE(M.MIMEType, P.MIMEType, ''),
+									COALESCE(M.EXIF, P.EXIF, ''),
+									COALESCE(M.Digest, P.Digest, ''),
+									COALESCE(M.PHash, ''),
+									COALESCE(B.BlurHash, ''),
+									COALESCE(B.Color, '')
+							FROM Post P JOIN Follow F ON P.Author = F.Followed LEFT JOIN PostMedia M ON P.PostID = M.PostID AND M.Position = 0 LEFT JOIN Blob B ON COALESCE(M.Digest, P.Digest) = B.Digest WHERE F.Follower = ? ORDER BY P.PostID DESC`)
 	if err != nil {
 		return nil, err
 	}
@@ -137,7 +145,11 @@ func (db appdbimpl) GetUserStream(username string) (*[]components.Post, error) {
 	var postStream []components.Post
 	for rows.Next() {
 		var post components.Post
-		if err := rows.Scan(&post.PostID, &post.Author, &post.CreationDatetime, &post.Description, &post.Photo); err != nil {
+		var exif string
+		if err := rows.Scan(&post.PostID, &post.Author, &post.CreationDatetime, &post.Description, &post.Photo, &post.MIMEType, &exif, &post.Digest, &post.PHash, &post.Placeholder.BlurHash, &post.Placeholder.Color); err != nil {
+			return nil, err
+		}
+		if post.EXIF, err = decodeEXIF(exif); err != nil {
 			return nil, err
 		}
 
@@ -153,6 +165,18 @@ func (db appdbimpl) GetUserStream(username string) (*[]components.Post, error) {
 		}
 		post.Comments = *comments
 
+		renditions, err := db.GetPhotoRenditions(post.Photo)
+		if err != nil {
+			return nil, err
+		}
+		post.Renditions = *renditions
+
+		media, err := db.GetPostMedia(post.PostID)
+		if err != nil {
+			return nil, err
+		}
+		post.Media = *media
+
 		postStream = append(postStream, post)
 	}
 
@@ -164,61 +188,371 @@ func (db appdbimpl) GetUserStream(username string) (*[]components.Post, error) {
 
 }
 
-func (db appdbimpl) UploadPost(username string, description string) (*components.Post, error) {
+// Retrieve the post with the given ID, with its likes, its comments and its images
+func (db appdbimpl) GetPost(PostID string) (*components.Post, error) {
+
+	stmt, err := db.c.Prepare(`SELECT 
+									P.PostID, 
+									P.Author, 
+									P.CreationDatetime, 
+									P.Description, 
+									COALESCE(M.PhotoPath, P.PhotoPath),
+									COALESCE(M.MIMEType, P.MIMEType, ''),
+									COALESCE(M.EXIF, P.EXIF, ''),
+									COALESCE(M.Digest, P.Digest, ''),
+									COALESCE(M.PHash, ''),
+									COALESCE(B.BlurHash, ''),
+									COALESCE(B.Color, '')
+							FROM Post P LEFT JOIN PostMedia M ON P.PostID = M.PostID AND M.Position = 0 LEFT JOIN Blob B ON COALESCE(M.Digest, P.Digest) = B.Digest WHERE P.PostID = ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var post components.Post
+	var exif string
+	if err = stmt.QueryRow(PostID).Scan(&post.PostID, &post.Author, &post.CreationDatetime, &post.Description, &post.Photo, &post.MIMEType, &exif, &post.Digest, &post.PHash, &post.Placeholder.BlurHash, &post.Placeholder.Color); err != nil {
+		return nil, err
+	}
+	if post.EXIF, err = decodeEXIF(exif); err != nil {
+		return nil, err
+	}
+
+	likers, err := db.GetPostLikes(post.PostID)
+	if err != nil {
+		return nil, err
+	}
+	post.Likes = *likers
+
+	comments, err := db.GetPostComments(post.PostID)
+	if err != nil {
+		return nil, err
+	}
+	post.Comments = *comments
+
+	renditions, err := db.GetPhotoRenditions(post.Photo)
+	if err != nil {
+		return nil, err
+	}
+	post.Renditions = *renditions
+
+	media, err := db.GetPostMedia(post.PostID)
+	if err != nil {
+		return nil, err
+	}
+	post.Media = *media
+
+	return &post, nil
+
+}
+
+// Retrieve the posts with the given IDs, in no particular order, with their likes, their comments and their images. The
+// posts that do not exist are left out, as are the posts of the users the viewer has banned or that have banned the
+// viewer.
+func (db appdbimpl) GetPostsByID(PostIDs []string, Viewer string) (*[]components.Post, error) {
+
+	postList := []components.Post{}
+	if len(PostIDs) == 0 {
+		return &postList, nil
+	}
+
+	stmt, err := db.c.Prepare(`SELECT 
+									P.PostID, 
+									P.Author, 
+									P.CreationDatetime, 
+									P.Description, 
+									COALESCE(M.PhotoPath, P.PhotoPath),
+									COALESCE(M.MIMEType, P.MIMEType, ''),
+									COALESCE(M.EXIF, P.EXIF, ''),
+									COALESCE(M.Digest, P.Digest, ''),
+									COALESCE(M.PHash, ''),
+									COALESCE(B.BlurHash, ''),
+									COALESCE(B.Color, '')
+							FROM Post P LEFT JOIN PostMedia M ON P.PostID = M.PostID AND M.Position = 0 LEFT JOIN Blob B ON COALESCE(M.Digest, P.Digest) = B.Digest
+							WHERE P.PostID IN (?` + strings.Repeat(", ?", len(PostIDs)-1) + `)
+								AND NOT EXISTS (SELECT 1 FROM Ban WHERE (Banner = ? AND Banned = P.Author) OR (Banner = P.Author AND Banned = ?))`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	args := make([]interface{}, 0, len(PostIDs)+2)
+	for _, postID := range PostIDs {
+		args = append(args, postID)
+	}
+	args = append(args, Viewer, Viewer)
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	var id int
-	if err := db.c.QueryRow("SELECT seq FROM sqlite_sequence WHERE Name='Post';").Scan(&id); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			id = 0
-		} else {
+	for rows.Next() {
+		var post components.Post
+		var exif string
+		if err := rows.Scan(&post.PostID, &post.Author, &post.CreationDatetime, &post.Description, &post.Photo, &post.MIMEType, &exif, &post.Digest, &post.PHash, &post.Placeholder.BlurHash, &post.Placeholder.Color); err != nil {
 			return nil, err
 		}
+		if post.EXIF, err = decodeEXIF(exif); err != nil {
+			return nil, err
+		}
+		postList = append(postList, post)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	stmt, err := db.c.Prepare("INSERT INTO Post (Author, CreationDatetime, Description, PhotoPath) VALUES (?, ?, ?, ?)")
+	for i := range postList {
+		likers, err := db.GetPostLikes(postList[i].PostID)
+		if err != nil {
+			return nil, err
+		}
+		postList[i].Likes = *likers
+
+		comments, err := db.GetPostComments(postList[i].PostID)
+		if err != nil {
+			return nil, err
+		}
+		postList[i].Comments = *comments
+
+		renditions, err := db.GetPhotoRenditions(postList[i].Photo)
+		if err != nil {
+			return nil, err
+		}
+		postList[i].Renditions = *renditions
+
+		media, err := db.GetPostMedia(postList[i].PostID)
+		if err != nil {
+			return nil, err
+		}
+		postList[i].Media = *media
+	}
+
+	return &postList, nil
+
+}
+
+// Retrieve the perceptual hashes of the images of all the posts, with the post they belong to. The images whose hash has
+// not been computed yet (see GetPostMediaWithoutHash) are left out.
+func (db appdbimpl) GetPhotoHashes() (*[]components.PhotoHash, error) {
+
+	rows, err := db.c.Query("SELECT PostID, PHash FROM PostMedia WHERE PHash IS NOT NULL")
 	if err != nil {
 		return nil, err
 	}
-	defer stmt.Close()
+	defer rows.Close()
+
+	var hashes []components.PhotoHash
+	for rows.Next() {
+		var hash components.PhotoHash
+		if err := rows.Scan(&hash.PostID, &hash.PHash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &hashes, nil
+
+}
+
+// Create a new post of the given user, with the given images in order. The images are stored with the extension of
+// their format: the first one at "posts/<user>_<id>.jpg", the following ones at "posts/<user>_<id>-<n>.jpg" (n being
+// their position, from 2). The first image is also the photo of the post, as read from the images (see
+// GetPostsWithoutMedia): it is not copied to the post. The EXIF tags kept from the images are stored as JSON objects.
+// Each image is recorded as a reference to the blob with its digest. The given uploads of the user, which the images
+// were sent as, are deleted with the post being created: if any of them no longer exists (e.g., another post claimed it
+// meanwhile), sql.ErrNoRows is returned and nothing is posted.
+func (db appdbimpl) UploadPost(username string, description string, Media []components.Media, Uploads []string) (*components.Post, error) {
+
+	if len(Media) == 0 {
+		return nil, components.ErrNoMedia
+	}
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	for _, uploadID := range Uploads {
+		res, err := tx.Exec("DELETE FROM Upload WHERE UploadID = ? AND Username = ? AND ExpiresAt > ?", uploadID, username, globaltime.Now().Unix())
+		if err != nil {
+			return nil, err
+		}
+		if affected, err := res.RowsAffected(); err != nil {
+			return nil, err
+		} else if affected == 0 {
+			return nil, sql.ErrNoRows
+		}
+	}
 
 	t := time.Now()
 	creationDatetime := strconv.Itoa(t.Year()) + "-" + strconv.Itoa(int(t.Month())) + "-" + strconv.Itoa(t.Day()) + " " + strconv.Itoa(t.Hour()) + ":" + strconv.Itoa(t.Minute()) + ":" + strconv.Itoa(t.Second())
-	photoPath := "posts/" + username + "_" + strconv.Itoa(id+1) + ".png"
-	if _, err := stmt.Exec(username, creationDatetime, description, photoPath); err != nil {
+	res, err := tx.Exec("INSERT INTO Post (Author, CreationDatetime, Description) VALUES (?, ?, ?)", username, creationDatetime, description)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	postID := strconv.FormatInt(id, 10)
+
+	media := make([]components.Media, len(Media))
+	exifs := make([]interface{}, len(Media))
+	for i, item := range Media {
+		extension, ok := components.PhotoExtensions[item.MIMEType]
+		if !ok {
+			return nil, components.ErrFormatNotValid
+		}
+		if exifs[i], err = encodeEXIF(item.EXIF); err != nil {
+			return nil, err
+		}
+
+		item.Photo = "posts/" + username + "_" + postID
+		if i > 0 {
+			item.Photo += "-" + strconv.Itoa(i+1)
+		}
+		item.Photo += extension
+		if _, err = tx.Exec("INSERT INTO PostMedia (PostID, Position, PhotoPath, MIMEType, EXIF, Digest, Width, Height, PHash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''))",
+			id, i, item.Photo, item.MIMEType, exifs[i], item.Digest, item.Width, item.Height, item.PHash); err != nil {
+			return nil, err
+		}
+		if err = acquireBlob(tx, item.Digest, item.Size, item.Placeholder); err != nil {
+			return nil, err
+		}
+		media[i] = item
+	}
+
+	if err = tx.Commit(); err != nil {
 		return nil, err
 	}
 
+	cover := media[0]
 	return &components.Post{
-		PostID:           strconv.Itoa(id + 1),
+		PostID:           postID,
 		Author:           username,
+		Photo:            cover.Photo,
+		MIMEType:         cover.MIMEType,
+		Digest:           cover.Digest,
 		CreationDatetime: creationDatetime,
 		Description:      description,
-		Photo:            photoPath,
+		EXIF:             cover.EXIF,
+		Media:            media,
+		PHash:            cover.PHash,
+		Placeholder:      cover.Placeholder,
 	}, nil
 
 }
 
-func (db appdbimpl) DeletePost(postID string) (*string, error) {
+// Delete the given post, with all its images. Returns the digests of the images the post was the last reference to, so
+// that their blobs can be deleted.
+func (db appdbimpl) DeletePost(postID string) (*[]string, error) {
 
-	stmt, err := db.c.Prepare("SELECT PhotoPath FROM Post WHERE PostID = ?")
+	tx, err := db.c.Begin()
 	if err != nil {
 		return nil, err
 	}
-	defer stmt.Close()
+	defer func() { _ = tx.Rollback() }()
+
+	var photoPath, digest string
+	if err := tx.QueryRow("SELECT COALESCE(PhotoPath, ''), COALESCE(Digest, '') FROM Post WHERE PostID = ?", postID).Scan(&photoPath, &digest); err != nil {
+		return nil, err
+	}
+
+	media, err := getPostMedia(tx, postID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The photo of the posts not migrated to images yet (see GetPostsWithoutMedia) is referenced by the post itself
+	if len(media) == 0 {
+		media = append(media, components.Media{Photo: photoPath, Digest: digest})
+	}
 
-	var photoPath string
-	if err := stmt.QueryRow(postID).Scan(&photoPath); err != nil {
+	if _, err := tx.Exec("DELETE FROM PostMedia WHERE PostID = ?", postID); err != nil {
 		return nil, err
 	}
 
-	if _, err := db.c.Exec("DELETE FROM Post WHERE PostID = ?", postID); err != nil {
+	if _, err := tx.Exec("DELETE FROM Post WHERE PostID = ?", postID); err != nil {
 		return nil, err
 	}
 
-	return &photoPath, nil
+	unreferenced := []string{}
+	for _, item := range media {
+		if _, err := tx.Exec("DELETE FROM Rendition WHERE PhotoPath = ?", item.Photo); err != nil {
+			return nil, err
+		}
+
+		if item.Digest == "" {
+			continue
+		}
+		last, err := releaseBlob(tx, item.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if last {
+			unreferenced = append(unreferenced, item.Digest)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &unreferenced, nil
+
+}
+
+// Retrieve the images of the given post, in order, with their renditions (whose URLs are left empty)
+func (db appdbimpl) GetPostMedia(PostID string) (*[]components.Media, error) {
+
+	media, err := getPostMedia(db.c, PostID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range media {
+		renditions, err := db.GetPhotoRenditions(media[i].Photo)
+		if err != nil {
+			return nil, err
+		}
+		media[i].Renditions = *renditions
+	}
+
+	return &media, nil
 
 }
 
+// getPostMedia retrieves the images of the given post, in order, without their renditions
+func getPostMedia(q querier, PostID string) ([]components.Media, error) {
+	rows, err := q.Query(`SELECT M.PhotoPath, M.MIMEType, COALESCE(M.EXIF, ''), M.Digest, M.Width, M.Height, COALESCE(B.Size, 0), COALESCE(M.PHash, ''), COALESCE(B.BlurHash, ''), COALESCE(B.Color, '')
+							FROM PostMedia M LEFT JOIN Blob B ON M.Digest = B.Digest WHERE M.PostID = ? ORDER BY M.Position`, PostID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mediaList []components.Media
+	for rows.Next() {
+		var media components.Media
+		var exif string
+		if err := rows.Scan(&media.Photo, &media.MIMEType, &exif, &media.Digest, &media.Width, &media.Height, &media.Size, &media.PHash, &media.Placeholder.BlurHash, &media.Placeholder.Color); err != nil {
+			return nil, err
+		}
+		if media.EXIF, err = decodeEXIF(exif); err != nil {
+			return nil, err
+		}
+		mediaList = append(mediaList, media)
+	}
+
+	return mediaList, rows.Err()
+}
+
 func (db appdbimpl) GetPostComments(postID string) (*[]components.Comment, error) {
 
 	stmt, err := db.c.Prepare("SELECT * FROM Comment C WHERE PostID = ? ORDER BY CommentID DESC")
@@ -252,7 +586,7 @@ func (db appdbimpl) GetPostComments(postID string) (*[]components.Comment, error
 
 func (db appdbimpl) GetPostLikes(postID string) (*[]components.User, error) {
 
-	stmt, err := db.c.Prepare("SELECT U.Username, U.ProfilePicPath, COALESCE('', U.Birthdate), COALESCE('', U.Name) FROM User U JOIN Like L ON L.Liker = U.Username WHERE L.PostID = ? ORDER BY L.CreationDatetime DESC")
+	stmt, err := db.c.Prepare("SELECT U.Username, U.ProfilePicPath, COALESCE('', U.Birthdate), COALESCE('', U.Name), COALESCE(PB.BlurHash, ''), COALESCE(PB.Color, '') FROM User U JOIN Like L ON L.Liker = U.Username LEFT JOIN Blob PB ON U.ProfilePicDigest = PB.Digest WHERE L.PostID = ? ORDER BY L.CreationDatetime DESC")
 	if err != nil {
 		return nil, err
 	}
@@ -267,7 +601,7 @@ func (db appdbimpl) GetPostLikes(postID string) (*[]components.User, error) {
 	var userList []components.User
 	for rows.Next() {
 		var user components.User
-		if err := rows.Scan(&user.Username, &user.ProfilePic, &user.Birthdate, &user.Name); err != nil {
+		if err := rows.Scan(&user.Username, &user.ProfilePic, &user.Birthdate, &user.Name, &user.ProfilePicPlaceholder.BlurHash, &user.ProfilePicPlaceholder.Color); err != nil {
 			return nil, err
 		}
 		userList = append(userList, user)
@@ -280,3 +614,326 @@ func (db appdbimpl) GetPostLikes(postID string) (*[]components.User, error) {
 	return &userList, nil
 
 }
+
+// Retrieve the username of the owner of the photo stored at the given path, either an image of a post or a profile
+// picture.
+// Returns sql.ErrNoRows if no post and no user refers to the path.
+func (db appdbimpl) GetPhotoOwner(PhotoPath string) (*string, error) {
+
+	stmt, err := db.c.Prepare(`SELECT P.Author FROM PostMedia M JOIN Post P ON M.PostID = P.PostID WHERE M.PhotoPath = ?
+							UNION SELECT Author FROM Post WHERE PhotoPath = ?
+							UNION SELECT Username FROM User WHERE ProfilePicPath = ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var owner string
+	if err = stmt.QueryRow(PhotoPath, PhotoPath, PhotoPath).Scan(&owner); err != nil {
+		return nil, err
+	}
+
+	return &owner, nil
+
+}
+
+// Retrieve the digest of the blob of the photo at the given path. The digest of the profile pic of the users who never
+// set one is empty. Posts whose photo has no digest (see GetPostsWithoutDigest) are not found.
+func (db appdbimpl) GetPhotoDigest(PhotoPath string) (*string, error) {
+
+	stmt, err := db.c.Prepare(`SELECT Digest FROM PostMedia WHERE PhotoPath = ?
+							UNION SELECT Digest FROM Post WHERE PhotoPath = ? AND Digest IS NOT NULL
+							UNION SELECT COALESCE(ProfilePicDigest, '') FROM User WHERE ProfilePicPath = ?`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var digest string
+	if err = stmt.QueryRow(PhotoPath, PhotoPath, PhotoPath).Scan(&digest); err != nil {
+		return nil, err
+	}
+
+	return &digest, nil
+
+}
+
+// Record the renditions generated for the photo stored at the given path
+func (db appdbimpl) AddPhotoRenditions(PhotoPath string, Renditions []components.Rendition) error {
+
+	stmt, err := db.c.Prepare("INSERT OR REPLACE INTO Rendition (PhotoPath, Width, Height) VALUES (?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, rendition := range Renditions {
+		if _, err = stmt.Exec(PhotoPath, rendition.Width, rendition.Height); err != nil {
+			return err
+		}
+	}
+
+	return nil
+
+}
+
+// Retrieve the renditions of the photo stored at the given path, narrowest first. Their URLs are left empty.
+func (db appdbimpl) GetPhotoRenditions(PhotoPath string) (*[]components.Rendition, error) {
+
+	stmt, err := db.c.Prepare("SELECT Width, Height FROM Rendition WHERE PhotoPath = ? ORDER BY Width")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(PhotoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var renditionList []components.Rendition
+	for rows.Next() {
+		var rendition components.Rendition
+		if err := rows.Scan(&rendition.Width, &rendition.Height); err != nil {
+			return nil, err
+		}
+		renditionList = append(renditionList, rendition)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &renditionList, nil
+
+}
+
+// Retrieve the posts uploaded before the format of the photos was recorded. Only their IDs and photo paths are filled.
+func (db appdbimpl) GetPostsWithoutMIMEType() (*[]components.Post, error) {
+
+	rows, err := db.c.Query("SELECT PostID, PhotoPath FROM Post WHERE MIMEType IS NULL AND PostID NOT IN (SELECT PostID FROM PostMedia) ORDER BY PostID")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var postList []components.Post
+	for rows.Next() {
+		var post components.Post
+		if err := rows.Scan(&post.PostID, &post.Photo); err != nil {
+			return nil, err
+		}
+		postList = append(postList, post)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &postList, nil
+
+}
+
+// Set the path and the format of the photo of the given post. The renditions of the photo follow it to the new path.
+func (db appdbimpl) SetPostPhoto(PostID string, PhotoPath string, MIMEType string) error {
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var oldPath string
+	if err = tx.QueryRow("SELECT PhotoPath FROM Post WHERE PostID = ?", PostID).Scan(&oldPath); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("UPDATE Post SET PhotoPath = ?, MIMEType = ? WHERE PostID = ?", PhotoPath, MIMEType, PostID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("UPDATE Rendition SET PhotoPath = ? WHERE PhotoPath = ?", PhotoPath, oldPath); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+
+}
+
+// Retrieve the posts whose photo was stored before photos were stored by digest. Only their IDs and photo paths are
+// filled.
+func (db appdbimpl) GetPostsWithoutDigest() (*[]components.Post, error) {
+
+	rows, err := db.c.Query("SELECT PostID, PhotoPath FROM Post WHERE Digest IS NULL AND PostID NOT IN (SELECT PostID FROM PostMedia) ORDER BY PostID")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var postList []components.Post
+	for rows.Next() {
+		var post components.Post
+		if err := rows.Scan(&post.PostID, &post.Photo); err != nil {
+			return nil, err
+		}
+		postList = append(postList, post)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &postList, nil
+
+}
+
+// Set the digest of the photo of the given post, which had none, recording the post as a reference to the blob of the
+// given size
+func (db appdbimpl) SetPostDigest(PostID string, Digest string, Size int64) error {
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec("UPDATE Post SET Digest = ? WHERE PostID = ? AND Digest IS NULL", Digest, PostID)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return sql.ErrNoRows
+	}
+	if err = acquireBlob(tx, Digest, Size, components.Placeholder{}); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+
+}
+
+// Retrieve the posts uploaded before posts had several images, whose photo is not recorded as their first image yet.
+// Only their IDs, photo paths and digests are filled. Posts whose photo has no digest (see GetPostsWithoutDigest) are
+// left out.
+func (db appdbimpl) GetPostsWithoutMedia() (*[]components.Post, error) {
+
+	rows, err := db.c.Query("SELECT PostID, PhotoPath, Digest FROM Post WHERE Digest IS NOT NULL AND PostID NOT IN (SELECT PostID FROM PostMedia) ORDER BY PostID")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var postList []components.Post
+	for rows.Next() {
+		var post components.Post
+		if err := rows.Scan(&post.PostID, &post.Photo, &post.Digest); err != nil {
+			return nil, err
+		}
+		postList = append(postList, post)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &postList, nil
+
+}
+
+// Record the photo of the given post, uploaded before posts had several images, as its only image, of the given size.
+// The photo and the reference to its blob pass from the post to the image.
+func (db appdbimpl) SetPostMedia(PostID string, Width int, Height int) error {
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec(`INSERT INTO PostMedia (PostID, Position, PhotoPath, MIMEType, EXIF, Digest, Width, Height)
+							SELECT PostID, 0, PhotoPath, COALESCE(MIMEType, ''), EXIF, Digest, ?, ? FROM Post WHERE PostID = ? AND Digest IS NOT NULL`,
+		Width, Height, PostID)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return sql.ErrNoRows
+	}
+	if _, err = tx.Exec(clearPostPhoto+" WHERE PostID = ?", PostID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+
+}
+
+// Retrieve the images of the posts whose perceptual hash has not been computed yet, uploaded before the hashes were
+// computed. Only the path and the digest of the images are retrieved.
+func (db appdbimpl) GetPostMediaWithoutHash() (*[]components.Media, error) {
+
+	rows, err := db.c.Query("SELECT PhotoPath, Digest FROM PostMedia WHERE PHash IS NULL ORDER BY PostID, Position")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mediaList []components.Media
+	for rows.Next() {
+		var media components.Media
+		if err := rows.Scan(&media.Photo, &media.Digest); err != nil {
+			return nil, err
+		}
+		mediaList = append(mediaList, media)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &mediaList, nil
+
+}
+
+// Set the perceptual hash of the image at the given path
+func (db appdbimpl) SetPostMediaHash(PhotoPath string, PHash string) error {
+
+	res, err := db.c.Exec("UPDATE PostMedia SET PHash = ? WHERE PhotoPath = ?", PHash, PhotoPath)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+
+}
+
+// encodeEXIF encodes the EXIF tags kept from a photo as a JSON object, or NULL if there are none
+func encodeEXIF(EXIF map[string]string) (interface{}, error) {
+	if len(EXIF) == 0 {
+		return nil, nil
+	}
+	encoded, err := json.Marshal(EXIF)
+	if err != nil {
+		return nil, err
+	}
+	return string(encoded), nil
+}
+
+// decodeEXIF decodes the EXIF tags encoded by encodeEXIF (an empty string for NULL)
+func decodeEXIF(EXIF string) (map[string]string, error) {
+	if EXIF == "" {
+		return nil, nil
+	}
+	var decoded map[string]string
+	if err := json.Unmarshal([]byte(EXIF), &decoded); err != nil {
+		return nil, err
+	}
+	return decoded, nil
+}
@@ -11,14 +11,14 @@ import (
 func (db appdbimpl) GetUserProfile(Username string) (*components.Profile, error) {
 
 	// Retrieve the informations about the user with the provided username
-	stmt, err := db.c.Prepare("SELECT Username, COALESCE(Birthdate, ''), COALESCE(Name, ''), ProfilePicPath FROM User WHERE Username = ?")
+	stmt, err := db.c.Prepare("SELECT U.Username, COALESCE(U.Birthdate, ''), COALESCE(U.Name, ''), U.ProfilePicPath, COALESCE(PB.BlurHash, ''), COALESCE(PB.Color, '') FROM User U LEFT JOIN Blob PB ON U.ProfilePicDigest = PB.Digest WHERE U.Username = ?")
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
 
 	var user components.User
-	if err = stmt.QueryRow(Username).Scan(&user.Username, &user.Birthdate, &user.Name, &user.ProfilePic); err != nil {
+	if err = stmt.QueryRow(Username).Scan(&user.Username, &user.Birthdate, &user.Name, &user.ProfilePic, &user.ProfilePicPlaceholder.BlurHash, &user.ProfilePicPlaceholder.Color); err != nil {
 		return nil, err
 	}
 
@@ -28,8 +28,14 @@ func (db appdbimpl) GetUserProfile(Username string) (*components.Profile, error)
 									P.Author, 
 									P.Description, 
 									P.CreationDatetime, 
-									P.PhotoPath
-							FROM Post P WHERE Author = ? ORDER BY P.CreationDatetime DESC`)
+									COALESCE(M.PhotoPath, P.PhotoPath),
+									COALESCE(M.MIMEType, P.MIMEType, ''),
+									COALESCE(M.EXIF, P.EXIF, ''),
+									COALESCE(M.Digest, P.Digest, ''),
+									COALESCE(M.PHash, ''),
+									COALESCE(B.BlurHash, ''),
+									COALESCE(B.Color, '')
+							FROM Post P LEFT JOIN PostMedia M ON P.PostID = M.PostID AND M.Position = 0 LEFT JOIN Blob B ON COALESCE(M.Digest, P.Digest) = B.Digest WHERE P.Author = ? ORDER BY P.CreationDatetime DESC`)
 	if err != nil {
 		return nil, err
 	}
@@ -44,7 +50,11 @@ func (db appdbimpl) GetUserProfile(Username string) (*components.Profile, error)
 	var posts []components.Post
 	for rows.Next() {
 		var post components.Post
-		if err = rows.Scan(&post.PostID, &post.Author, &post.Description, &post.CreationDatetime, &post.Photo); err != nil {
+		var exif string
+		if err = rows.Scan(&post.PostID, &post.Author, &post.Description, &post.CreationDatetime, &post.Photo, &post.MIMEType, &exif, &post.Digest, &post.PHash, &post.Placeholder.BlurHash, &post.Placeholder.Color); err != nil {
+			return nil, err
+		}
+		if post.EXIF, err = decodeEXIF(exif); err != nil {
 			return nil, err
 		}
 
@@ -60,6 +70,18 @@ func (db appdbimpl) GetUserProfile(Username string) (*components.Profile, error)
 		}
 		post.Comments = *comments
 
+		renditions, err := db.GetPhotoRenditions(post.Photo)
+		if err != nil {
+			return nil, err
+		}
+		post.Renditions = *renditions
+
+		media, err := db.GetPostMedia(post.PostID)
+		if err != nil {
+			return nil, err
+		}
+		post.Media = *media
+
 		posts = append(posts, post)
 	}
 
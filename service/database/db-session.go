@@ -0,0 +1,253 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"github.com/dchest/uniuri"
+)
+
+// Only the SHA-256 digest of a session token is stored, so that the content of the Session table cannot be used to authenticate
+func hashToken(Token string) string {
+	sum := sha256.Sum256([]byte(Token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Open a new session for the given user, valid for the given TTL. The (plain) token of the session is returned.
+// Expired sessions of the user are cleaned up in the process.
+func (db appdbimpl) CreateSession(Username string, UserAgent string, RemoteIP string, TTL time.Duration) (*string, error) {
+
+	now := globaltime.Now()
+	if _, err := db.c.Exec("DELETE FROM Session WHERE Username = ? AND ExpiresAt <= ?", Username, now.Unix()); err != nil {
+		return nil, err
+	}
+
+	stmt, err := db.c.Prepare("INSERT INTO Session (TokenHash, Username, IssuedAt, ExpiresAt, LastUsed, UserAgent, RemoteIP) VALUES (?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	token := uniuri.NewLen(64)
+	if _, err = stmt.Exec(hashToken(token), Username, now.Unix(), now.Add(TTL).Unix(), now.Unix(), UserAgent, RemoteIP); err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+
+}
+
+// Retrieve the username of the owner of the session with the given token.
+// Returns sql.ErrNoRows if the session does not exist (or has been revoked), components.ErrSessionExpired if it has expired.
+// If the session is valid, its expiration is moved forward by the given TTL (sliding expiry).
+func (db appdbimpl) GetUsernameByToken(Token string, TTL time.Duration) (*string, error) {
+
+	stmt, err := db.c.Prepare("SELECT Username, ExpiresAt FROM Session WHERE TokenHash = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var username string
+	var expiresAt int64
+	if err = stmt.QueryRow(hashToken(Token)).Scan(&username, &expiresAt); err != nil {
+		return nil, err
+	}
+
+	now := globaltime.Now()
+	if now.Unix() >= expiresAt {
+		return nil, components.ErrSessionExpired
+	}
+
+	stmt, err = db.c.Prepare("UPDATE Session SET LastUsed = ?, ExpiresAt = ? WHERE TokenHash = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	if _, err = stmt.Exec(now.Unix(), now.Add(TTL).Unix(), hashToken(Token)); err != nil {
+		return nil, err
+	}
+
+	return &username, nil
+
+}
+
+// Revoke the session with the given token. Returns sql.ErrNoRows if no such session exists.
+func (db appdbimpl) DeleteSession(Token string) error {
+
+	stmt, err := db.c.Prepare("DELETE FROM Session WHERE TokenHash = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(hashToken(Token))
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+
+}
+
+// Retrieve the active sessions of the given user, most recently used first. The session with the given token is flagged as the current one.
+func (db appdbimpl) GetUserSessions(Username string, Token string) (*[]components.Session, error) {
+
+	stmt, err := db.c.Prepare(`SELECT 
+									SessionID, 
+									TokenHash, 
+									COALESCE(UserAgent, ''), 
+									COALESCE(RemoteIP, ''), 
+									IssuedAt, 
+									LastUsed, 
+									ExpiresAt 
+							FROM Session WHERE Username = ? AND ExpiresAt > ? ORDER BY LastUsed DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	rows, err := stmt.Query(Username, globaltime.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessionList := []components.Session{}
+	for rows.Next() {
+		var session components.Session
+		var tokenHash string
+		var issuedAt, lastUsed, expiresAt int64
+		if err = rows.Scan(&session.SessionID, &tokenHash, &session.UserAgent, &session.RemoteIP, &issuedAt, &lastUsed, &expiresAt); err != nil {
+			return nil, err
+		}
+		session.IssuedAt = formatUnix(issuedAt)
+		session.LastUsed = formatUnix(lastUsed)
+		session.ExpiresAt = formatUnix(expiresAt)
+		session.Current = tokenHash == hashToken(Token)
+
+		sessionList = append(sessionList, session)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &sessionList, nil
+
+}
+
+// Revoke the session with the given ID, provided that it belongs to the given user. Returns sql.ErrNoRows otherwise.
+func (db appdbimpl) DeleteUserSession(Username string, SessionID string) error {
+
+	stmt, err := db.c.Prepare("DELETE FROM Session WHERE Username = ? AND SessionID = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(Username, SessionID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+
+}
+
+// Revoke all the sessions of the given user, except the one with the given token
+func (db appdbimpl) DeleteOtherSessions(Username string, Token string) error {
+
+	stmt, err := db.c.Prepare("DELETE FROM Session WHERE Username = ? AND TokenHash <> ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	if _, err = stmt.Exec(Username, hashToken(Token)); err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// Retrieve the subject of the signed tokens issued to the given user
+func (db appdbimpl) GetTokenSubject(Username string) (*components.TokenSubject, error) {
+
+	stmt, err := db.c.Prepare("SELECT ID, Username, TokenGeneration FROM User WHERE Username = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var subject components.TokenSubject
+	if err = stmt.QueryRow(Username).Scan(&subject.UserID, &subject.Username, &subject.Generation); err != nil {
+		return nil, err
+	}
+
+	return &subject, nil
+
+}
+
+// Retrieve the current username and token generation of the user with the given ID, the subject of the signed tokens.
+// Returns sql.ErrNoRows if the user does not exist.
+func (db appdbimpl) GetTokenSubjectByUserID(UserID string) (*components.TokenSubject, error) {
+
+	stmt, err := db.c.Prepare("SELECT ID, Username, TokenGeneration FROM User WHERE ID = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	var subject components.TokenSubject
+	if err = stmt.QueryRow(UserID).Scan(&subject.UserID, &subject.Username, &subject.Generation); err != nil {
+		return nil, err
+	}
+
+	return &subject, nil
+
+}
+
+// Revoke all the signed tokens issued to the given user so far
+func (db appdbimpl) IncrementTokenGeneration(Username string) error {
+
+	stmt, err := db.c.Prepare("UPDATE User SET TokenGeneration = TokenGeneration + 1 WHERE Username = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	if _, err = stmt.Exec(Username); err != nil {
+		return err
+	}
+
+	return nil
+
+}
+
+// Format a unix timestamp as a datetime (see components.DATETIME_REGEXP)
+func formatUnix(t int64) string {
+	return time.Unix(t, 0).Format("2006-01-02 15:04:05")
+}
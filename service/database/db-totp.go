@@ -0,0 +1,182 @@
+package database
+
+import (
+	"strings"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/totp"
+	"github.com/dchest/uniuri"
+)
+
+// Number of recovery codes generated when two-factor authentication is enabled
+const recoveryCodesCount = 10
+
+// Generate a new TOTP secret for the given user, to be confirmed with ConfirmTOTP. The secret is returned.
+// Returns components.ErrTOTPAlreadyEnabled if the user already enabled two-factor authentication.
+func (db appdbimpl) EnrollTOTP(Username string) (*string, error) {
+
+	var enabled bool
+	if err := db.c.QueryRow("SELECT TOTPEnabled FROM User WHERE Username = ?", Username).Scan(&enabled); err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, components.ErrTOTPAlreadyEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	stmt, err := db.c.Prepare("UPDATE User SET TOTPSecret = ?, TOTPLastStep = 0 WHERE Username = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	if _, err = stmt.Exec(secret, Username); err != nil {
+		return nil, err
+	}
+
+	return &secret, nil
+
+}
+
+// Enable two-factor authentication for the given user, provided that the code matches the secret generated by EnrollTOTP.
+// A fresh set of recovery codes is generated and returned: only their hashes are stored.
+func (db appdbimpl) ConfirmTOTP(Username string, Code string) (*[]string, error) {
+
+	var secret string
+	var enabled bool
+	var lastStep int64
+	if err := db.c.QueryRow("SELECT COALESCE(TOTPSecret, ''), TOTPEnabled, TOTPLastStep FROM User WHERE Username = ?", Username).Scan(&secret, &enabled, &lastStep); err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, components.ErrTOTPAlreadyEnabled
+	}
+	if secret == "" {
+		return nil, components.ErrTOTPNotEnabled
+	}
+
+	step, ok, err := totp.Validate(secret, Code, globaltime.Now(), lastStep)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, components.ErrWrongCode
+	}
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	res, err := tx.Exec("UPDATE User SET TOTPEnabled = 1, TOTPLastStep = ? WHERE Username = ? AND TOTPEnabled = 0 AND TOTPLastStep < ?", step, Username, step)
+	if err != nil {
+		return nil, err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 {
+		return nil, components.ErrWrongCode
+	}
+	if _, err = tx.Exec("DELETE FROM RecoveryCode WHERE Username = ?", Username); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodesCount)
+	for i := range codes {
+		codes[i] = strings.ToLower(uniuri.NewLen(10))
+		if _, err = tx.Exec("INSERT INTO RecoveryCode (Username, CodeHash) VALUES (?, ?)", Username, hashToken(codes[i])); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &codes, nil
+
+}
+
+// Disable two-factor authentication for the given user, dropping its secret and its recovery codes
+func (db appdbimpl) DisableTOTP(Username string) error {
+
+	tx, err := db.c.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if _, err = tx.Exec("UPDATE User SET TOTPSecret = NULL, TOTPEnabled = 0, TOTPLastStep = 0 WHERE Username = ?", Username); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM RecoveryCode WHERE Username = ?", Username); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+
+}
+
+// Check the second factor provided by the given user, either a TOTP code or one of its recovery codes (which is then consumed).
+// Returns components.ErrTOTPNotEnabled if the user did not enable two-factor authentication, components.ErrCodeRequired
+// if no code has been provided, components.ErrWrongCode if the code does not match.
+func (db appdbimpl) CheckSecondFactor(Username string, Code string) error {
+
+	var secret string
+	var enabled bool
+	var lastStep int64
+	if err := db.c.QueryRow("SELECT COALESCE(TOTPSecret, ''), TOTPEnabled, TOTPLastStep FROM User WHERE Username = ?", Username).Scan(&secret, &enabled, &lastStep); err != nil {
+		return err
+	}
+	if !enabled {
+		return components.ErrTOTPNotEnabled
+	}
+	if Code == "" {
+		return components.ErrCodeRequired
+	}
+
+	step, ok, err := totp.Validate(secret, Code, globaltime.Now(), lastStep)
+	if err != nil {
+		return err
+	}
+	if ok {
+		// Remember the time step of the code, so that it cannot be used again: if a concurrent request has used it (or a
+		// later one) in the meantime, no row is updated and the code is rejected
+		res, err := db.c.Exec("UPDATE User SET TOTPLastStep = ? WHERE Username = ? AND TOTPLastStep < ?", step, Username, step)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return components.ErrWrongCode
+		}
+		return nil
+	}
+
+	// Not a valid TOTP code, it may be a recovery code
+	res, err := db.c.Exec("DELETE FROM RecoveryCode WHERE Username = ? AND CodeHash = ?", Username, hashToken(strings.ToLower(Code)))
+	if err != nil {
+		return err
+	}
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return components.ErrWrongCode
+	}
+
+	return nil
+
+}
@@ -0,0 +1,145 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+	"github.com/dchest/uniuri"
+)
+
+// Start a resumable upload of a photo of the given size and digest for the given user. The upload expires if no chunk
+// is received within the given TTL.
+func (db appdbimpl) CreateUpload(Username string, Size int64, Digest string, TTL time.Duration) (*components.Upload, error) {
+
+	stmt, err := db.c.Prepare("INSERT INTO Upload (UploadID, Username, Size, Digest, Received, ExpiresAt) VALUES (?, ?, ?, ?, 0, ?)")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	expiresAt := globaltime.Now().Add(TTL).Unix()
+	upload := components.Upload{
+		UploadID:  uniuri.NewLen(64),
+		Size:      Size,
+		Digest:    Digest,
+		ExpiresAt: formatUnix(expiresAt),
+	}
+	if _, err = stmt.Exec(upload.UploadID, Username, Size, Digest, expiresAt); err != nil {
+		return nil, err
+	}
+
+	return &upload, nil
+
+}
+
+// Retrieve the upload of the given user with the given ID. Returns sql.ErrNoRows if the user has no such upload, or if
+// it has expired.
+func (db appdbimpl) GetUpload(Username string, UploadID string) (*components.Upload, error) {
+
+	stmt, err := db.c.Prepare("SELECT Size, Digest, Received, ExpiresAt FROM Upload WHERE UploadID = ? AND Username = ? AND ExpiresAt > ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	upload := components.Upload{UploadID: UploadID}
+	var expiresAt int64
+	if err = stmt.QueryRow(UploadID, Username, globaltime.Now().Unix()).Scan(&upload.Size, &upload.Digest, &upload.Offset, &expiresAt); err != nil {
+		return nil, err
+	}
+	upload.ExpiresAt = formatUnix(expiresAt)
+
+	return &upload, nil
+
+}
+
+// Count the uploads of the given user that have not expired, complete or not
+func (db appdbimpl) CountUploads(Username string) (*int, error) {
+
+	var count int
+	if err := db.c.QueryRow("SELECT COUNT(*) FROM Upload WHERE Username = ? AND ExpiresAt > ?", Username, globaltime.Now().Unix()).Scan(&count); err != nil {
+		return nil, err
+	}
+
+	return &count, nil
+
+}
+
+// Record a chunk of the given length received for the given upload, starting at the given offset, and postpone the
+// expiration of the upload by the given TTL. Returns sql.ErrNoRows if the user has no such upload (or it has expired),
+// components.ErrUploadOffset if the upload is not at the given offset (e.g., another chunk has been received meanwhile),
+// or if the chunk goes past the size of the upload.
+func (db appdbimpl) AdvanceUpload(Username string, UploadID string, Offset int64, Length int64, TTL time.Duration) (*components.Upload, error) {
+
+	now := globaltime.Now()
+	res, err := db.c.Exec(`UPDATE Upload SET Received = Received + ?, ExpiresAt = ?
+							WHERE UploadID = ? AND Username = ? AND ExpiresAt > ? AND Received = ? AND Received + ? <= Size`,
+		Length, now.Add(TTL).Unix(), UploadID, Username, now.Unix(), Offset, Length)
+	if err != nil {
+		return nil, err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if affected == 0 {
+		if _, err = db.GetUpload(Username, UploadID); err != nil {
+			return nil, err
+		}
+		return nil, components.ErrUploadOffset
+	}
+
+	return db.GetUpload(Username, UploadID)
+
+}
+
+// Delete the upload of the given user with the given ID. Returns sql.ErrNoRows if the user has no such upload.
+func (db appdbimpl) DeleteUpload(Username string, UploadID string) error {
+
+	res, err := db.c.Exec("DELETE FROM Upload WHERE UploadID = ? AND Username = ?", UploadID, Username)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+
+}
+
+// Delete the uploads that have expired
+func (db appdbimpl) DeleteExpiredUploads() error {
+
+	_, err := db.c.Exec("DELETE FROM Upload WHERE ExpiresAt <= ?", globaltime.Now().Unix())
+	return err
+
+}
+
+// Retrieve the IDs of all the uploads, expired or not
+func (db appdbimpl) GetUploadIDs() (*[]string, error) {
+
+	rows, err := db.c.Query("SELECT UploadID FROM Upload")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &ids, nil
+
+}
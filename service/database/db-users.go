@@ -4,17 +4,17 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"os/exec"
 
 	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/components"
 	"github.com/dchest/uniuri"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // If the user does not exist, it will be created, and an identifier is returned. If the user exists, the user identifier is returned.
 func (db appdbimpl) PostUserID(Username string) (*components.User, error) {
 
 	// Prepare the SQL statement
-	stmt, err := db.c.Prepare("SELECT ID, Username, ProfilePicPath, COALESCE(Birthdate, ''), COALESCE(Name, '') from User WHERE Username = ?")
+	stmt, err := db.c.Prepare("SELECT U.ID, U.Username, U.ProfilePicPath, COALESCE(U.Birthdate, ''), COALESCE(U.Name, ''), COALESCE(PB.BlurHash, ''), COALESCE(PB.Color, '') from User U LEFT JOIN Blob PB ON U.ProfilePicDigest = PB.Digest WHERE U.Username = ?")
 	if err != nil {
 		return nil, fmt.Errorf("error while preparing the SQL statement to obtain the id for the given user (if it exists)")
 	}
@@ -28,14 +28,14 @@ func (db appdbimpl) PostUserID(Username string) (*components.User, error) {
 		return nil, err
 	}
 
-	if err = row.Scan(&user.ID, &user.Username, &user.ProfilePic, &user.Birthdate, &user.Name); err != nil {
+	if err = row.Scan(&user.ID, &user.Username, &user.ProfilePic, &user.Birthdate, &user.Name, &user.ProfilePicPlaceholder.BlurHash, &user.ProfilePicPlaceholder.Color); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 
 			user.ID = uniuri.NewLen(64)
 			user.Username = Username
 			user.ProfilePic = "profile_pics/" + user.Username + ".png"
 
-			stmt, err = db.c.Prepare("INSERT INTO User (Username, ID, ProfilePicPath) VALUES (?, ?, ?)")
+			stmt, err = db.c.Prepare("INSERT INTO User (Username, ID, ProfilePicPath, ProfilePicDigest) VALUES (?, ?, ?, '')")
 			if err != nil {
 				return nil, err
 			}
@@ -44,15 +44,6 @@ func (db appdbimpl) PostUserID(Username string) (*components.User, error) {
 			if _, err = stmt.Exec(user.Username, user.ID, user.ProfilePic); err != nil {
 				return nil, err
 			}
-
-			// Make a copy of the default profile pic and rename it
-			srcFolder := "photos/profile_pics/default.png"
-			destFolder := "photos/" + user.ProfilePic
-			cpCmd := exec.Command("cp", "-rf", srcFolder, destFolder)
-			if err := cpCmd.Run(); err != nil {
-				return nil, err
-			}
-
 		} else {
 			return nil, err
 		}
@@ -61,6 +52,64 @@ func (db appdbimpl) PostUserID(Username string) (*components.User, error) {
 	return &user, nil
 }
 
+// Create a new user with the given username and password. Only a salted bcrypt hash of the password is stored.
+// Returns components.ErrUsernameTaken if a user with the given username already exists.
+func (db appdbimpl) PostUserWithPassword(Username string, Password string) (*components.User, error) {
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(Password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	user := components.User{
+		ID:         uniuri.NewLen(64),
+		Username:   Username,
+		ProfilePic: "profile_pics/" + Username + ".png",
+	}
+
+	stmt, err := db.c.Prepare(`INSERT INTO User (Username, ID, ProfilePicPath, ProfilePicDigest, PasswordHash)
+								SELECT ?, ?, ?, '', ? WHERE NOT EXISTS (SELECT 1 FROM User WHERE Username = ?)`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	res, err := stmt.Exec(user.Username, user.ID, user.ProfilePic, string(hash), user.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if affected == 0 {
+		return nil, components.ErrUsernameTaken
+	}
+
+	return &user, nil
+
+}
+
+// Check whether the given user signs in with single sign-on only: users linked to a subject of an OpenID Connect
+// provider are, and cannot login with a password (nor with just their username). Users who do not exist are not.
+func (db appdbimpl) IsSSOUser(Username string) (bool, error) {
+
+	stmt, err := db.c.Prepare("SELECT EXISTS (SELECT 1 FROM OIDCIdentity WHERE Username = ?)")
+	if err != nil {
+		return false, err
+	}
+	defer stmt.Close()
+
+	var linked bool
+	if err = stmt.QueryRow(Username).Scan(&linked); err != nil {
+		return false, err
+	}
+
+	return linked, nil
+
+}
+
 func (db appdbimpl) UpdateUsername(NewUsername string, OldUsername string) error {
 
 	stmt, err := db.c.Prepare("UPDATE User SET Username = ?, ProfilePicPath = ? WHERE Username = ?")
@@ -77,17 +126,16 @@ func (db appdbimpl) UpdateUsername(NewUsername string, OldUsername string) error
 
 }
 
-func (db appdbimpl) GetUsernameByToken(Id string) (*string, error) {
+func (db appdbimpl) GetOwnerUsernameOfComment(Id string) (*string, error) {
 
-	stmt, err := db.c.Prepare("SELECT Username FROM User WHERE ID = ?")
+	stmt, err := db.c.Prepare("SELECT Author FROM Comment WHERE CommentID = ?")
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
 
 	var username string
-	err = stmt.QueryRow(Id).Scan(&username)
-	if err != nil {
+	if err = stmt.QueryRow(Id).Scan(&username); err != nil {
 		return nil, err
 	}
 
@@ -95,19 +143,64 @@ func (db appdbimpl) GetUsernameByToken(Id string) (*string, error) {
 
 }
 
-func (db appdbimpl) GetOwnerUsernameOfComment(Id string) (*string, error) {
+// Set (or replace) the password of the given user. Only a salted bcrypt hash of the password is stored.
+func (db appdbimpl) SetUserPassword(Username string, Password string) error {
 
-	stmt, err := db.c.Prepare("SELECT Author FROM Comment WHERE CommentID = ?")
+	hash, err := bcrypt.GenerateFromPassword([]byte(Password), bcrypt.DefaultCost)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	stmt, err := db.c.Prepare("UPDATE User SET PasswordHash = ? WHERE Username = ?")
+	if err != nil {
+		return err
 	}
 	defer stmt.Close()
 
-	var username string
-	if err = stmt.QueryRow(Id).Scan(&username); err != nil {
-		return nil, err
+	res, err := stmt.Exec(string(hash), Username)
+	if err != nil {
+		return err
 	}
 
-	return &username, nil
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+
+}
+
+// Check the password of the given user.
+// Returns sql.ErrNoRows if the user does not exist, components.ErrNoPassword if the user has no password yet,
+// components.ErrWrongPassword if the password does not match.
+func (db appdbimpl) CheckUserPassword(Username string, Password string) error {
+
+	stmt, err := db.c.Prepare("SELECT COALESCE(PasswordHash, '') FROM User WHERE Username = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	var hash string
+	if err = stmt.QueryRow(Username).Scan(&hash); err != nil {
+		return err
+	}
+
+	if hash == "" {
+		return components.ErrNoPassword
+	}
+
+	if err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(Password)); err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return components.ErrWrongPassword
+		}
+		return err
+	}
+
+	return nil
 
 }
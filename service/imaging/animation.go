@@ -0,0 +1,177 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"time"
+)
+
+// ErrAnimation is returned by Policy.Apply when the animation has too many frames, lasts too long or is too large
+var ErrAnimation = errors.New("animation not allowed")
+
+// maxAnimationPixels is the number of pixels all the frames of an animation can add up to. Each frame is decoded on its
+// own image, as large as the canvas at most, so animations over it are rejected before being decoded.
+const maxAnimationPixels = 1 << 28
+
+// applyGIF brings the GIF (animated or not) to the aspect ratio and the resolution of the policy. GIFs are always
+// re-encoded, which drops their metadata (comments and application extensions, XMP included). The frames keep their
+// palettes, so no color is lost unless the frames have to be cropped, padded or scaled.
+func (p Policy) applyGIF(data []byte) ([]byte, error) {
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	count := countFrames(data)
+	if p.MaxFrames > 0 && count > p.MaxFrames {
+		return nil, ErrAnimation
+	}
+	if uint64(count)*uint64(config.Width)*uint64(config.Height) > maxAnimationPixels {
+		return nil, ErrAnimation
+	}
+
+	anim, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var duration time.Duration
+	for _, delay := range anim.Delay {
+		duration += time.Duration(delay) * 10 * time.Millisecond
+	}
+	if p.MaxDuration > 0 && duration > p.MaxDuration {
+		return nil, ErrAnimation
+	}
+
+	// Frames are transformed as displayed (composited on the previous ones), then brought back to their palette. Each
+	// frame then covers the whole canvas, and is cleared before the next one is drawn.
+	var out *gif.GIF
+	frames := newCompositor(anim)
+	for i := range anim.Image {
+		frame := frames.next()
+		img, err := p.transform(frame)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 && img == image.Image(frame) {
+			break // The canvas needs no transformation: the frames are kept as they are
+		}
+
+		if out == nil {
+			out = &gif.GIF{LoopCount: anim.LoopCount}
+		}
+		paletted := image.NewPaletted(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()), anim.Image[i].Palette)
+		draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), img, img.Bounds().Min)
+		out.Image = append(out.Image, paletted)
+		out.Delay = append(out.Delay, anim.Delay[i])
+		out.Disposal = append(out.Disposal, gif.DisposalBackground)
+	}
+	if out == nil {
+		out = anim
+	}
+
+	var buf bytes.Buffer
+	if err = gif.EncodeAll(&buf, out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// countFrames counts the frames of the GIF by walking its blocks, without decompressing them. Malformed or truncated
+// GIFs are counted up to where they go wrong, which gif.DecodeAll cannot go past either.
+func countFrames(data []byte) int {
+	// Header and logical screen descriptor, followed by the global color table if any
+	pos := 13
+	if len(data) < pos {
+		return 0
+	}
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << (flags&0x07 + 1)
+	}
+
+	count := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // Extension: label, then sub-blocks
+			pos += 2
+		case 0x2C: // Image descriptor, followed by the local color table if any, the LZW code size and sub-blocks
+			if pos+10 > len(data) {
+				return count
+			}
+			if flags := data[pos+9]; flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+			pos += 11
+			count++
+		default: // Trailer, or a block gif.DecodeAll rejects
+			return count
+		}
+		for pos < len(data) && data[pos] != 0 {
+			pos += int(data[pos]) + 1
+		}
+		pos++
+	}
+	return count
+}
+
+// firstFrame decodes the first frame of the GIF, as displayed: on the whole canvas
+func firstFrame(data []byte) (image.Image, error) {
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	frame, err := gif.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, config.Width, config.Height))
+	draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	return canvas, nil
+}
+
+// compositor draws the frames of an animation one after the other on its canvas, honouring their disposal methods
+type compositor struct {
+	anim     *gif.GIF
+	canvas   *image.RGBA
+	previous *image.RGBA // The canvas before the last frame, if it has to be restored
+	i        int
+}
+
+func newCompositor(anim *gif.GIF) *compositor {
+	return &compositor{anim: anim, canvas: image.NewRGBA(image.Rect(0, 0, anim.Config.Width, anim.Config.Height))}
+}
+
+// next returns the canvas with the next frame drawn. The canvas is reused by the following calls.
+func (c *compositor) next() *image.RGBA {
+	// Dispose of the previous frame
+	if c.i > 0 {
+		last := c.anim.Image[c.i-1]
+		switch c.disposal(c.i - 1) {
+		case gif.DisposalBackground:
+			draw.Draw(c.canvas, last.Bounds(), image.NewUniform(color.Transparent), image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			copy(c.canvas.Pix, c.previous.Pix)
+		}
+	}
+
+	frame := c.anim.Image[c.i]
+	if c.disposal(c.i) == gif.DisposalPrevious {
+		if c.previous == nil {
+			c.previous = image.NewRGBA(c.canvas.Bounds())
+		}
+		copy(c.previous.Pix, c.canvas.Pix)
+	}
+	draw.Draw(c.canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	c.i++
+	return c.canvas
+}
+
+func (c *compositor) disposal(i int) byte {
+	if i < len(c.anim.Disposal) {
+		return c.anim.Disposal[i]
+	}
+	return gif.DisposalNone
+}
@@ -0,0 +1,77 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"math/bits"
+	"strconv"
+)
+
+// Hash is the perceptual hash of a photo (a difference hash, or dHash): visually similar photos (e.g., the same photo
+// scaled, re-encoded or slightly retouched) have hashes differing in few bits
+type Hash uint64
+
+// hashWidth and hashHeight are the size the photos are shrunk to, in grayscale, before comparing each pixel with the one
+// on its right: 8 comparisons by 8 rows make the 64 bits of the hash
+const (
+	hashWidth  = 9
+	hashHeight = 8
+)
+
+// PerceptualHash decodes the photo and returns its perceptual hash (see Still.PerceptualHash)
+func PerceptualHash(data []byte) (Hash, error) {
+	still, err := DecodeStill(data)
+	if err != nil {
+		return 0, err
+	}
+	return still.PerceptualHash()
+}
+
+// PerceptualHash returns the perceptual hash of the photo (of the first frame, for animations)
+func (s *Still) PerceptualHash() (Hash, error) {
+	src := s.img
+	if bounds := src.Bounds(); bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return 0, image.ErrFormat
+	}
+
+	small := resize(src, hashWidth, hashHeight)
+	var hash Hash
+	for y := 0; y < hashHeight; y++ {
+		for x := 0; x < hashWidth-1; x++ {
+			hash <<= 1
+			if luma(small, x, y) < luma(small, x+1, y) {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// ParseHash parses a hash in the format of Hash.String
+func ParseHash(s string) (Hash, error) {
+	if len(s) != 16 {
+		return 0, fmt.Errorf("perceptual hash %q not made of 16 hex digits", s)
+	}
+	hash, err := strconv.ParseUint(s, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("perceptual hash %q not made of 16 hex digits", s)
+	}
+	return Hash(hash), nil
+}
+
+// String returns the hash as 16 hex digits
+func (h Hash) String() string {
+	return fmt.Sprintf("%016x", uint64(h))
+}
+
+// Distance returns the Hamming distance between the hashes: the number of bits they differ in, from 0 (the photos look
+// the same) to 64
+func (h Hash) Distance(other Hash) int {
+	return bits.OnesCount64(uint64(h ^ other))
+}
+
+// luma returns the luminance (ITU-R BT.601) of the given pixel, scaled by 1000
+func luma(img *image.RGBA, x int, y int) int {
+	i := img.PixOffset(x, y)
+	return 299*int(img.Pix[i]) + 587*int(img.Pix[i+1]) + 114*int(img.Pix[i+2])
+}
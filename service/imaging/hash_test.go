@@ -0,0 +1,146 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// scene returns a photo-like image of the given size: a diagonal gradient with a dark disc off center, drawn in
+// proportion to the size so that the same scene can be rendered at different resolutions
+func scene(width int, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			fx, fy := float64(x)/float64(width), float64(y)/float64(height)
+			v := uint8(40 + 180*(fx+fy)/2)
+			if dx, dy := fx-0.3, fy-0.6; dx*dx+dy*dy < 0.04 {
+				v = 20
+			}
+			i := img.PixOffset(x, y)
+			copy(img.Pix[i:], []byte{v, v / 2, 255 - v, 255})
+		}
+	}
+	return img
+}
+
+func encodeAs(t *testing.T, img image.Image, format string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 40})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPerceptualHashStable(t *testing.T) {
+	original, err := PerceptualHash(encodeAs(t, scene(640, 480), "png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"re-encoded as JPEG", encodeAs(t, scene(640, 480), "jpeg")},
+		{"shrunk", encodeAs(t, resize(scene(640, 480), 160, 120), "png")},
+		{"rendered smaller and re-encoded", encodeAs(t, scene(200, 150), "jpeg")},
+		{"enlarged", encodeAs(t, resize(scene(320, 240), 1280, 960), "png")},
+	}
+	for _, tt := range tests {
+		hash, err := PerceptualHash(tt.data)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if d := original.Distance(hash); d > 4 {
+			t.Errorf("%s: distance = %d, want at most 4", tt.name, d)
+		}
+	}
+
+	// A different photo is far from it
+	flipped := orient(scene(640, 480), 2)
+	hash, err := PerceptualHash(encodeAs(t, flipped, "png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := original.Distance(hash); d < 16 {
+		t.Errorf("mirrored photo: distance = %d, want at least 16", d)
+	}
+}
+
+func TestParseHash(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    Hash
+		wantErr bool
+	}{
+		{"0000000000000000", 0, false},
+		{"ffffffffffffffff", ^Hash(0), false},
+		{"00ff00ff00ff00ff", 0x00ff00ff00ff00ff, false},
+		{"00FF00FF00FF00FF", 0x00ff00ff00ff00ff, false},
+		{"", 0, true},
+		{"ff", 0, true},
+		{"00ff00ff00ff00ff0", 0, true},
+		{"00ff00ff00ff00fg", 0, true},
+		{"+0ff00ff00ff00ff", 0, true},
+		{"-0ff00ff00ff00ff", 0, true},
+		{"0x0ff00ff00ff00f", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseHash(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: error = %v, want error %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: hash = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+
+	// String and ParseHash round-trip
+	for _, h := range []Hash{0, 1, 0x8000000000000000, 0x0123456789abcdef} {
+		if got, err := ParseHash(h.String()); err != nil || got != h {
+			t.Errorf("%v: parsed back as %v, %v", h, got, err)
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	tests := []struct {
+		a, b Hash
+		want int
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{0, ^Hash(0), 64},
+		{0x00ff00ff00ff00ff, 0xff00ff00ff00ff00, 64},
+		{0x0123456789abcdef, 0x0123456789abcdee, 1},
+		{0xf0, 0x0f, 8},
+	}
+	for _, tt := range tests {
+		if got := tt.a.Distance(tt.b); got != tt.want {
+			t.Errorf("%v.Distance(%v) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := tt.b.Distance(tt.a); got != tt.want {
+			t.Errorf("%v.Distance(%v) = %d, want %d", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
+
+func TestPerceptualHashEmpty(t *testing.T) {
+	if _, err := (&Still{img: image.NewRGBA(image.Rect(0, 0, 0, 0))}).PerceptualHash(); err == nil {
+		t.Error("empty image hashed")
+	}
+	if _, err := PerceptualHash([]byte("not an image")); err == nil {
+		t.Error("data not an image hashed")
+	}
+}
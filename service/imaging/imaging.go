@@ -0,0 +1,190 @@
+/*
+Package imaging processes the uploaded photos (JPEG, PNG, WebP and GIF, animated or not), using the standard image
+packages and the WebP decoder of golang.org/x/image.
+
+A Policy drops the metadata of the photos (EXIF, with GPS coordinates, XMP and the like, keeping aside the few
+harmless tags configured), turns them upright according to their EXIF orientation, brings them to the configured aspect
+ratio (rejecting, cropping or padding the ones not in it) and scales down the ones above the configured resolution.
+Animations with more frames or lasting longer than configured are rejected.
+
+Renditions are then generated: smaller copies, of fixed widths (Widths for the photos of the posts, ProfilePicWidths for
+the profile pics), clients can download instead of the originals (e.g., thumbnails in the stream). Renditions keep the
+aspect ratio of the original, and are never larger than it: an original narrower than a width has no rendition of that
+width. Renditions of JPEGs are JPEGs, the others are PNGs (animations get still renditions, of their first frame).
+
+A PerceptualHash of the photos is computed too, so that near-duplicates (the same photo scaled, re-encoded or slightly
+retouched) can be found by the Hamming distance of their hashes, and a Placeholder (a BlurHash and the dominant color)
+clients can show while loading them. The renditions, the hash and the placeholder are all computed from a Still, so
+that the photo is decoded once for the three.
+*/
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"path"
+	"strconv"
+	"strings"
+
+	_ "golang.org/x/image/webp" // Blank import for decoding WebP images with the image package
+)
+
+// Widths are the widths (in pixels) of the renditions of the photos of the posts, narrowest first
+var Widths = []int{320, 640, 1280}
+
+// ProfilePicWidths are the widths (in pixels) of the renditions of the profile pics (small and large), narrowest first
+var ProfilePicWidths = []int{128, 512}
+
+// JPEG quality the renditions of JPEG photos are encoded with
+const jpegQuality = 85
+
+// ErrUnsupportedFormat is returned when the photo is not in a format renditions can be encoded in
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+
+// Rendition is an encoded rendition of a photo
+type Rendition struct {
+	Width  int
+	Height int
+	Data   []byte
+}
+
+// IsWidth reports whether renditions of the given width are generated, either for posts or for profile pics
+func IsWidth(width int) bool {
+	for _, w := range AllWidths() {
+		if w == width {
+			return true
+		}
+	}
+	return false
+}
+
+// AllWidths returns the widths of the renditions of both the posts and the profile pics
+func AllWidths() []int {
+	return append(append([]int(nil), Widths...), ProfilePicWidths...)
+}
+
+// RenditionPath returns the path the rendition of the given width of the photo at the given path is stored at: next to
+// the original, with the width before the extension (e.g., "posts/1.w320.png")
+func RenditionPath(photoPath string, width int) string {
+	ext := path.Ext(photoPath)
+	return strings.TrimSuffix(photoPath, ext) + ".w" + strconv.Itoa(width) + ext
+}
+
+// Still is a photo decoded as a still image (its first frame, for animations), which its renditions, its perceptual
+// hash and its placeholder are computed from
+type Still struct {
+	img    image.Image
+	format string
+}
+
+// DecodeStill decodes the photo as a still image. Returns ErrTooManyPixels, without decoding it, if the photo exceeds
+// MaxDecodePixels.
+func DecodeStill(data []byte) (*Still, error) {
+	img, format, err := decodeStill(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Still{img: img, format: format}, nil
+}
+
+// Renditions returns the renditions of the photo of the given widths (e.g., Widths), narrowest first
+func (s *Still) Renditions(widths []int) ([]Rendition, error) {
+	var renditions []Rendition
+	bounds := s.img.Bounds()
+	for _, width := range widths {
+		if width >= bounds.Dx() {
+			break
+		}
+		height := (bounds.Dy()*width + bounds.Dx()/2) / bounds.Dx()
+		if height < 1 {
+			height = 1
+		}
+
+		var buf bytes.Buffer
+		var err error
+		dst := resize(s.img, width, height)
+		if s.format == "jpeg" {
+			err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: jpegQuality})
+		} else {
+			err = png.Encode(&buf, dst)
+		}
+		if err != nil {
+			return nil, err
+		}
+		renditions = append(renditions, Rendition{Width: width, Height: height, Data: buf.Bytes()})
+	}
+	return renditions, nil
+}
+
+// decodeStill decodes the photo, returning its format too. Animations are decoded as their first frame. Returns
+// ErrTooManyPixels, without decoding it, if the photo exceeds MaxDecodePixels.
+func decodeStill(data []byte) (image.Image, string, error) {
+	if err := checkPixels(data, MaxDecodePixels); err != nil {
+		return nil, "", err
+	}
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	switch format {
+	case "jpeg", "png", "webp":
+	case "gif":
+		if src, err = firstFrame(data); err != nil {
+			return nil, "", err
+		}
+	default:
+		return nil, "", ErrUnsupportedFormat
+	}
+	return src, format, nil
+}
+
+// resize scales the image down to the given size. Each pixel of the result is the average of the pixels of the source
+// it covers (box filter), which is as good as it gets when shrinking, without external packages.
+func resize(src image.Image, width int, height int) *image.RGBA {
+	bounds := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	}
+	srcW, srcH := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+	origin := rgba.Bounds().Min
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcH/height, (y+1)*srcH/height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcW/width, (x+1)*srcW/width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				i := rgba.PixOffset(origin.X+x0, origin.Y+sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(rgba.Pix[i])
+					g += uint64(rgba.Pix[i+1])
+					b += uint64(rgba.Pix[i+2])
+					a += uint64(rgba.Pix[i+3])
+					n++
+					i += 4
+				}
+			}
+
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(r / n)
+			dst.Pix[j+1] = uint8(g / n)
+			dst.Pix[j+2] = uint8(b / n)
+			dst.Pix[j+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,311 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"strings"
+	"time"
+)
+
+// EXIFTags are the names of the EXIF tags that can be kept (see Policy.KeepEXIF): plain text tags telling nothing
+// about where the photo has been taken
+var EXIFTags = []string{"Make", "Model", "Software", "DateTime", "DateTimeOriginal", "LensModel"}
+
+// IDs of the EXIF tags read from the photos
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagSoftware         = 0x0131
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagDateTimeOriginal = 0x9003
+	tagLensModel        = 0xa434
+)
+
+var exifTagNames = map[uint16]string{
+	tagMake:             "Make",
+	tagModel:            "Model",
+	tagSoftware:         "Software",
+	tagDateTime:         "DateTime",
+	tagDateTimeOriginal: "DateTimeOriginal",
+	tagLensModel:        "LensModel",
+}
+
+// metadata is what is read from the metadata of a photo before dropping it
+type metadata struct {
+	// orientation is the EXIF orientation (1 to 8, 1 being upright)
+	orientation int
+
+	// tags are the text EXIF tags, by name
+	tags map[string]string
+}
+
+// stripMetadata returns the photo without its metadata (EXIF, XMP, IPTC, comments and text chunks), and what has been
+// read from it. The pixels are left untouched: segments and chunks are dropped without re-encoding. GIFs are returned as
+// they are: their metadata is dropped when they are re-encoded (see Policy.Apply).
+func stripMetadata(data []byte) ([]byte, *metadata, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8")):
+		return stripJPEG(data)
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		stripped, err := stripPNG(data)
+		return stripped, &metadata{orientation: 1}, err
+	case len(data) >= 12 && bytes.HasPrefix(data, []byte("RIFF")) && string(data[8:12]) == "WEBP":
+		return stripWebP(data)
+	default:
+		return data, &metadata{orientation: 1}, nil
+	}
+}
+
+// stripJPEG drops the APPn segments but APP0 (JFIF), APP2 (ICC profile) and APP14 (Adobe, telling how colors are
+// encoded), and the comments. EXIF is read from APP1 before dropping it.
+func stripJPEG(data []byte) ([]byte, *metadata, error) {
+	meta := &metadata{orientation: 1}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:2])
+
+	i := 2
+	for {
+		// Markers can be preceded by any number of fill bytes
+		for i < len(data) && data[i] == 0xff && i+1 < len(data) && data[i+1] == 0xff {
+			i++
+		}
+		if i+4 > len(data) || data[i] != 0xff {
+			return nil, nil, fmt.Errorf("%w: malformed JPEG segment", image.ErrFormat)
+		}
+		marker := data[i+1]
+
+		// Start of scan: the rest is the entropy-coded image, with no more metadata than EOI
+		if marker == 0xda {
+			out.Write(data[i:])
+			return out.Bytes(), meta, nil
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		end := i + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, nil, fmt.Errorf("%w: malformed JPEG segment", image.ErrFormat)
+		}
+		payload := data[i+4 : end]
+
+		switch {
+		case marker == 0xe1:
+			if bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+				readEXIF(payload[6:], meta)
+			}
+		case marker >= 0xe0 && marker <= 0xef && marker != 0xe0 && marker != 0xe2 && marker != 0xee, marker == 0xfe:
+			// Other metadata segment, or comment: dropped
+		default:
+			out.Write(data[i:end])
+		}
+		i = end
+	}
+}
+
+// readEXIF reads the orientation and the text tags from the TIFF structure of an EXIF segment. Malformed EXIF is
+// ignored: at worst, the photo is left as it is and no tag is kept.
+func readEXIF(tiff []byte, meta *metadata) {
+	if len(tiff) < 8 {
+		return
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return
+	}
+
+	// readIFD calls visit for each entry of the IFD at the given offset, with the value of text entries resolved
+	readIFD := func(offset uint32, visit func(tag uint16, typ uint16, value []byte)) {
+		if offset < 8 || uint64(offset)+2 > uint64(len(tiff)) {
+			return
+		}
+		n := int(order.Uint16(tiff[offset:]))
+		for e := 0; e < n; e++ {
+			entry := int(offset) + 2 + 12*e
+			if entry+12 > len(tiff) {
+				return
+			}
+			tag, typ, count := order.Uint16(tiff[entry:]), order.Uint16(tiff[entry+2:]), order.Uint32(tiff[entry+4:])
+			value := tiff[entry+8 : entry+12]
+
+			// Text values longer than 4 bytes are stored elsewhere, at the offset found in the entry
+			if typ == 2 && count > 4 {
+				start := order.Uint32(value)
+				if uint64(start)+uint64(count) > uint64(len(tiff)) {
+					continue
+				}
+				value = tiff[start : start+count]
+			} else if typ == 2 {
+				value = value[:count]
+			}
+			visit(tag, typ, value)
+		}
+	}
+
+	var exifIFD uint32
+	visit := func(tag uint16, typ uint16, value []byte) {
+		switch {
+		case tag == tagOrientation && typ == 3:
+			if o := int(order.Uint16(value)); o >= 1 && o <= 8 {
+				meta.orientation = o
+			}
+		case tag == tagExifIFD && typ == 4:
+			exifIFD = order.Uint32(value)
+		case typ == 2 && exifTagNames[tag] != "":
+			text := strings.TrimSpace(strings.TrimRight(string(value), "\x00"))
+			if tag == tagDateTime || tag == tagDateTimeOriginal {
+				// Dates are brought to the format used everywhere else, dropped if not valid
+				t, err := time.Parse("2006:01:02 15:04:05", text)
+				if err != nil {
+					return
+				}
+				text = t.Format("2006-01-02 15:04:05")
+			}
+			if text != "" {
+				if meta.tags == nil {
+					meta.tags = make(map[string]string)
+				}
+				meta.tags[exifTagNames[tag]] = text
+			}
+		}
+	}
+
+	ifd0 := order.Uint32(tiff[4:])
+	readIFD(ifd0, visit)
+	if exifIFD != 0 && exifIFD != ifd0 {
+		readIFD(exifIFD, visit)
+	}
+}
+
+// stripPNG drops the text chunks (tEXt, zTXt, iTXt: XMP lives there), the EXIF chunk (eXIf) and the modification time
+// (tIME)
+func stripPNG(data []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:8])
+
+	for i := 8; i < len(data); {
+		if i+12 > len(data) {
+			return nil, fmt.Errorf("%w: malformed PNG chunk", image.ErrFormat)
+		}
+		length := binary.BigEndian.Uint32(data[i:])
+		end := uint64(i) + 12 + uint64(length)
+		if end > uint64(len(data)) {
+			return nil, fmt.Errorf("%w: malformed PNG chunk", image.ErrFormat)
+		}
+		switch string(data[i+4 : i+8]) {
+		case "tEXt", "zTXt", "iTXt", "eXIf", "tIME":
+			// Metadata: dropped
+		default:
+			out.Write(data[i:end])
+		}
+		i = int(end)
+	}
+	return out.Bytes(), nil
+}
+
+// Flags of the VP8X chunk of extended WebP files telling that EXIF and XMP chunks follow, and that the file is animated
+const (
+	webpFlagEXIF      = 0x08
+	webpFlagXMP       = 0x04
+	webpFlagAnimation = 0x02
+)
+
+// stripWebP drops the EXIF and XMP chunks of the RIFF container, clearing their flags in the VP8X chunk. EXIF is read
+// before dropping it.
+func stripWebP(data []byte) ([]byte, *metadata, error) {
+	meta := &metadata{orientation: 1}
+	out := bytes.NewBuffer(make([]byte, 0, len(data)))
+	out.Write(data[:12])
+
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, nil, fmt.Errorf("%w: malformed WebP chunk", image.ErrFormat)
+		}
+		length := binary.LittleEndian.Uint32(data[i+4:])
+		end := uint64(i) + 8 + uint64(length) + uint64(length&1) // Chunks are padded to an even size
+		if end > uint64(len(data)) {
+			// The padding byte of the last chunk is sometimes missing
+			if end-1 != uint64(len(data)) || length&1 == 0 {
+				return nil, nil, fmt.Errorf("%w: malformed WebP chunk", image.ErrFormat)
+			}
+			end--
+		}
+		chunk := data[i:end]
+		switch string(chunk[:4]) {
+		case "EXIF":
+			payload := chunk[8 : 8+length]
+			readEXIF(bytes.TrimPrefix(payload, []byte("Exif\x00\x00")), meta)
+		case "XMP ":
+			// Metadata: dropped
+		case "VP8X":
+			if length < 1 {
+				return nil, nil, fmt.Errorf("%w: malformed WebP chunk", image.ErrFormat)
+			}
+			if chunk[8]&webpFlagAnimation != 0 {
+				return nil, nil, fmt.Errorf("%w: animated WebP not supported", image.ErrFormat)
+			}
+			start := out.Len()
+			out.Write(chunk)
+			out.Bytes()[start+8] &^= webpFlagEXIF | webpFlagXMP
+		default:
+			out.Write(chunk)
+		}
+		i = int(end)
+	}
+
+	// The size of the RIFF container changes with the chunks dropped
+	stripped := out.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:], uint32(len(stripped)-8))
+	return stripped, meta, nil
+}
+
+// orient applies the EXIF orientation to the pixels, returning an upright image
+func orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	w, h := b.Dx(), b.Dy()
+
+	// Orientations 5 to 8 swap width and height
+	dstW, dstH := w, h
+	if orientation >= 5 {
+		dstW, dstH = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+
+	for y := 0; y < dstH; y++ {
+		for x := 0; x < dstW; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				sx, sy = w-1-x, y
+			case 3: // Rotated 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // Mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // Mirrored along the main diagonal
+				sx, sy = y, x
+			case 6: // To be rotated 90° clockwise
+				sx, sy = y, h-1-x
+			case 7: // Mirrored along the anti-diagonal
+				sx, sy = w-1-y, h-1-x
+			case 8: // To be rotated 90° counterclockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
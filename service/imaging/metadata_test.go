@@ -0,0 +1,443 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// ifdEntry is an entry of an IFD built by buildTIFF. Text values longer than 4 bytes are stored after the IFDs.
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte // Short and long values are written as they are (in the byte order of the TIFF)
+}
+
+func textEntry(tag uint16, text string) ifdEntry {
+	return ifdEntry{tag: tag, typ: 2, count: uint32(len(text) + 1), value: append([]byte(text), 0)}
+}
+
+func shortEntry(order binary.ByteOrder, tag uint16, v uint16) ifdEntry {
+	value := make([]byte, 4)
+	order.PutUint16(value, v)
+	return ifdEntry{tag: tag, typ: 3, count: 1, value: value}
+}
+
+// buildTIFF returns the TIFF structure of an EXIF segment, with IFD0 and, if any entry is given, the EXIF IFD
+func buildTIFF(order binary.ByteOrder, ifd0 []ifdEntry, exif []ifdEntry) []byte {
+	ifdSize := func(entries []ifdEntry) int { return 2 + 12*len(entries) + 4 }
+	if len(exif) > 0 {
+		ifd0 = append(ifd0, ifdEntry{tag: tagExifIFD, typ: 4, count: 1})
+	}
+	exifOffset := 8 + ifdSize(ifd0)
+	dataOffset := exifOffset
+	if len(exif) > 0 {
+		dataOffset += ifdSize(exif)
+	}
+
+	var data []byte
+	header := make([]byte, 8)
+	if order == binary.LittleEndian {
+		copy(header, "II")
+	} else {
+		copy(header, "MM")
+	}
+	order.PutUint16(header[2:], 42)
+	order.PutUint32(header[4:], 8)
+
+	writeIFD := func(entries []ifdEntry) []byte {
+		ifd := make([]byte, ifdSize(entries))
+		order.PutUint16(ifd, uint16(len(entries)))
+		for i, e := range entries {
+			entry := ifd[2+12*i:]
+			order.PutUint16(entry, e.tag)
+			order.PutUint16(entry[2:], e.typ)
+			order.PutUint32(entry[4:], e.count)
+			switch {
+			case e.tag == tagExifIFD && e.value == nil:
+				order.PutUint32(entry[8:], uint32(exifOffset))
+			case len(e.value) > 4:
+				order.PutUint32(entry[8:], uint32(dataOffset+len(data)))
+				data = append(data, e.value...)
+			default:
+				copy(entry[8:], e.value)
+			}
+		}
+		return ifd
+	}
+	tiff := append(header, writeIFD(ifd0)...)
+	if len(exif) > 0 {
+		tiff = append(tiff, writeIFD(exif)...)
+	}
+	return append(tiff, data...)
+}
+
+// withSegments inserts the given segments (marker, then payload) right after the SOI of the JPEG
+func withSegments(jpg []byte, segments ...[]byte) []byte {
+	out := append([]byte{}, jpg[:2]...)
+	for _, s := range segments {
+		length := make([]byte, 2)
+		binary.BigEndian.PutUint16(length, uint16(len(s)-1+2))
+		out = append(out, 0xff, s[0])
+		out = append(out, length...)
+		out = append(out, s[1:]...)
+	}
+	return append(out, jpg[2:]...)
+}
+
+func exifSegment(tiff []byte) []byte {
+	return append([]byte{0xe1}, append([]byte("Exif\x00\x00"), tiff...)...)
+}
+
+// quadrants is a 64x32 image with a color per quadrant: red, green (top), blue, white (bottom). Blocks this large
+// survive JPEG compression well enough to be told apart.
+var quadrants = [4]color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {255, 255, 255, 255}}
+
+func quadrantsJPEG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, quadrants[2*(y/16)+x/32])
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// quadrantAt returns which of the quadrants colors the pixel is closest to
+func quadrantAt(img image.Image, x int, y int) int {
+	r, g, b, _ := img.At(x, y).RGBA()
+	best, bestDist := -1, 1<<62
+	for i, c := range quadrants {
+		dr, dg, db := int(r>>8)-int(c.R), int(g>>8)-int(c.G), int(b>>8)-int(c.B)
+		if dist := dr*dr + dg*dg + db*db; dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	return best
+}
+
+func TestOrientation(t *testing.T) {
+	// Where the top left and top right quadrants of the stored photo are displayed (0 to 3: top left, top right,
+	// bottom left, bottom right), as defined by the EXIF specification
+	tests := []struct {
+		orientation       int
+		topLeft, topRight int
+	}{
+		{1, 0, 1},
+		{2, 1, 0}, // Mirrored horizontally
+		{3, 3, 2}, // Rotated 180°
+		{4, 2, 3}, // Mirrored vertically
+		{5, 0, 2}, // Mirrored along the main diagonal
+		{6, 1, 3}, // To be rotated 90° clockwise
+		{7, 3, 1}, // Mirrored along the anti-diagonal
+		{8, 2, 0}, // To be rotated 90° counterclockwise
+	}
+	stored := quadrantsJPEG(t)
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		for _, tt := range tests {
+			tiff := buildTIFF(order, []ifdEntry{shortEntry(order, tagOrientation, uint16(tt.orientation))}, nil)
+			out, _, err := Policy{}.Apply(withSegments(stored, exifSegment(tiff)))
+			if err != nil {
+				t.Fatalf("orientation %d (%v): %v", tt.orientation, order, err)
+			}
+			img, err := jpeg.Decode(bytes.NewReader(out))
+			if err != nil {
+				t.Fatalf("orientation %d (%v): %v", tt.orientation, order, err)
+			}
+
+			w, h := 64, 32
+			if tt.orientation >= 5 {
+				w, h = 32, 64
+			}
+			if img.Bounds().Dx() != w || img.Bounds().Dy() != h {
+				t.Errorf("orientation %d (%v): size = %v, want %dx%d", tt.orientation, order, img.Bounds().Size(), w, h)
+				continue
+			}
+
+			// Centers of the displayed quadrants
+			centers := [4]image.Point{{w / 4, h / 4}, {3 * w / 4, h / 4}, {w / 4, 3 * h / 4}, {3 * w / 4, 3 * h / 4}}
+			if q := quadrantAt(img, centers[tt.topLeft].X, centers[tt.topLeft].Y); q != 0 {
+				t.Errorf("orientation %d (%v): top left quadrant displayed at %d, found quadrant %d there", tt.orientation, order, tt.topLeft, q)
+			}
+			if q := quadrantAt(img, centers[tt.topRight].X, centers[tt.topRight].Y); q != 1 {
+				t.Errorf("orientation %d (%v): top right quadrant displayed at %d, found quadrant %d there", tt.orientation, order, tt.topRight, q)
+			}
+		}
+	}
+}
+
+func TestReadEXIF(t *testing.T) {
+	order := binary.BigEndian
+	tiff := buildTIFF(order,
+		[]ifdEntry{
+			textEntry(tagMake, "Fujifilm"),
+			textEntry(tagModel, "X"), // Stored in the entry itself
+			shortEntry(order, tagOrientation, 6),
+			textEntry(tagDateTime, "not a date"),
+			textEntry(0x010e, "ImageDescription, never kept"),
+		},
+		[]ifdEntry{
+			textEntry(tagDateTimeOriginal, "2023:05:17 10:20:30"),
+			textEntry(tagLensModel, "  XF35mmF1.4 R  "),
+		})
+
+	meta := &metadata{orientation: 1}
+	readEXIF(tiff, meta)
+	if meta.orientation != 6 {
+		t.Errorf("orientation = %d, want 6", meta.orientation)
+	}
+	want := map[string]string{
+		"Make":             "Fujifilm",
+		"Model":            "X",
+		"DateTimeOriginal": "2023-05-17 10:20:30",
+		"LensModel":        "XF35mmF1.4 R",
+	}
+	if len(meta.tags) != len(want) {
+		t.Errorf("tags = %v, want %v", meta.tags, want)
+	}
+	for name, value := range want {
+		if meta.tags[name] != value {
+			t.Errorf("%s = %q, want %q", name, meta.tags[name], value)
+		}
+	}
+
+	// Only the tags in KeepEXIF are returned by Apply
+	_, tags, err := Policy{KeepEXIF: []string{"Make", "DateTimeOriginal", "Software"}}.Apply(withSegments(quadrantsJPEG(t), exifSegment(tiff)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 2 || tags["Make"] != "Fujifilm" || tags["DateTimeOriginal"] != "2023-05-17 10:20:30" {
+		t.Errorf("tags kept = %v", tags)
+	}
+}
+
+func TestReadEXIFMalformed(t *testing.T) {
+	order := binary.LittleEndian
+	valid := buildTIFF(order, []ifdEntry{shortEntry(order, tagOrientation, 3), textEntry(tagMake, "Fujifilm")}, nil)
+	with := func(edit func(tiff []byte)) []byte {
+		tiff := append([]byte{}, valid...)
+		edit(tiff)
+		return tiff
+	}
+	// Offsets of the fields of IFD0 and of its entries
+	const count, orientation, makeEntry = 8, 10, 22
+
+	tests := []struct {
+		name            string
+		tiff            []byte
+		wantOrientation int
+		wantMake        string
+	}{
+		{"empty", nil, 1, ""},
+		{"header only", valid[:6], 1, ""},
+		{"unknown byte order", with(func(b []byte) { copy(b, "XX") }), 1, ""},
+		{"IFD inside the header", with(func(b []byte) { order.PutUint32(b[4:], 4) }), 1, ""},
+		{"IFD past the end", with(func(b []byte) { order.PutUint32(b[4:], uint32(len(b))) }), 1, ""},
+		{"IFD offset overflowing", with(func(b []byte) { order.PutUint32(b[4:], 0xffffffff) }), 1, ""},
+		{"entries truncated", valid[:makeEntry+6], 3, ""},
+		{"more entries than the data holds", with(func(b []byte) { order.PutUint16(b[count:], 0xffff) }), 3, "Fujifilm"},
+		{"text past the end", with(func(b []byte) { order.PutUint32(b[makeEntry+8:], uint32(len(b)-2)) }), 3, ""},
+		{"text offset overflowing", with(func(b []byte) { order.PutUint32(b[makeEntry+8:], 0xfffffffe) }), 3, ""},
+		{"text length overflowing", with(func(b []byte) { order.PutUint32(b[makeEntry+4:], 0xffffffff) }), 3, ""},
+		{"orientation out of range", with(func(b []byte) { order.PutUint16(b[orientation+8:], 9) }), 1, "Fujifilm"},
+		{"orientation not a short", with(func(b []byte) { order.PutUint16(b[orientation+2:], 4) }), 1, "Fujifilm"},
+		{"EXIF IFD pointing to IFD0", buildTIFF(order, []ifdEntry{{tag: tagExifIFD, typ: 4, count: 1, value: []byte{8, 0, 0, 0}}}, nil), 1, ""},
+	}
+	for _, tt := range tests {
+		meta := &metadata{orientation: 1}
+		readEXIF(tt.tiff, meta)
+		if meta.orientation != tt.wantOrientation {
+			t.Errorf("%s: orientation = %d, want %d", tt.name, meta.orientation, tt.wantOrientation)
+		}
+		if meta.tags["Make"] != tt.wantMake {
+			t.Errorf("%s: Make = %q, want %q", tt.name, meta.tags["Make"], tt.wantMake)
+		}
+	}
+
+	// A malformed EXIF segment leaves the photo as it is
+	stored := quadrantsJPEG(t)
+	out, _, err := Policy{}.Apply(withSegments(stored, exifSegment(valid[:makeEntry+6])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("photo with malformed EXIF not decoded: %v", err)
+	}
+}
+
+func TestStripJPEG(t *testing.T) {
+	stored := quadrantsJPEG(t)
+	tiff := buildTIFF(binary.BigEndian, []ifdEntry{textEntry(tagMake, "Fujifilm")}, nil)
+	icc := append([]byte{0xe2}, []byte("ICC_PROFILE\x00 kept")...)
+	data := withSegments(stored,
+		exifSegment(tiff),
+		append([]byte{0xe1}, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>")...),
+		append([]byte{0xed}, []byte("Photoshop 3.0\x00IPTC")...),
+		icc,
+		append([]byte{0xfe}, []byte("a comment")...),
+	)
+
+	stripped, meta, err := stripMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.tags["Make"] != "Fujifilm" {
+		t.Errorf("EXIF not read before being dropped: %v", meta.tags)
+	}
+	for _, dropped := range []string{"Exif", "xmpmeta", "IPTC", "a comment"} {
+		if bytes.Contains(stripped, []byte(dropped)) {
+			t.Errorf("%s not dropped", dropped)
+		}
+	}
+	if !bytes.Contains(stripped, []byte("ICC_PROFILE\x00 kept")) {
+		t.Error("ICC profile dropped")
+	}
+	if !bytes.Equal(stripped, withSegments(stored, icc)) {
+		t.Error("segments other than the metadata changed")
+	}
+
+	// Fill bytes before a marker are skipped
+	filled := append([]byte{0xff, 0xd8, 0xff, 0xff}, withSegments(stored, append([]byte{0xfe}, "comment"...))[2:]...)
+	if stripped, _, err = stripMetadata(filled); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stripped, []byte("comment")) {
+		t.Error("comment after fill bytes not dropped")
+	}
+
+	for name, malformed := range map[string][]byte{
+		"truncated segment":   withSegments(stored, icc)[:10],
+		"segment too short":   append([]byte{0xff, 0xd8, 0xff, 0xe2, 0x00, 0x01}, stored[2:]...),
+		"no marker":           append([]byte{0xff, 0xd8, 0x00, 0x00, 0x00, 0x00}, stored[2:]...),
+		"no start of scan":    stored[:20],
+		"nothing but the SOI": stored[:2],
+	} {
+		if _, _, err := stripMetadata(malformed); !errors.Is(err, image.ErrFormat) {
+			t.Errorf("%s: error = %v, want %v", name, err, image.ErrFormat)
+		}
+	}
+}
+
+// pngChunk returns a PNG chunk (its CRC is not checked by stripPNG, and left zero)
+func pngChunk(typ string, payload string) []byte {
+	chunk := make([]byte, 8, 12+len(payload))
+	binary.BigEndian.PutUint32(chunk, uint32(len(payload)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, payload...)
+	return append(chunk, 0, 0, 0, 0)
+}
+
+func TestStripPNG(t *testing.T) {
+	stored := encodePNG(t, 4, 4)
+	iend := len(stored) - 12
+	var metadataChunks []byte
+	for _, typ := range []string{"tEXt", "zTXt", "iTXt", "eXIf", "tIME"} {
+		metadataChunks = append(metadataChunks, pngChunk(typ, typ+" metadata")...)
+	}
+	data := append(append(append([]byte{}, stored[:iend]...), metadataChunks...), stored[iend:]...)
+
+	stripped, meta, err := stripMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.orientation != 1 {
+		t.Errorf("orientation = %d, want 1", meta.orientation)
+	}
+	if !bytes.Equal(stripped, stored) {
+		t.Error("PNG not stripped to its original chunks")
+	}
+	if _, err = png.Decode(bytes.NewReader(stripped)); err != nil {
+		t.Errorf("stripped PNG not decoded: %v", err)
+	}
+
+	for name, malformed := range map[string][]byte{
+		"truncated chunk header": stored[:len(stored)-4],
+		"chunk past the end":     append(append([]byte{}, stored[:iend]...), pngChunk("tEXt", "text")[:10]...),
+		"length overflowing":     append(append([]byte{}, stored[:iend]...), 0xff, 0xff, 0xff, 0xff, 't', 'E', 'X', 't', 0, 0, 0, 0),
+	} {
+		if _, _, err := stripMetadata(malformed); !errors.Is(err, image.ErrFormat) {
+			t.Errorf("%s: error = %v, want %v", name, err, image.ErrFormat)
+		}
+	}
+}
+
+// webpChunk returns a chunk of a RIFF container, padded to an even size
+func webpChunk(typ string, payload []byte) []byte {
+	chunk := make([]byte, 8, 9+len(payload))
+	copy(chunk, typ)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(payload)))
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// webp returns a RIFF WebP container holding the given chunks. The image data is not valid: stripWebP only walks the
+// chunks.
+func webp(chunks ...[]byte) []byte {
+	data := []byte("RIFF\x00\x00\x00\x00WEBP")
+	for _, c := range chunks {
+		data = append(data, c...)
+	}
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+	return data
+}
+
+func TestStripWebP(t *testing.T) {
+	vp8x := func(flags byte) []byte { return webpChunk("VP8X", []byte{flags, 0, 0, 0, 3, 0, 0, 3, 0, 0}) }
+	bitstream := webpChunk("VP8L", []byte("lossless bitstream"))
+	tiff := buildTIFF(binary.LittleEndian, []ifdEntry{shortEntry(binary.LittleEndian, tagOrientation, 8)}, nil)
+	iccp := webpChunk("ICCP", []byte("profile"))
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"EXIF with its header", webp(vp8x(webpFlagEXIF|webpFlagXMP|0x20), iccp, bitstream, webpChunk("EXIF", append([]byte("Exif\x00\x00"), tiff...)), webpChunk("XMP ", []byte("<x:xmpmeta/>")))},
+		{"EXIF without its header", webp(vp8x(webpFlagEXIF|webpFlagXMP|0x20), iccp, bitstream, webpChunk("XMP ", []byte("<x:xmpmeta/>")), webpChunk("EXIF", tiff))},
+	}
+	want := webp(vp8x(0x20), iccp, bitstream)
+	for _, tt := range tests {
+		stripped, meta, err := stripMetadata(tt.data)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if meta.orientation != 8 {
+			t.Errorf("%s: orientation = %d, want 8", tt.name, meta.orientation)
+		}
+		if !bytes.Equal(stripped, want) {
+			t.Errorf("%s: stripped to\n%q, want\n%q", tt.name, stripped, want)
+		}
+	}
+
+	// The padding byte of the last chunk may be missing
+	odd := webp(webpChunk("VP8L", []byte("odd")))
+	odd = odd[:len(odd)-1]
+	binary.LittleEndian.PutUint32(odd[4:], uint32(len(odd)-8))
+	if stripped, _, err := stripMetadata(odd); err != nil || !bytes.Equal(stripped, odd) {
+		t.Errorf("last chunk with no padding: %q, %v", stripped, err)
+	}
+
+	for name, malformed := range map[string][]byte{
+		"truncated chunk header": webp(bitstream)[:len(webp(bitstream))-len(bitstream)+4],
+		"chunk past the end":     webp(bitstream)[:len(webp(bitstream))-4],
+		"empty VP8X":             webp(webpChunk("VP8X", nil), bitstream),
+		"animated":               webp(vp8x(webpFlagAnimation), bitstream),
+	} {
+		if _, _, err := stripMetadata(malformed); !errors.Is(err, image.ErrFormat) {
+			t.Errorf("%s: error = %v, want %v", name, err, image.ErrFormat)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strings"
+)
+
+// Number of horizontal and vertical components of the BlurHash of the photos: more components make finer (and longer)
+// hashes
+const (
+	blurHashComponentsX = 4
+	blurHashComponentsY = 3
+)
+
+// placeholderSize is the size (in pixels) of the longer side the photos are shrunk to before computing their
+// placeholder: the BlurHash and the dominant color are blurry anyway
+const placeholderSize = 64
+
+// base83 is the alphabet BlurHashes are encoded with
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Placeholder decodes the photo and returns its placeholder (see Still.Placeholder)
+func Placeholder(data []byte) (string, string, error) {
+	still, err := DecodeStill(data)
+	if err != nil {
+		return "", "", err
+	}
+	return still.Placeholder()
+}
+
+// Placeholder returns what clients can show while loading the photo (of the first frame, for animations): its BlurHash
+// (see https://blurha.sh), and its dominant color as "#rrggbb"
+func (s *Still) Placeholder() (string, string, error) {
+	src := s.img
+	bounds := src.Bounds()
+	if bounds.Dx() == 0 || bounds.Dy() == 0 {
+		return "", "", image.ErrFormat
+	}
+
+	width, height := placeholderSize, placeholderSize
+	if bounds.Dx() > bounds.Dy() {
+		height = max1(bounds.Dy() * placeholderSize / bounds.Dx())
+	} else {
+		width = max1(bounds.Dx() * placeholderSize / bounds.Dy())
+	}
+	small := resize(src, width, height)
+	return blurHash(small), dominantColor(small), nil
+}
+
+// blurHash encodes the image as a BlurHash, following the reference implementation
+func blurHash(img *image.RGBA) string {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+
+	// Each component is the weight of a cosine of the image, per channel, in linear RGB
+	var factors [blurHashComponentsX * blurHashComponentsY][3]float64
+	for j := 0; j < blurHashComponentsY; j++ {
+		for i := 0; i < blurHashComponentsX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var r, g, b float64
+			for y := 0; y < height; y++ {
+				basisY := math.Cos(math.Pi * float64(j) * float64(y) / float64(height))
+				for x := 0; x < width; x++ {
+					basis := normalisation * basisY * math.Cos(math.Pi*float64(i)*float64(x)/float64(width))
+					p := img.PixOffset(x, y)
+					r += basis * srgbToLinear(img.Pix[p])
+					g += basis * srgbToLinear(img.Pix[p+1])
+					b += basis * srgbToLinear(img.Pix[p+2])
+				}
+			}
+			scale := 1 / float64(width*height)
+			factors[j*blurHashComponentsX+i] = [3]float64{r * scale, g * scale, b * scale}
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encode83((blurHashComponentsX-1)+(blurHashComponentsY-1)*9, 1))
+
+	// The AC components are quantised relative to the largest of them
+	maximum := 0.0
+	for _, factor := range factors[1:] {
+		for _, value := range factor {
+			maximum = math.Max(maximum, math.Abs(value))
+		}
+	}
+	quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(maximum*166-0.5))))
+	maximumValue := float64(quantisedMaximum+1) / 166
+	hash.WriteString(encode83(quantisedMaximum, 1))
+
+	dc := factors[0]
+	hash.WriteString(encode83(linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4))
+	for _, ac := range factors[1:] {
+		quantised := 0
+		for _, value := range ac {
+			q := math.Floor(signPow(value/maximumValue, 0.5)*9 + 9.5)
+			quantised = quantised*19 + int(math.Max(0, math.Min(18, q)))
+		}
+		hash.WriteString(encode83(quantised, 2))
+	}
+	return hash.String()
+}
+
+// dominantColor returns the most frequent color of the image as "#rrggbb". Colors are counted in buckets of similar
+// ones (4 bits per channel), and the pixels of the largest bucket are averaged. Mostly transparent pixels are skipped.
+func dominantColor(img *image.RGBA) string {
+	var counts [4096]int
+	var sums [4096][3]int
+	best := -1
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		r, g, b, a := img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]
+		if a < 128 {
+			continue
+		}
+		bucket := int(r>>4)<<8 | int(g>>4)<<4 | int(b>>4)
+		counts[bucket]++
+		sums[bucket][0] += int(r)
+		sums[bucket][1] += int(g)
+		sums[bucket][2] += int(b)
+		if best < 0 || counts[bucket] > counts[best] {
+			best = bucket
+		}
+	}
+	if best < 0 {
+		return "#000000"
+	}
+	n := counts[best]
+	return fmt.Sprintf("#%02x%02x%02x", sums[best][0]/n, sums[best][1]/n, sums[best][2]/n)
+}
+
+// encode83 encodes the value in base 83, with the given number of digits
+func encode83(value int, length int) string {
+	digits := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		digits[i] = base83[value%83]
+		value /= 83
+	}
+	return string(digits)
+}
+
+// srgbToLinear converts an sRGB channel to linear RGB, from 0 to 1
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// linearToSRGB converts a linear RGB channel back to sRGB, from 0 to 255
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// signPow raises the absolute value of the base to the exponent, keeping its sign
+func signPow(base float64, exponent float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(base), exponent), base)
+}
+
+// max1 returns the value, or 1 if it is smaller
+func max1(value int) int {
+	if value < 1 {
+		return 1
+	}
+	return value
+}
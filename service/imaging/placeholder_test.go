@@ -0,0 +1,112 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"testing"
+)
+
+// fill returns an image of the given size, with the color of each pixel given by the function
+func fill(width int, height int, color func(x int, y int) [4]uint8) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := color(x, y)
+			copy(img.Pix[img.PixOffset(x, y):], c[:])
+		}
+	}
+	return img
+}
+
+func TestBlurHash(t *testing.T) {
+	// The hashes are the ones the reference implementation (https://github.com/woltapp/blurhash) encodes the same
+	// pixels to, with 4 by 3 components
+	tests := []struct {
+		name string
+		img  *image.RGBA
+		want string
+	}{
+		{"gradient", fill(8, 6, func(x, y int) [4]uint8 {
+			return [4]uint8{uint8(x * 32), uint8(y * 40), uint8(255 - (x+y)*15), 255}
+		}), "LuF=b07Qb2xdvIR=fTnnevf9fRf9"},
+		{"solid", fill(4, 3, func(x, y int) [4]uint8 {
+			return [4]uint8{200, 100, 50, 255}
+		}), "L$M|T9^4fQ^4}XxFfQxFfQfQfQfQ"},
+		{"white", fill(4, 3, func(x, y int) [4]uint8 {
+			return [4]uint8{255, 255, 255, 255}
+		}), "L~TSUA~qfQ~q~q%MfQ%MfQfQfQfQ"},
+	}
+	for _, tt := range tests {
+		if got := blurHash(tt.img); got != tt.want {
+			t.Errorf("%s: hash = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDominantColor(t *testing.T) {
+	tests := []struct {
+		name string
+		img  *image.RGBA
+		want string
+	}{
+		{"solid", fill(4, 4, func(x, y int) [4]uint8 {
+			return [4]uint8{200, 100, 50, 255}
+		}), "#c86432"},
+		{"largest bucket, averaged", fill(4, 4, func(x, y int) [4]uint8 {
+			if y == 0 {
+				return [4]uint8{0, 0, 255, 255}
+			}
+			return [4]uint8{200 + uint8(x), 100, 50, 255}
+		}), "#c96432"},
+		{"transparent pixels skipped", fill(4, 4, func(x, y int) [4]uint8 {
+			if y < 3 {
+				return [4]uint8{0, 0, 0, 0}
+			}
+			return [4]uint8{30, 160, 90, 255}
+		}), "#1ea05a"},
+		{"mostly transparent pixels skipped", fill(4, 4, func(x, y int) [4]uint8 {
+			if y < 3 {
+				return [4]uint8{60, 0, 0, 127}
+			}
+			return [4]uint8{30, 160, 90, 128}
+		}), "#1ea05a"},
+		{"all transparent", fill(4, 4, func(x, y int) [4]uint8 {
+			return [4]uint8{0, 0, 0, 0}
+		}), "#000000"},
+	}
+	for _, tt := range tests {
+		if got := dominantColor(tt.img); got != tt.want {
+			t.Errorf("%s: color = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPlaceholder(t *testing.T) {
+	// A PNG transparent but for a green strip at the bottom: shrunk to 64 by 64, the transparent pixels stay transparent
+	img := image.NewNRGBA(image.Rect(0, 0, 128, 128))
+	for y := 96; y < 128; y++ {
+		for x := 0; x < 128; x++ {
+			copy(img.Pix[img.PixOffset(x, y):], []byte{30, 160, 90, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, color, err := Placeholder(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hash) != 28 || hash[0] != 'L' {
+		t.Errorf("hash = %s, want 28 characters for 4 by 3 components", hash)
+	}
+	if color != "#1ea05a" {
+		t.Errorf("color = %s, want #1ea05a", color)
+	}
+
+	if _, _, err = Placeholder([]byte("not an image")); err == nil {
+		t.Error("data not an image accepted")
+	}
+}
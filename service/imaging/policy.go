@@ -0,0 +1,304 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What to do with photos whose aspect ratio is not the one of the policy
+const (
+	// AspectReject rejects them
+	AspectReject = "reject"
+
+	// AspectCrop crops them to the ratio, keeping the center
+	AspectCrop = "crop"
+
+	// AspectPad pads them to the ratio, with transparent (black, for JPEGs and GIFs with no transparent color) bands on
+	// the sides
+	AspectPad = "pad"
+)
+
+// ErrAspectRatio is returned by Policy.Apply when the photo is rejected for its aspect ratio
+var ErrAspectRatio = errors.New("photo aspect ratio not allowed")
+
+// ErrTooManyPixels is returned when the photo declares more pixels than allowed: it is rejected before being decoded
+var ErrTooManyPixels = errors.New("photo has too many pixels")
+
+// MaxDecodePixels is the number of pixels (width times height) no photo can exceed to be decoded, whatever the policy:
+// decoded, each pixel takes up to 4 bytes (8 for 16-bit PNGs)
+const MaxDecodePixels = 1 << 27
+
+// Policy is the aspect ratio and the resolution the uploaded photos are brought to, and the metadata they keep
+type Policy struct {
+	// RatioWidth and RatioHeight are the aspect ratio (e.g., 16 and 9). If zero, any aspect ratio is accepted.
+	RatioWidth  int
+	RatioHeight int
+
+	// Tolerance is the relative difference from the aspect ratio still accepted as is (e.g., 0.02 for 2%)
+	Tolerance float64
+
+	// Aspect is what to do with photos not in the aspect ratio: AspectReject (the default), AspectCrop or AspectPad
+	Aspect string
+
+	// MaxWidth and MaxHeight are the resolution photos are scaled down to fit in. If zero, there is no limit.
+	MaxWidth  int
+	MaxHeight int
+
+	// MaxPixels is the number of pixels (width times height) photos can declare: larger ones are rejected before being
+	// decoded. If zero (or above MaxDecodePixels), MaxDecodePixels is the limit.
+	MaxPixels int
+
+	// KeepEXIF are the names of the EXIF tags (among EXIFTags) returned by Apply. All the metadata is dropped from the
+	// photos anyway.
+	KeepEXIF []string
+
+	// MaxFrames and MaxDuration are the number of frames and the duration animations cannot exceed. If zero, there is
+	// no limit.
+	MaxFrames   int
+	MaxDuration time.Duration
+}
+
+// ParseRatio parses an aspect ratio in the "width:height" format (e.g., "16:9"). An empty string is no ratio (0:0).
+func ParseRatio(ratio string) (int, int, error) {
+	if ratio == "" {
+		return 0, 0, nil
+	}
+	parts := strings.Split(ratio, ":")
+	if len(parts) == 2 {
+		w, errW := strconv.Atoi(parts[0])
+		h, errH := strconv.Atoi(parts[1])
+		if errW == nil && errH == nil && w > 0 && h > 0 {
+			return w, h, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("aspect ratio %q not in the width:height format", ratio)
+}
+
+// Check returns an error if the policy is not valid
+func (p Policy) Check() error {
+	if p.RatioWidth < 0 || p.RatioHeight < 0 || (p.RatioWidth == 0) != (p.RatioHeight == 0) {
+		return errors.New("aspect ratio not valid")
+	}
+	if p.Tolerance < 0 {
+		return errors.New("aspect ratio tolerance must not be negative")
+	}
+	if p.Aspect != "" && p.Aspect != AspectReject && p.Aspect != AspectCrop && p.Aspect != AspectPad {
+		return fmt.Errorf("aspect ratio policy must be either %q, %q or %q", AspectReject, AspectCrop, AspectPad)
+	}
+	if p.MaxWidth < 0 || p.MaxHeight < 0 {
+		return errors.New("maximum resolution must not be negative")
+	}
+	if p.MaxPixels < 0 {
+		return errors.New("maximum number of pixels must not be negative")
+	}
+	if p.MaxFrames < 0 || p.MaxDuration < 0 {
+		return errors.New("maximum frames and duration of the animations must not be negative")
+	}
+	for _, name := range p.KeepEXIF {
+		// An empty name is what an empty list in the configuration is split into
+		if name == "" {
+			continue
+		}
+		found := false
+		for _, tag := range EXIFTags {
+			found = found || tag == name
+		}
+		if !found {
+			return fmt.Errorf("EXIF tag %q cannot be kept, only %s can", name, strings.Join(EXIFTags, ", "))
+		}
+	}
+	return nil
+}
+
+// Apply drops the metadata of the photo, turns it upright according to its EXIF orientation and brings it to the
+// aspect ratio and the resolution of the policy. The photo is re-encoded in its format only if its pixels change, but
+// WebPs, which cannot be encoded, are re-encoded as PNGs, and GIFs, which are always re-encoded (see applyGIF). The
+// EXIF tags in KeepEXIF found in the photo are returned, by name. Returns ErrTooManyPixels or ErrAspectRatio if the
+// photo is rejected, and ErrAnimation if the animation exceeds the limits of the policy.
+func (p Policy) Apply(data []byte) ([]byte, map[string]string, error) {
+	if err := checkPixels(data, p.maxPixels()); err != nil {
+		return nil, nil, err
+	}
+
+	data, meta, err := stripMetadata(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.HasPrefix(data, []byte("GIF8")) {
+		data, err = p.applyGIF(data)
+		return data, nil, err
+	}
+	src, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	if format != "jpeg" && format != "png" && format != "webp" {
+		return nil, nil, ErrUnsupportedFormat
+	}
+
+	img, err := p.transform(orient(src, meta.orientation))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var tags map[string]string
+	for _, name := range p.KeepEXIF {
+		if value, ok := meta.tags[name]; ok {
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[name] = value
+		}
+	}
+
+	if img == src {
+		return data, tags, nil
+	}
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	return buf.Bytes(), tags, err
+}
+
+// maxPixels returns the number of pixels photos cannot exceed, before and after being transformed
+func (p Policy) maxPixels() int {
+	if p.MaxPixels == 0 || p.MaxPixels > MaxDecodePixels {
+		return MaxDecodePixels
+	}
+	return p.MaxPixels
+}
+
+// checkPixels returns ErrTooManyPixels if the size the photo declares (the size of the canvas, for animations) exceeds
+// the given number of pixels. Only the header of the photo is read.
+func checkPixels(data []byte, maxPixels int) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return image.ErrFormat
+	}
+	if uint64(config.Width)*uint64(config.Height) > uint64(maxPixels) {
+		return ErrTooManyPixels
+	}
+	return nil
+}
+
+// transform brings the image to the aspect ratio and the resolution of the policy. The image is returned as it is if it
+// is already in them. Returns ErrTooManyPixels if the image, padded to the aspect ratio and scaled down, still exceeds
+// the pixels allowed.
+func (p Policy) transform(img image.Image) (image.Image, error) {
+	if !p.hasRatio(img.Bounds().Dx(), img.Bounds().Dy()) {
+		switch p.Aspect {
+		case AspectCrop:
+			img = p.crop(img)
+		case AspectPad:
+			var err error
+			if img, err = p.pad(img); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, ErrAspectRatio
+		}
+	}
+	return p.fit(img), nil
+}
+
+// hasRatio reports whether the given size is in the aspect ratio, within the tolerance
+func (p Policy) hasRatio(width int, height int) bool {
+	if p.RatioWidth == 0 {
+		return true
+	}
+	ratio := float64(width) * float64(p.RatioHeight) / (float64(height) * float64(p.RatioWidth))
+	return math.Abs(ratio-1) <= p.Tolerance
+}
+
+// crop returns the largest area in the center of the image in the aspect ratio, at least one pixel on each side
+func (p Policy) crop(img image.Image) image.Image {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width*p.RatioHeight > height*p.RatioWidth {
+		width = max1(height * p.RatioWidth / p.RatioHeight)
+	} else {
+		height = max1(width * p.RatioHeight / p.RatioWidth)
+	}
+	min := image.Pt(b.Min.X+(b.Dx()-width)/2, b.Min.Y+(b.Dy()-height)/2)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), img, min, draw.Src)
+	return dst
+}
+
+// pad returns the image in the center of the smallest area in the aspect ratio containing it, already scaled down to
+// fit in the maximum resolution: the padded area of a very narrow image can be far larger than the image itself, so it
+// is never allocated at full size. Returns ErrTooManyPixels if the result would exceed the pixels allowed.
+func (p Policy) pad(img image.Image) (image.Image, error) {
+	b := img.Bounds()
+	padW, padH := b.Dx(), b.Dy()
+	if padW*p.RatioHeight > padH*p.RatioWidth {
+		padH = (padW*p.RatioHeight + p.RatioWidth - 1) / p.RatioWidth
+	} else {
+		padW = (padH*p.RatioWidth + p.RatioHeight - 1) / p.RatioHeight
+	}
+	width, height := p.fitSize(padW, padH)
+	if uint64(width)*uint64(height) > uint64(p.maxPixels()) {
+		return nil, ErrTooManyPixels
+	}
+
+	// The image is scaled down as much as the padded area, but never beyond it
+	innerW := max1(int(math.Round(float64(b.Dx()) * float64(width) / float64(padW))))
+	innerH := max1(int(math.Round(float64(b.Dy()) * float64(height) / float64(padH))))
+	if innerW > width {
+		innerW = width
+	}
+	if innerH > height {
+		innerH = height
+	}
+	if innerW != b.Dx() || innerH != b.Dy() {
+		img = resize(img, innerW, innerH)
+		b = img.Bounds()
+	}
+	offset := image.Pt((width-innerW)/2, (height-innerH)/2)
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, b.Sub(b.Min).Add(offset), img, b.Min, draw.Src)
+	return dst, nil
+}
+
+// fit scales the image down to fit in the maximum resolution, keeping its aspect ratio
+func (p Policy) fit(img image.Image) image.Image {
+	b := img.Bounds()
+	width, height := p.fitSize(b.Dx(), b.Dy())
+	if width == b.Dx() && height == b.Dy() {
+		return img
+	}
+	return resize(img, width, height)
+}
+
+// fitSize returns the given size scaled down to fit in the maximum resolution, keeping its aspect ratio, at least one
+// pixel on each side
+func (p Policy) fitSize(width int, height int) (int, int) {
+	scale := 1.0
+	if p.MaxWidth > 0 && width > p.MaxWidth {
+		scale = float64(p.MaxWidth) / float64(width)
+	}
+	if p.MaxHeight > 0 && height > p.MaxHeight {
+		scale = math.Min(scale, float64(p.MaxHeight)/float64(height))
+	}
+	if scale == 1 {
+		return width, height
+	}
+	return max1(int(math.Round(float64(width) * scale))), max1(int(math.Round(float64(height) * scale)))
+}
@@ -0,0 +1,151 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+// encodePNG returns a PNG of the given size, filled with a single color
+func encodePNG(t *testing.T, width int, height int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i := 0; i < len(img.Pix); i += 4 {
+		copy(img.Pix[i:], []byte{200, 100, 50, 255})
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// encodeGIF returns an animated GIF of the given size and number of frames
+func encodeGIF(t *testing.T, width int, height int, frames int) []byte {
+	t.Helper()
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), palette)
+		frame.SetColorIndex(0, 0, uint8(i%2))
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPolicyApply(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        Policy
+		width, height int
+		wantW, wantH  int
+		wantErr       error
+	}{
+		{"in ratio", Policy{RatioWidth: 16, RatioHeight: 9}, 160, 90, 160, 90, nil},
+		{"within tolerance", Policy{RatioWidth: 16, RatioHeight: 9, Tolerance: 0.02}, 160, 91, 160, 91, nil},
+		{"no ratio", Policy{}, 1, 40000, 1, 40000, nil},
+		{"reject", Policy{RatioWidth: 16, RatioHeight: 9}, 90, 160, 0, 0, ErrAspectRatio},
+		{"reject tall strip", Policy{RatioWidth: 16, RatioHeight: 9, Aspect: AspectReject}, 1, 40000, 0, 0, ErrAspectRatio},
+		{"crop tall", Policy{RatioWidth: 16, RatioHeight: 9, Aspect: AspectCrop}, 90, 160, 90, 50, nil},
+		{"crop wide", Policy{RatioWidth: 1, RatioHeight: 1, Aspect: AspectCrop}, 300, 100, 100, 100, nil},
+		{"crop tall strip", Policy{RatioWidth: 16, RatioHeight: 9, Aspect: AspectCrop}, 1, 40000, 1, 1, nil},
+		{"crop wide strip", Policy{RatioWidth: 9, RatioHeight: 16, Aspect: AspectCrop}, 40000, 1, 1, 1, nil},
+		{"pad tall", Policy{RatioWidth: 16, RatioHeight: 9, Aspect: AspectPad}, 90, 160, 285, 160, nil},
+		{"pad wide", Policy{RatioWidth: 1, RatioHeight: 1, Aspect: AspectPad}, 300, 100, 300, 300, nil},
+		{"pad tall strip", Policy{RatioWidth: 16, RatioHeight: 9, Aspect: AspectPad, MaxWidth: 1920, MaxHeight: 1080}, 1, 40000, 1920, 1080, nil},
+		{"pad wide strip", Policy{RatioWidth: 9, RatioHeight: 16, Aspect: AspectPad, MaxWidth: 1080, MaxHeight: 1920}, 40000, 1, 1080, 1920, nil},
+		{"pad tall strip, width only", Policy{RatioWidth: 16, RatioHeight: 9, Aspect: AspectPad, MaxWidth: 1920}, 1, 40000, 1920, 1080, nil},
+		{"pad tall strip, no resolution", Policy{RatioWidth: 16, RatioHeight: 9, Aspect: AspectPad}, 1, 40000, 0, 0, ErrTooManyPixels},
+		{"pad over max pixels", Policy{RatioWidth: 1, RatioHeight: 1, Aspect: AspectPad, MaxPixels: 10000}, 200, 20, 0, 0, ErrTooManyPixels},
+		{"fit", Policy{MaxWidth: 100, MaxHeight: 100}, 400, 200, 100, 50, nil},
+		{"fit wide strip", Policy{MaxWidth: 1000, MaxHeight: 1000}, 40000, 1, 1000, 1, nil},
+		{"fit tall strip", Policy{MaxWidth: 1000, MaxHeight: 1000}, 1, 40000, 1, 1000, nil},
+		{"declared over max pixels", Policy{MaxPixels: 1000}, 100, 100, 0, 0, ErrTooManyPixels},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.Check(); err != nil {
+			t.Fatalf("%s: policy not valid: %v", tt.name, err)
+		}
+		data := encodePNG(t, tt.width, tt.height)
+		out, _, err := tt.policy.Apply(data)
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("%s: result not an image: %v", tt.name, err)
+			continue
+		}
+		if config.Width != tt.wantW || config.Height != tt.wantH {
+			t.Errorf("%s: size = %dx%d, want %dx%d", tt.name, config.Width, config.Height, tt.wantW, tt.wantH)
+		}
+	}
+}
+
+func TestPolicyApplyUnchanged(t *testing.T) {
+	// Photos already in the ratio and the resolution are returned as they are
+	data := encodePNG(t, 160, 90)
+	out, _, err := Policy{RatioWidth: 16, RatioHeight: 9, MaxWidth: 1920, MaxHeight: 1080}.Apply(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Error("photo re-encoded, while no pixel had to change")
+	}
+}
+
+func TestPolicyApplyGIF(t *testing.T) {
+	tests := []struct {
+		name          string
+		policy        Policy
+		width, height int
+		wantW, wantH  int
+		wantErr       error
+	}{
+		{"crop tall strip", Policy{RatioWidth: 16, RatioHeight: 9, Aspect: AspectCrop}, 1, 4000, 1, 1, nil},
+		{"pad tall strip", Policy{RatioWidth: 16, RatioHeight: 9, Aspect: AspectPad, MaxWidth: 160, MaxHeight: 90}, 1, 4000, 160, 90, nil},
+		{"pad over max pixels", Policy{RatioWidth: 16, RatioHeight: 9, Aspect: AspectPad, MaxPixels: 1 << 20}, 1, 4000, 0, 0, ErrTooManyPixels},
+		{"reject", Policy{RatioWidth: 16, RatioHeight: 9}, 1, 4000, 0, 0, ErrAspectRatio},
+		{"too many frames", Policy{MaxFrames: 2}, 10, 10, 0, 0, ErrAnimation},
+	}
+	for _, tt := range tests {
+		out, _, err := tt.policy.Apply(encodeGIF(t, tt.width, tt.height, 3))
+		if tt.wantErr != nil {
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("%s: error = %v, want %v", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		anim, err := gif.DecodeAll(bytes.NewReader(out))
+		if err != nil {
+			t.Errorf("%s: result not a GIF: %v", tt.name, err)
+			continue
+		}
+		if len(anim.Image) != 3 {
+			t.Errorf("%s: %d frames, want 3", tt.name, len(anim.Image))
+		}
+		if anim.Config.Width != tt.wantW || anim.Config.Height != tt.wantH {
+			t.Errorf("%s: size = %dx%d, want %dx%d", tt.name, anim.Config.Width, anim.Config.Height, tt.wantW, tt.wantH)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+const (
+	testClientID    = "wasaphoto"
+	testRedirectURL = "http://localhost:3000/session/oidc/callback"
+)
+
+// fakeProvider is an OpenID Connect provider serving the discovery document, its keys and a token endpoint issuing the
+// ID token built by idToken
+type fakeProvider struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	// challenge is the PKCE challenge the token endpoint expects the code verifier to match
+	challenge string
+
+	// idToken returns the ID token to be issued, given the default claims of a valid one
+	idToken func(claims map[string]interface{}) string
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeProvider{t: t, key: key}
+	f.idToken = func(claims map[string]interface{}) string { return f.sign(f.key, claims) }
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 f.server.URL,
+			"authorization_endpoint": f.server.URL + "/authorize",
+			"token_endpoint":         f.server.URL + "/token",
+			"jwks_uri":               f.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "key-1",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(f.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(f.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "authorization_code" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Form.Get("client_id") != testClientID || r.Form.Get("redirect_uri") != testRedirectURL {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if Challenge(r.Form.Get("code_verifier")) != f.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		now := globaltime.Now()
+		claims := map[string]interface{}{
+			"iss":                f.server.URL,
+			"aud":                testClientID,
+			"sub":                "subject-1",
+			"nonce":              "nonce-1",
+			"preferred_username": "alice",
+			"iat":                now.Unix(),
+			"exp":                now.Add(time.Hour).Unix(),
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"id_token": f.idToken(claims)})
+	})
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+// sign returns the claims as an RS256 ID token signed with the given key
+func (f *fakeProvider) sign(key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "key-1"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (f *fakeProvider) provider(t *testing.T) *Provider {
+	p, err := NewProvider(Config{Issuer: f.server.URL, ClientID: testClientID, ClientSecret: "secret", RedirectURL: testRedirectURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestNewProviderDefaultTimeout(t *testing.T) {
+	p, err := NewProvider(Config{Issuer: "http://idp", ClientID: testClientID, RedirectURL: testRedirectURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.client.Timeout != DefaultTimeout {
+		t.Errorf("timeout = %v, want %v", p.client.Timeout, DefaultTimeout)
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	f := newFakeProvider(t)
+	p := f.provider(t)
+
+	authURL, err := p.AuthCodeURL("state-1", "nonce-1", "verifier-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, f.server.URL+"/authorize?") {
+		t.Fatalf("URL %q does not point to the discovered authorization endpoint", authURL)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURL,
+		"state":                 "state-1",
+		"nonce":                 "nonce-1",
+		"code_challenge":        Challenge("verifier-1"),
+		"code_challenge_method": "S256",
+	}
+	for name, value := range want {
+		if got := u.Query().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	f := newFakeProvider(t)
+	p, err := NewProvider(Config{Issuer: f.server.URL + "/other", ClientID: testClientID, RedirectURL: testRedirectURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.AuthCodeURL("state-1", "nonce-1", "verifier-1"); err == nil {
+		t.Error("discovery document of another issuer accepted")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	globaltime.FixedTime = time.Unix(1700000000, 0)
+	defer func() { globaltime.FixedTime = time.Time{} }()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		verifier string
+		modify   func(f *fakeProvider, claims map[string]interface{}) string
+		invalid  bool // Whether the ID token must be rejected as invalid
+		fails    bool // Whether the exchange must fail for any other reason
+	}{
+		{name: "valid"},
+		{name: "wrong PKCE verifier", verifier: "another-verifier", fails: true},
+		{
+			name: "bad signature",
+			modify: func(f *fakeProvider, claims map[string]interface{}) string {
+				return f.sign(otherKey, claims)
+			},
+			invalid: true,
+		},
+		{
+			name: "wrong audience",
+			modify: func(f *fakeProvider, claims map[string]interface{}) string {
+				claims["aud"] = []string{"another-client"}
+				return f.sign(f.key, claims)
+			},
+			invalid: true,
+		},
+		{
+			name: "nonce mismatch",
+			modify: func(f *fakeProvider, claims map[string]interface{}) string {
+				claims["nonce"] = "nonce-2"
+				return f.sign(f.key, claims)
+			},
+			invalid: true,
+		},
+		{
+			name: "expired",
+			modify: func(f *fakeProvider, claims map[string]interface{}) string {
+				claims["iat"] = globaltime.Now().Add(-2 * time.Hour).Unix()
+				claims["exp"] = globaltime.Now().Add(-Leeway - time.Second).Unix()
+				return f.sign(f.key, claims)
+			},
+			invalid: true,
+		},
+		{
+			name: "expired within the leeway",
+			modify: func(f *fakeProvider, claims map[string]interface{}) string {
+				claims["exp"] = globaltime.Now().Add(-Leeway / 2).Unix()
+				return f.sign(f.key, claims)
+			},
+		},
+		{
+			name: "wrong issuer",
+			modify: func(f *fakeProvider, claims map[string]interface{}) string {
+				claims["iss"] = "http://another-issuer"
+				return f.sign(f.key, claims)
+			},
+			invalid: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeProvider(t)
+			if tt.modify != nil {
+				f.idToken = func(claims map[string]interface{}) string { return tt.modify(f, claims) }
+			}
+			f.challenge = Challenge("verifier-1")
+			verifier := "verifier-1"
+			if tt.verifier != "" {
+				verifier = tt.verifier
+			}
+
+			claims, err := f.provider(t).Exchange("code-1", verifier, "nonce-1")
+			switch {
+			case tt.invalid:
+				if !errors.Is(err, ErrInvalidIDToken) {
+					t.Errorf("err = %v, want %v", err, ErrInvalidIDToken)
+				}
+			case tt.fails:
+				if err == nil || errors.Is(err, ErrInvalidIDToken) {
+					t.Errorf("err = %v, want a failed exchange", err)
+				}
+			case err != nil:
+				t.Errorf("err = %v", err)
+			case claims.Subject != "subject-1" || claims.PreferredUsername != "alice" || claims.Issuer != f.server.URL:
+				t.Errorf("claims = %+v", *claims)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Package photourl signs and verifies the URLs photos are served at.
+
+Browsers cannot attach an Authorization header to <img src>, so the API hands out photo URLs carrying their own
+credentials: the path of the photo, the user the URL has been issued to (the viewer), an expiration and an
+HMAC-SHA256 signature of the three. A signed URL is only good for that photo, and only until it expires.
+*/
+package photourl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// Prefix is the path photos are served at: signed URLs are relative to the root of the API
+const Prefix = "/photos/"
+
+// ErrInvalidSignature is returned when the signature does not match the path, the viewer and the expiration
+var ErrInvalidSignature = errors.New("invalid photo URL signature")
+
+// ErrExpired is returned when the URL has expired
+var ErrExpired = errors.New("photo URL expired")
+
+// Signer signs and verifies photo URLs
+type Signer struct {
+	key []byte
+	ttl time.Duration
+}
+
+// NewSigner returns a Signer issuing URLs valid for the given TTL at least, and half of it more at most (see Sign). If no key is provided, a random one is generated:
+// URLs issued before a restart are then no longer valid.
+func NewSigner(key []byte, TTL time.Duration) (*Signer, error) {
+	if len(key) == 0 {
+		key = make([]byte, sha256.Size)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	if len(key) < sha256.Size {
+		return nil, fmt.Errorf("photo URL key must be at least %d bytes long", sha256.Size)
+	}
+	if TTL <= 0 {
+		return nil, errors.New("photo URL TTL must be positive")
+	}
+	return &Signer{key: key, ttl: TTL}, nil
+}
+
+// Sign returns the URL of the photo stored at the given path, for the given viewer. An empty path is left as it is.
+// The expiration is rounded up to a multiple of half the TTL, so that the URL of a photo stays the same for a while and
+// browsers can cache it.
+func (s *Signer) Sign(path string, viewer string) string {
+	if path == "" {
+		return ""
+	}
+	bucket := int64((s.ttl / 2).Seconds())
+	if bucket < 1 {
+		bucket = 1
+	}
+	exp := globaltime.Now().Add(s.ttl).Unix()
+	exp += (bucket - exp%bucket) % bucket
+	expires := strconv.FormatInt(exp, 10)
+
+	query := url.Values{}
+	query.Set("photo_path", path)
+	query.Set("viewer", viewer)
+	query.Set("expires", expires)
+	query.Set("signature", s.signature(path, viewer, expires))
+	return Prefix + "?" + query.Encode()
+}
+
+// Verify checks the signature and the expiration of a photo URL, given its query parameters
+func (s *Signer) Verify(path string, viewer string, expires string, signature string) error {
+	given, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	expected, _ := base64.RawURLEncoding.DecodeString(s.signature(path, viewer, expires))
+	if !hmac.Equal(given, expected) {
+		return ErrInvalidSignature
+	}
+
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if globaltime.Now().Unix() >= exp {
+		return ErrExpired
+	}
+	return nil
+}
+
+// signature returns the HMAC-SHA256 of the path, the viewer and the expiration. The fields are length-prefixed, so that
+// they cannot be shifted into one another.
+func (s *Signer) signature(path string, viewer string, expires string) string {
+	mac := hmac.New(sha256.New, s.key)
+	for _, field := range []string{path, viewer, expires} {
+		_, _ = fmt.Fprintf(mac, "%d:%s", len(field), field)
+	}
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
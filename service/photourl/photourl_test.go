@@ -0,0 +1,149 @@
+package photourl
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newTestSigner(t *testing.T, ttl time.Duration) *Signer {
+	t.Helper()
+	s, err := NewSigner(testKey, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// parse returns the query parameters of a signed URL
+func parse(t *testing.T, signed string) url.Values {
+	t.Helper()
+	if !strings.HasPrefix(signed, Prefix+"?") {
+		t.Fatalf("URL %q not under %s", signed, Prefix)
+	}
+	query, err := url.ParseQuery(strings.TrimPrefix(signed, Prefix+"?"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return query
+}
+
+func TestVerify(t *testing.T) {
+	globaltime.FixedTime = time.Unix(1700000000, 0)
+	defer func() { globaltime.FixedTime = time.Time{} }()
+
+	s := newTestSigner(t, time.Hour)
+	q := parse(t, s.Sign("photos/1.jpg", "alice_user"))
+	path, viewer, expires, signature := q.Get("photo_path"), q.Get("viewer"), q.Get("expires"), q.Get("signature")
+	if path != "photos/1.jpg" || viewer != "alice_user" {
+		t.Fatalf("path = %q, viewer = %q", path, viewer)
+	}
+	exp, _ := strconv.ParseInt(expires, 10, 64)
+
+	tests := []struct {
+		name                             string
+		path, viewer, expires, signature string
+		err                              error
+	}{
+		{"valid", path, viewer, expires, signature, nil},
+		{"other photo", "photos/2.jpg", viewer, expires, signature, ErrInvalidSignature},
+		{"other viewer", path, "bob_user", expires, signature, ErrInvalidSignature},
+		{"later expiration", path, viewer, strconv.FormatInt(exp+3600, 10), signature, ErrInvalidSignature},
+		{"fields shifted", "photos/1.jpgalice_user", "", expires, signature, ErrInvalidSignature},
+		{"signature not base64", path, viewer, expires, "!!", ErrInvalidSignature},
+		{"no signature", path, viewer, expires, "", ErrInvalidSignature},
+		{"signed with another key", path, viewer, expires, (&Signer{key: []byte(strings.Repeat("x", 32)), ttl: time.Hour}).signature(path, viewer, expires), ErrInvalidSignature},
+	}
+	for _, tt := range tests {
+		if err := s.Verify(tt.path, tt.viewer, tt.expires, tt.signature); !errors.Is(err, tt.err) {
+			t.Errorf("%s: error = %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	// Signed for an expiration that is not a number: the signature matches, the expiration does not parse
+	if err := s.Verify(path, viewer, "soon", s.signature(path, viewer, "soon")); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expiration not a number: error = %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	globaltime.FixedTime = time.Unix(1700000000, 0)
+	defer func() { globaltime.FixedTime = time.Time{} }()
+
+	s := newTestSigner(t, time.Hour)
+	q := parse(t, s.Sign("photos/1.jpg", "alice_user"))
+	exp, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Valid for the TTL at least, and half of it more at most
+	if valid := time.Duration(exp-globaltime.FixedTime.Unix()) * time.Second; valid < time.Hour || valid > 3*time.Hour/2 {
+		t.Errorf("URL valid for %v, want between 1h and 1h30m", valid)
+	}
+
+	globaltime.FixedTime = time.Unix(exp-1, 0)
+	if err = s.Verify(q.Get("photo_path"), q.Get("viewer"), q.Get("expires"), q.Get("signature")); err != nil {
+		t.Errorf("URL rejected before its expiration: %v", err)
+	}
+	globaltime.FixedTime = time.Unix(exp, 0)
+	if err = s.Verify(q.Get("photo_path"), q.Get("viewer"), q.Get("expires"), q.Get("signature")); !errors.Is(err, ErrExpired) {
+		t.Errorf("error = %v, want %v", err, ErrExpired)
+	}
+}
+
+func TestSignStable(t *testing.T) {
+	globaltime.FixedTime = time.Unix(1700000000, 0)
+	defer func() { globaltime.FixedTime = time.Time{} }()
+
+	// The URL of a photo stays the same within half the TTL, so that browsers can cache it
+	s := newTestSigner(t, time.Hour)
+	bucket := int64(time.Hour / 2 / time.Second)
+	start := (globaltime.FixedTime.Unix()/bucket + 1) * bucket
+	globaltime.FixedTime = time.Unix(start+1, 0)
+	first := s.Sign("photos/1.jpg", "alice_user")
+	for _, later := range []int64{2, 60, bucket - 1, bucket} {
+		globaltime.FixedTime = time.Unix(start+later, 0)
+		if signed := s.Sign("photos/1.jpg", "alice_user"); signed != first {
+			t.Errorf("URL changed %d seconds later: %s, then %s", later-1, first, signed)
+		}
+	}
+	globaltime.FixedTime = time.Unix(start+bucket+1, 0)
+	if s.Sign("photos/1.jpg", "alice_user") == first {
+		t.Error("URL unchanged past half the TTL")
+	}
+
+	if s.Sign("", "alice_user") != "" {
+		t.Error("empty path signed")
+	}
+}
+
+func TestNewSigner(t *testing.T) {
+	if _, err := NewSigner([]byte("short"), time.Hour); err == nil {
+		t.Error("key shorter than 32 bytes accepted")
+	}
+	if _, err := NewSigner(testKey, 0); err == nil {
+		t.Error("TTL of zero accepted")
+	}
+
+	// Without a key, a random one is generated: each signer rejects the URLs of the other
+	a, err := NewSigner(nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSigner(nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := parse(t, a.Sign("photos/1.jpg", "alice_user"))
+	if err = b.Verify(q.Get("photo_path"), q.Get("viewer"), q.Get("expires"), q.Get("signature")); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("error = %v, want %v", err, ErrInvalidSignature)
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Package ratelimit implements in-memory token bucket rate limiting.
+
+Each key (e.g., a username or an IP address) gets its own bucket holding up to Limit.Requests tokens, refilled at a rate
+of Limit.Requests per Limit.Period. Every request takes a token: when the bucket is empty, the request is rejected
+until a token is refilled. Bursts up to the size of the bucket are therefore allowed, while the long term rate is capped.
+*/
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// Limit is the number of requests allowed in a period of time. A Limit with no requests disables rate limiting.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// Result is the outcome of a request against a Limiter
+type Result struct {
+	// Allowed is whether the request can go through
+	Allowed bool
+
+	// Limit is the size of the bucket, Remaining the tokens left in it after this request
+	Limit     int
+	Remaining int
+
+	// RetryAfter is the time before a token is available again (zero if Allowed), Reset the time before the bucket is full
+	RetryAfter time.Duration
+	Reset      time.Duration
+}
+
+// minSweep is the number of buckets added since the last sweep that triggers a new one before the period is over
+const minSweep = 1024
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter keeps a token bucket per key. It is safe for concurrent use.
+type Limiter struct {
+	limit Limit
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	swept     int // Number of buckets left by the last sweep
+}
+
+// New returns a new Limiter enforcing the given limit
+func New(limit Limit) *Limiter {
+	return &Limiter{limit: limit, buckets: make(map[string]*bucket)}
+}
+
+// Enabled is whether the limiter actually limits anything
+func (l *Limiter) Enabled() bool {
+	return l.limit.Requests > 0 && l.limit.Period > 0
+}
+
+// Allow takes a token from the bucket of the given key, if any is left
+func (l *Limiter) Allow(key string) Result {
+	if !l.Enabled() {
+		return Result{Allowed: true}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := globaltime.Now()
+	capacity := float64(l.limit.Requests)
+	perToken := l.limit.Period / time.Duration(l.limit.Requests)
+
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+
+	// Refill the tokens earned since the last request
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+float64(elapsed)/float64(perToken))
+		b.last = now
+	}
+
+	res := Result{Limit: l.limit.Requests}
+	if b.tokens >= 1 {
+		b.tokens--
+		res.Allowed = true
+	} else {
+		res.RetryAfter = time.Duration((1 - b.tokens) * float64(perToken))
+	}
+	res.Remaining = int(b.tokens)
+	res.Reset = time.Duration((capacity - b.tokens) * float64(perToken))
+
+	return res
+}
+
+// sweep drops the buckets that are full again (i.e., of keys idle for a whole period): once per period, or as soon as
+// the buckets have doubled since the last sweep, so that a burst of new keys (e.g., IP addresses) is not kept for long
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.limit.Period && len(l.buckets) < 2*l.swept+minSweep {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if now.Sub(b.last) >= l.limit.Period {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = len(l.buckets)
+}
+
+// Len returns the number of buckets currently kept
+func (l *Limiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
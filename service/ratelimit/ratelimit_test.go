@@ -0,0 +1,146 @@
+package ratelimit
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"git.sapienzaapps.it/fantasticcoffee/fantastic-coffee-decaffeinated/service/globaltime"
+)
+
+// at sets the current time to the given offset from a fixed moment
+func at(offset time.Duration) {
+	globaltime.FixedTime = time.Unix(1700000000, 0).Add(offset)
+}
+
+func TestBurst(t *testing.T) {
+	at(0)
+	defer func() { globaltime.FixedTime = time.Time{} }()
+
+	l := New(Limit{Requests: 5, Period: time.Minute})
+	for i := 0; i < 5; i++ {
+		res := l.Allow("alice")
+		if !res.Allowed {
+			t.Fatalf("request %d of the burst rejected", i+1)
+		}
+		if res.Limit != 5 || res.Remaining != 4-i {
+			t.Errorf("request %d: limit = %d, remaining = %d, want 5 and %d", i+1, res.Limit, res.Remaining, 4-i)
+		}
+	}
+
+	res := l.Allow("alice")
+	if res.Allowed {
+		t.Fatal("request past the burst allowed")
+	}
+	if res.RetryAfter != 12*time.Second {
+		t.Errorf("retry after %v, want 12s (a token every minute / 5)", res.RetryAfter)
+	}
+	if res.Reset != time.Minute {
+		t.Errorf("reset after %v, want 1m", res.Reset)
+	}
+}
+
+func TestRefill(t *testing.T) {
+	at(0)
+	defer func() { globaltime.FixedTime = time.Time{} }()
+
+	l := New(Limit{Requests: 5, Period: time.Minute})
+	for i := 0; i < 5; i++ {
+		l.Allow("alice")
+	}
+
+	// A token every 12 seconds: not earned yet just before, earned right then
+	at(12*time.Second - time.Millisecond)
+	if res := l.Allow("alice"); res.Allowed {
+		t.Error("request allowed before a token has been refilled")
+	}
+	at(12 * time.Second)
+	if res := l.Allow("alice"); !res.Allowed {
+		t.Errorf("request rejected after a token has been refilled, retry after %v", res.RetryAfter)
+	}
+	if res := l.Allow("alice"); res.Allowed {
+		t.Error("request allowed past the refilled token")
+	}
+
+	// Idle for longer than the period, the bucket is full again but never holds more than its size
+	at(time.Hour)
+	for i := 0; i < 5; i++ {
+		if res := l.Allow("alice"); !res.Allowed {
+			t.Fatalf("request %d after a long pause rejected", i+1)
+		}
+	}
+	if res := l.Allow("alice"); res.Allowed {
+		t.Error("bucket refilled past its size")
+	}
+}
+
+func TestKeys(t *testing.T) {
+	at(0)
+	defer func() { globaltime.FixedTime = time.Time{} }()
+
+	l := New(Limit{Requests: 1, Period: time.Minute})
+	if !l.Allow("alice").Allowed || !l.Allow("bob").Allowed {
+		t.Fatal("first request of a key rejected")
+	}
+	if l.Allow("alice").Allowed || l.Allow("bob").Allowed {
+		t.Error("keys sharing a bucket, or the bucket not limiting")
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	for _, limit := range []Limit{{}, {Requests: 5}, {Period: time.Minute}} {
+		l := New(limit)
+		if l.Enabled() {
+			t.Errorf("%+v enabled", limit)
+		}
+		for i := 0; i < 100; i++ {
+			if !l.Allow("alice").Allowed {
+				t.Fatalf("%+v: request rejected", limit)
+			}
+		}
+		if l.Len() != 0 {
+			t.Errorf("%+v: %d buckets kept", limit, l.Len())
+		}
+	}
+}
+
+func TestSweep(t *testing.T) {
+	at(0)
+	defer func() { globaltime.FixedTime = time.Time{} }()
+
+	l := New(Limit{Requests: 5, Period: time.Minute})
+	l.Allow("alice")
+	for i := 0; i < 10; i++ {
+		l.Allow("ip:" + strconv.Itoa(i))
+	}
+	if l.Len() != 11 {
+		t.Fatalf("%d buckets, want 11", l.Len())
+	}
+
+	// Within the period, no bucket is dropped; once it is over, the idle buckets are
+	at(59 * time.Second)
+	l.Allow("alice")
+	if l.Len() != 11 {
+		t.Errorf("%d buckets before the period is over, want 11", l.Len())
+	}
+	at(time.Minute)
+	l.Allow("bob")
+	if l.Len() != 2 {
+		t.Errorf("%d buckets after the period, want 2 (alice, active, and bob)", l.Len())
+	}
+
+	// A burst of new keys triggers a sweep before the period is over, dropping the keys idle since
+	at(90 * time.Second)
+	for i := 0; i < 500; i++ {
+		l.Allow("idle:" + strconv.Itoa(i))
+	}
+	at(2 * time.Minute)
+	l.Allow("alice") // Sweeps, keeping the keys idle for 30 seconds only
+	at(2*time.Minute + 30*time.Second)
+	for i := 0; i < 2*minSweep; i++ {
+		l.Allow("burst:" + strconv.Itoa(i))
+	}
+	if n := l.Len(); n != 2*minSweep+1 {
+		t.Errorf("%d buckets after a burst of new keys, want %d (the idle ones dropped)", n, 2*minSweep+1)
+	}
+}
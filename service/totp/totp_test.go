@@ -0,0 +1,110 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 secret of the test vectors of RFC 6238 (appendix B), "12345678901234567890", base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCode(t *testing.T) {
+	// RFC 6238 lists 8 digits codes: ours are their last 6 digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		code, err := Code(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code(%d): %v", tt.unix, err)
+		}
+		if code != tt.code {
+			t.Errorf("Code(%d) = %s, want %s", tt.unix, code, tt.code)
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	current := Step(now)
+
+	tests := []struct {
+		name  string
+		step  int64
+		valid bool
+	}{
+		{"previous step", current - 1, true},
+		{"current step", current, true},
+		{"next step", current + 1, true},
+		{"two steps before", current - 2, false},
+		{"two steps after", current + 2, false},
+	}
+	for _, tt := range tests {
+		code, err := Code(rfcSecret, tt.step)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		step, ok, err := Validate(rfcSecret, code, now, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if ok != tt.valid {
+			t.Errorf("%s: valid = %v, want %v", tt.name, ok, tt.valid)
+		}
+		if ok && step != tt.step {
+			t.Errorf("%s: step = %d, want %d", tt.name, step, tt.step)
+		}
+	}
+}
+
+func TestValidateReplay(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, err := Code(rfcSecret, Step(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastStep, ok, err := Validate(rfcSecret, code, now, 0)
+	if err != nil || !ok {
+		t.Fatalf("first use: valid = %v, err = %v", ok, err)
+	}
+
+	// The same code, within the same period or the next one, must not be accepted again
+	for _, at := range []time.Time{now, now.Add(Period)} {
+		if _, ok, err = Validate(rfcSecret, code, at, lastStep); err != nil || ok {
+			t.Errorf("replay at %v: valid = %v, err = %v", at, ok, err)
+		}
+	}
+
+	// Codes of earlier steps are rejected as well, even if within the skew
+	previous, err := Code(rfcSecret, lastStep-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err = Validate(rfcSecret, previous, now, lastStep); err != nil || ok {
+		t.Errorf("code of an earlier step: valid = %v, err = %v", ok, err)
+	}
+
+	// The code of the next step is still fine
+	next, err := Code(rfcSecret, lastStep+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step, ok, err := Validate(rfcSecret, next, now.Add(Period), lastStep); err != nil || !ok || step != lastStep+1 {
+		t.Errorf("code of the next step: step = %d, valid = %v, err = %v", step, ok, err)
+	}
+}
+
+func TestValidateWrongCode(t *testing.T) {
+	if _, ok, err := Validate(rfcSecret, "000000", time.Unix(59, 0), 0); err != nil || ok {
+		t.Errorf("valid = %v, err = %v", ok, err)
+	}
+}
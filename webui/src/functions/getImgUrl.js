@@ -1,5 +0,0 @@
-export const getImgUrl = (path) => {
-    if (path) {
-        return __API_URL__ + "/photos/?photo_path=" + path
-    }
-}
\ No newline at end of file
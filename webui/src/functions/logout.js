@@ -1,4 +1,11 @@
-export const logout = () => {
+import axios from '../services/axios.js'
+
+export const logout = async () => {
+    await axios.delete('/session', {
+        headers: {
+            'Authorization': localStorage.getItem('ID')
+        }
+    }).catch(() => {}) // The session may have already expired: the client is logged out anyway
     localStorage.clear()
     window.location.href = '/'
-}
\ No newline at end of file
+}
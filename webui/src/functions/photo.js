@@ -0,0 +1,52 @@
+import axios from '../services/axios.js'
+
+// Photos are sent by the API as signed URLs, which <img src> can load as they are. Bare paths (and signed URLs that
+// have expired meanwhile) require the Authorization header instead, which <img src> cannot send: they are fetched as
+// blobs.
+const fetchBlob = async (el, path) => {
+    try {
+        let response = await axios.get('/photos/', {
+            params: {
+                photo_path: path
+            },
+            headers: {
+                'Authorization': localStorage.getItem('ID')
+            },
+            responseType: 'blob'
+        })
+        revoke(el)
+        el.src = URL.createObjectURL(response.data)
+    } catch (e) {
+        console.log(e)
+    }
+}
+
+const revoke = (el) => {
+    if (el.src && el.src.startsWith('blob:')) {
+        URL.revokeObjectURL(el.src)
+    }
+}
+
+const load = (el, value) => {
+    if (!value || el.dataset.photo === value) {
+        return
+    }
+    el.dataset.photo = value
+    if (!value.startsWith('/photos/')) {
+        fetchBlob(el, value)
+        return
+    }
+    revoke(el)
+    el.onerror = () => {
+        el.onerror = null
+        fetchBlob(el, new URLSearchParams(value.split('?')[1]).get('photo_path'))
+    }
+    el.src = __API_URL__ + value
+}
+
+// v-photo="value" loads the photo with the given signed URL (or path) into an <img>
+export const photo = {
+    mounted: (el, binding) => load(el, binding.value),
+    updated: (el, binding) => load(el, binding.value),
+    unmounted: (el) => revoke(el)
+}
@@ -4,6 +4,7 @@ import router from './router'
 import axios from './services/axios.js';
 import LoginView from './views/LoginView.vue'
 import HeaderTopBar from './components/HeaderTopBar.vue'
+import { photo } from './functions/photo.js'
 
 import './assets/css/main.css'
 
@@ -11,5 +12,6 @@ const app = createApp(App)
 app.config.globalProperties.$axios = axios;
 app.component("LoginView", LoginView)
 app.component("HeaderTopBar", HeaderTopBar)
+app.directive("photo", photo)
 app.use(router)
 app.mount('#app')